@@ -4,8 +4,14 @@ import (
 	"common"
 	"common/crypto"
 	"common/erasure"
+	"context"
+	"discovery"
+	"flag"
 	"fmt"
+	"net"
 	"network"
+	"strconv"
+	"strings"
 )
 
 // global variables
@@ -31,6 +37,7 @@ func uploadSector(sec *common.Sector) (err error) {
 	}
 
 	// calculate and store segment hashes
+	rh.SegHashes = make([]crypto.Hash, len(ring))
 	for i := range ring {
 		rh.SegHashes[i], err = crypto.CalculateHash(ring[i].Data)
 		if err != nil {
@@ -44,7 +51,7 @@ func uploadSector(sec *common.Sector) (err error) {
 		err = router.SendMessage(&common.Message{
 			Dest: rh.Hosts[i],
 			Proc: "Server.UploadSegment",
-			Args: ring[i],
+			Args: common.Upload{Sector: sec.Hash, Segment: ring[i]},
 			Resp: nil,
 		})
 		if err != nil {
@@ -68,14 +75,17 @@ func downloadSector(hash crypto.Hash) (sec *common.Sector, err error) {
 	// send requests to each member of the quorum
 	var segs []common.Segment
 	for i := range rh.Hosts {
+		// downloading is idempotent, so a failed request can be retried
 		var seg common.Segment
-		sendErr := router.SendMessage(&common.Message{
+		sendErr := common.SendWithRetry(context.Background(), router, &common.Message{
 			Dest: rh.Hosts[i],
 			Proc: "Server.DownloadSegment",
 			Args: rh.SegHashes[i],
 			Resp: &seg,
-		})
+		}, common.DefaultRetry)
 		if sendErr == nil {
+			// hosts do not know where in the ring their segment belongs
+			seg.Index = uint8(i)
 			segs = append(segs, seg)
 		} else {
 			fmt.Println(sendErr)
@@ -87,18 +97,51 @@ func downloadSector(hash crypto.Hash) (sec *common.Sector, err error) {
 	return
 }
 
-func readQuorumAddresses() (q [common.QuorumSize]common.Address) {
-	var input int
+// discoverQuorum asks the seeds for peers and returns the Server handlers of
+// the first size peers in the peer database, most recently seen first.
+func discoverQuorum(seeds []common.Address, db *discovery.PeerDB, size int) (q common.Quorum, err error) {
+	err = discovery.Discover(router, seeds, db)
+	if err != nil {
+		return
+	}
+	addresses := db.Addresses()
+	if len(addresses) < size {
+		err = fmt.Errorf("only found %v of %v participants", len(addresses), size)
+		return
+	}
+	q = common.Quorum(addresses[:size])
 	for i := range q {
-		fmt.Print("Please enter port number ", i, ": ")
-		fmt.Scanln(&input)
-		q[i] = common.Address{2, "localhost", input}
+		q[i].ID = common.ServerHandlerID
+	}
+	return
+}
+
+// parseSeeds converts a comma separated list of host:port into the
+// addresses of each seed's Discovery handler.
+func parseSeeds(list string) (seeds []common.Address, err error) {
+	if list == "" {
+		return
+	}
+	for _, seed := range strings.Split(list, ",") {
+		host, portString, err := net.SplitHostPort(seed)
+		if err != nil {
+			return nil, err
+		}
+		port, err := strconv.Atoi(portString)
+		if err != nil {
+			return nil, err
+		}
+		seeds = append(seeds, common.Address{
+			ID:   discovery.HandlerID,
+			Host: host,
+			Port: port,
+		})
 	}
 	return
 }
 
 func generateSector(q common.Quorum) (s *common.Sector, err error) {
-	if q[0].Port == 0 {
+	if len(q) == 0 {
 		err = fmt.Errorf("you must connect to a quorum first")
 		return
 	}
@@ -112,12 +155,33 @@ func generateSector(q common.Quorum) (s *common.Sector, err error) {
 	}
 	SectorDB[s.Hash] = &common.RingHeader{
 		Hosts:  q,
-		Params: s.CalculateParams(common.QuorumSize / 2),
+		Params: s.CalculateParams(len(q)/2, len(q)),
 	}
 	return
 }
 
 func main() {
+	seedList := flag.String("seeds", "", "comma separated host:port of each seed")
+	peerFile := flag.String("peers", "clientpeers.json", "file holding the peer database")
+	quorumSize := flag.Int("quorum-size", common.DefaultQuorumSize, "participants in each quorum")
+	flag.Parse()
+	seeds, err := parseSeeds(*seedList)
+	if err != nil {
+		fmt.Println("error:", err)
+		return
+	}
+	err = common.ValidateQuorumSize(*quorumSize)
+	if err != nil {
+		fmt.Println("error:", err)
+		return
+	}
+	db, err := discovery.LoadPeerDB(*peerFile)
+	if err != nil {
+		fmt.Println("error:", err)
+		return
+	}
+	defer db.Save()
+
 	router, _ = network.NewRPCServer(9989)
 	defer router.Close()
 	SectorDB = make(map[crypto.Hash]*common.RingHeader)
@@ -126,7 +190,6 @@ func main() {
 		q     common.Quorum
 		s     *common.Sector
 		h     crypto.Hash
-		err   error
 	)
 	for {
 		fmt.Print("Please enter a command: ")
@@ -137,7 +200,12 @@ func main() {
 			fmt.Println("unrecognized command")
 		case "j":
 			fmt.Println("joining quorum")
-			q = readQuorumAddresses()
+			q, err = discoverQuorum(seeds, db, *quorumSize)
+			if err != nil {
+				fmt.Println("error:", err)
+				fmt.Println("failed to find a quorum")
+				break
+			}
 			fmt.Println("connected to quorum")
 		case "g":
 			fmt.Println("generating Sector")
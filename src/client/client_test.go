@@ -12,8 +12,8 @@ type Server struct {
 	seg common.Segment
 }
 
-func (s *Server) UploadSegment(seg common.Segment, arb *struct{}) error {
-	s.seg = seg
+func (s *Server) UploadSegment(upload common.Upload, arb *struct{}) error {
+	s.seg = upload.Segment
 	return nil
 }
 
@@ -38,9 +38,10 @@ func TestRPCuploadSector(t *testing.T) {
 	defer router.Close()
 
 	// create quorum
-	var q [common.QuorumSize]common.Address
-	var shs [common.QuorumSize]Server
-	for i := 0; i < common.QuorumSize; i++ {
+	n := common.DefaultQuorumSize
+	q := make(common.Quorum, n)
+	shs := make([]Server, n)
+	for i := 0; i < n; i++ {
 		q[i] = common.Address{0, "localhost", 9000 + i}
 		qrpc, err := network.NewRPCServer(9000 + i)
 		defer qrpc.Close()
@@ -62,10 +63,10 @@ func TestRPCuploadSector(t *testing.T) {
 	}
 
 	// add sector to database
-	k := common.QuorumSize / 2
+	k := n / 2
 	SectorDB[sec.Hash] = &common.RingHeader{
 		Hosts:  q,
-		Params: sec.CalculateParams(k),
+		Params: sec.CalculateParams(k, n),
 	}
 
 	// upload sector to quorum
@@ -114,8 +115,9 @@ func TestRPCdownloadSector(t *testing.T) {
 		t.Fatal("Failed to create sector:", err)
 	}
 
-	k := common.QuorumSize / 2
-	params := sec.CalculateParams(k)
+	n := common.DefaultQuorumSize
+	k := n / 2
+	params := sec.CalculateParams(k, n)
 
 	// encode sector
 	ring, err := erasure.EncodeRing(sec, params)
@@ -131,8 +133,8 @@ func TestRPCdownloadSector(t *testing.T) {
 	defer router.Close()
 
 	// create quorum
-	var q [common.QuorumSize]common.Address
-	for i := 0; i < common.QuorumSize; i++ {
+	q := make(common.Quorum, n)
+	for i := 0; i < n; i++ {
 		q[i] = common.Address{0, "localhost", 9000 + i}
 		qrpc, err := network.NewRPCServer(9000 + i)
 		if err != nil {
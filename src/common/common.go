@@ -3,6 +3,7 @@
 package common
 
 import (
+	"fmt"
 	"time"
 )
 
@@ -14,16 +15,31 @@ const (
 	MinSegmentSize int = 512
 	MaxSegmentSize int = 1048576 // 1 MB
 
-	// How many participants are in each quorum
-	// This number is chosen to minimize the probability of a single quorum
-	// 	becoming more than 80% compromised by an attacker controlling 1/2 of
-	// 	the network.
-	QuorumSize int = 4
+	// How many participants are in each quorum, unless configured otherwise
+	// The whitepaper chooses 128 to minimize the probability of a single
+	// 	quorum becoming more than 80% compromised by an attacker controlling
+	// 	1/2 of the network; small quorums are useful for testing.
+	DefaultQuorumSize int = 4
 
-	// How long a single step in the consensus algorithm takes
-	StepDuration time.Duration = 3 * time.Second
+	// Bounds on the quorum size. Redundancy needs at least two participants,
+	// and participant indices are a byte, with 255 meaning "not yet joined".
+	MinQuorumSize int = 2
+	MaxQuorumSize int = 255
+
+	// How long a single step in the consensus algorithm takes, until the
+	// quorum adjusts it to the network
+	DefaultStepDuration time.Duration = 3 * time.Second
 )
 
 type Entropy [EntropyVolume]byte
 
-type Quorum [QuorumSize]Address
+// A Quorum is the address of each participant, in index order.
+type Quorum []Address
+
+// ValidateQuorumSize returns an error if n is not a usable quorum size.
+func ValidateQuorumSize(n int) error {
+	if n < MinQuorumSize || n > MaxQuorumSize {
+		return fmt.Errorf("quorum size %v is not between %v and %v", n, MinQuorumSize, MaxQuorumSize)
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package crypto
+
+import (
+	"common/encoding"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"errors"
+	"math/big"
+)
+
+// coordinateSize is the width of a P-521 coordinate or signature component.
+const coordinateSize = 66
+
+// PublicKeySize is the length of a canonically encoded PublicKey: the
+// uncompressed point, as produced by elliptic.Marshal.
+const PublicKeySize = 1 + 2*coordinateSize
+
+var errNilKey = errors.New("cannot encode a nil key")
+var errInvalidKey = errors.New("encoded key is not a point on the curve")
+var errNilSignature = errors.New("cannot encode a nil signature")
+var errSignatureRange = errors.New("signature component is too large")
+
+// EncodeTo writes the key as an uncompressed P-521 point, PublicKeySize
+// bytes long.
+func (pk *PublicKey) EncodeTo(e *encoding.Encoder) {
+	if pk == nil || pk.X == nil || pk.Y == nil {
+		e.Fail(errNilKey)
+		return
+	}
+	e.WriteFixed(elliptic.Marshal(elliptic.P521(), pk.X, pk.Y))
+}
+
+// DecodeFrom reads a key written by EncodeTo, rejecting points that are not
+// on the curve.
+func (pk *PublicKey) DecodeFrom(d *encoding.Decoder) {
+	var point [PublicKeySize]byte
+	d.ReadFixed(point[:])
+	if d.Err() != nil {
+		return
+	}
+	x, y := elliptic.Unmarshal(elliptic.P521(), point[:])
+	if x == nil {
+		d.Fail(errInvalidKey)
+		return
+	}
+	*pk = PublicKey(ecdsa.PublicKey{Curve: elliptic.P521(), X: x, Y: y})
+}
+
+// EncodeTo writes R and then S, each as a big-endian integer padded to
+// coordinateSize bytes.
+func (sig *Signature) EncodeTo(e *encoding.Encoder) {
+	if sig.R == nil || sig.S == nil {
+		e.Fail(errNilSignature)
+		return
+	}
+	for _, v := range []*big.Int{sig.R, sig.S} {
+		if v.Sign() < 0 || v.BitLen() > 8*coordinateSize {
+			e.Fail(errSignatureRange)
+			return
+		}
+		var b [coordinateSize]byte
+		v.FillBytes(b[:])
+		e.WriteFixed(b[:])
+	}
+}
+
+// DecodeFrom reads a signature written by EncodeTo.
+func (sig *Signature) DecodeFrom(d *encoding.Decoder) {
+	var r, s [coordinateSize]byte
+	d.ReadFixed(r[:])
+	d.ReadFixed(s[:])
+	if d.Err() != nil {
+		return
+	}
+	sig.R = new(big.Int).SetBytes(r[:])
+	sig.S = new(big.Int).SetBytes(s[:])
+}
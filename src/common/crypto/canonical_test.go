@@ -0,0 +1,94 @@
+package crypto
+
+import (
+	"common/encoding"
+	"crypto/elliptic"
+	"encoding/hex"
+	"math/big"
+	"strings"
+	"testing"
+)
+
+// the P-521 generator, as an uncompressed point
+const goldenGenerator = "04" +
+	"00c6858e06b70404e9cd9e3ecb662395b4429c648139053fb521f828af606b4d3dbaa14b5e77efe75928fe1dc127a2ffa8de3348b3c1856a429bf97e7e31c2e5bd66" +
+	"011839296a789a3bc0045c8a5fb42c7d1bd998f54449579b446817afbd17273e662c97ee72995ef42640c550b9013fad0761353c7086a272c24088be94769fd16650"
+
+func TestGoldenPublicKey(t *testing.T) {
+	c := elliptic.P521()
+	pk := &PublicKey{Curve: c, X: c.Params().Gx, Y: c.Params().Gy}
+	encoded, err := encoding.Marshal(pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(encoded) != goldenGenerator {
+		t.Fatalf("public key encoding changed: %x", encoded)
+	}
+
+	decoded := new(PublicKey)
+	err = encoding.Unmarshal(encoded, decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.Compare(pk) {
+		t.Error("public key changed in encoding")
+	}
+
+	// a point off the curve is rejected
+	encoded[len(encoded)-1] ^= 1
+	if encoding.Unmarshal(encoded, decoded) == nil {
+		t.Error("decoded a point that is not on the curve")
+	}
+	var nilKey *PublicKey
+	if _, err = encoding.Marshal(nilKey); err == nil {
+		t.Error("encoded a nil key")
+	}
+}
+
+// Signatures are padded to a fixed width, and a SignedMessage is its
+// signature followed by the length-prefixed message.
+func TestGoldenSignedMessage(t *testing.T) {
+	sm := &SignedMessage{
+		Signature: Signature{R: big.NewInt(1), S: big.NewInt(2)},
+		Message:   []byte("sia"),
+	}
+	combined, err := sm.CombinedMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	golden := strings.Repeat("00", 65) + "01" + strings.Repeat("00", 65) + "02" + "00000003736961"
+	if hex.EncodeToString(combined) != golden {
+		t.Fatalf("signed message encoding changed: %x", combined)
+	}
+
+	decoded := new(SignedMessage)
+	err = encoding.Unmarshal(combined, decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Signature.R.Int64() != 1 || decoded.Signature.S.Int64() != 2 || string(decoded.Message) != "sia" {
+		t.Error("signed message changed in encoding:", decoded)
+	}
+
+	sm.Signature.R = nil
+	if _, err = sm.CombinedMessage(); err == nil {
+		t.Error("encoded a nil signature")
+	}
+}
+
+// A signature covers the whole message, however long.
+func TestSignLongMessage(t *testing.T) {
+	publicKey, secretKey, err := CreateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := make([]byte, 1000)
+	signed, err := secretKey.Sign(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed.Message[999] = 1
+	if publicKey.Verify(&signed) {
+		t.Error("verified a message that was changed past the curve width")
+	}
+}
@@ -0,0 +1,221 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/pbkdf2"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+)
+
+// Keys are stored as PEM blocks so that key files are plain text and can
+// be inspected with standard tools. The block bytes are the standard DER
+// encodings: SEC 1 for secret keys and PKIX for public keys.
+//
+// An encrypted secret key stores the SEC 1 bytes sealed with AES-256-GCM.
+// The AES key is derived from the passphrase with PBKDF2-SHA512, using the
+// salt and iteration count recorded in the block headers.
+const (
+	secretKeyBlock          = "SIA SECRET KEY"
+	encryptedSecretKeyBlock = "SIA ENCRYPTED SECRET KEY"
+	publicKeyBlock          = "SIA PUBLIC KEY"
+
+	keyIterations = 100000
+	keySaltSize   = 32
+)
+
+// Public returns the public half of the secret key.
+func (secKey *SecretKey) Public() *PublicKey {
+	pk := PublicKey(secKey.PublicKey)
+	return &pk
+}
+
+// MarshalPEM encodes the secret key as a PEM block. If passphrase is
+// non-empty, the key is encrypted with it.
+func (secKey *SecretKey) MarshalPEM(passphrase []byte) (encoded []byte, err error) {
+	if secKey == nil {
+		err = fmt.Errorf("Cannot marshal a nil SecretKey")
+		return
+	}
+	der, err := x509.MarshalECPrivateKey((*ecdsa.PrivateKey)(secKey))
+	if err != nil {
+		return
+	}
+
+	block := &pem.Block{Type: secretKeyBlock, Bytes: der}
+	if len(passphrase) != 0 {
+		block, err = encryptKeyBlock(der, passphrase)
+		if err != nil {
+			return
+		}
+	}
+	encoded = pem.EncodeToMemory(block)
+	return
+}
+
+// UnmarshalSecretKey decodes a secret key produced by MarshalPEM. The
+// passphrase is ignored for keys that are not encrypted.
+func UnmarshalSecretKey(encoded []byte, passphrase []byte) (secKey SecretKey, err error) {
+	block, _ := pem.Decode(encoded)
+	if block == nil {
+		err = fmt.Errorf("no PEM block found")
+		return
+	}
+
+	der := block.Bytes
+	switch block.Type {
+	case secretKeyBlock:
+	case encryptedSecretKeyBlock:
+		der, err = decryptKeyBlock(block, passphrase)
+		if err != nil {
+			return
+		}
+	default:
+		err = fmt.Errorf("unexpected PEM block type %q", block.Type)
+		return
+	}
+
+	key, err := x509.ParseECPrivateKey(der)
+	if err != nil {
+		return
+	}
+	secKey = SecretKey(*key)
+	return
+}
+
+// MarshalPEM encodes the public key as a PEM block.
+func (pk *PublicKey) MarshalPEM() (encoded []byte, err error) {
+	if pk == nil {
+		err = fmt.Errorf("Cannot marshal a nil PublicKey")
+		return
+	}
+	der, err := x509.MarshalPKIXPublicKey((*ecdsa.PublicKey)(pk))
+	if err != nil {
+		return
+	}
+	encoded = pem.EncodeToMemory(&pem.Block{Type: publicKeyBlock, Bytes: der})
+	return
+}
+
+// UnmarshalPublicKey decodes a public key produced by PublicKey.MarshalPEM.
+func UnmarshalPublicKey(encoded []byte) (pk *PublicKey, err error) {
+	block, _ := pem.Decode(encoded)
+	if block == nil || block.Type != publicKeyBlock {
+		err = fmt.Errorf("no %v PEM block found", publicKeyBlock)
+		return
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return
+	}
+	ecdsaKey, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		err = fmt.Errorf("key is not an ecdsa public key")
+		return
+	}
+	pk = (*PublicKey)(ecdsaKey)
+	return
+}
+
+// SaveSecretKey writes the secret key to a file readable only by its owner.
+func SaveSecretKey(filename string, secKey *SecretKey, passphrase []byte) (err error) {
+	encoded, err := secKey.MarshalPEM(passphrase)
+	if err != nil {
+		return
+	}
+	return ioutil.WriteFile(filename, encoded, 0600)
+}
+
+// LoadSecretKey reads a secret key written by SaveSecretKey.
+func LoadSecretKey(filename string, passphrase []byte) (secKey SecretKey, err error) {
+	encoded, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return
+	}
+	return UnmarshalSecretKey(encoded, passphrase)
+}
+
+// keyCipher derives the AES-GCM cipher for a passphrase and salt.
+func keyCipher(passphrase []byte, salt []byte, iterations int) (aead cipher.AEAD, err error) {
+	key, err := pbkdf2.Key(sha512.New, string(passphrase), salt, iterations, 32)
+	if err != nil {
+		return
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptKeyBlock seals der under the passphrase.
+func encryptKeyBlock(der []byte, passphrase []byte) (block *pem.Block, err error) {
+	salt, err := RandomByteSlice(keySaltSize)
+	if err != nil {
+		return
+	}
+	aead, err := keyCipher(passphrase, salt, keyIterations)
+	if err != nil {
+		return
+	}
+	nonce, err := RandomByteSlice(aead.NonceSize())
+	if err != nil {
+		return
+	}
+
+	block = &pem.Block{
+		Type: encryptedSecretKeyBlock,
+		Headers: map[string]string{
+			"KDF":        "PBKDF2-SHA512",
+			"Iterations": strconv.Itoa(keyIterations),
+			"Salt":       hex.EncodeToString(salt),
+			"Nonce":      hex.EncodeToString(nonce),
+		},
+		Bytes: aead.Seal(nil, nonce, der, nil),
+	}
+	return
+}
+
+// decryptKeyBlock opens a block sealed by encryptKeyBlock.
+func decryptKeyBlock(block *pem.Block, passphrase []byte) (der []byte, err error) {
+	if len(passphrase) == 0 {
+		err = fmt.Errorf("key is encrypted and no passphrase was given")
+		return
+	}
+	if block.Headers["KDF"] != "PBKDF2-SHA512" {
+		err = fmt.Errorf("unsupported key derivation %q", block.Headers["KDF"])
+		return
+	}
+	iterations, err := strconv.Atoi(block.Headers["Iterations"])
+	if err != nil {
+		return
+	}
+	salt, err := hex.DecodeString(block.Headers["Salt"])
+	if err != nil {
+		return
+	}
+	nonce, err := hex.DecodeString(block.Headers["Nonce"])
+	if err != nil {
+		return
+	}
+
+	aead, err := keyCipher(passphrase, salt, iterations)
+	if err != nil {
+		return
+	}
+	if len(nonce) != aead.NonceSize() {
+		err = fmt.Errorf("invalid nonce size")
+		return
+	}
+	der, err = aead.Open(nil, nonce, block.Bytes, nil)
+	if err != nil {
+		err = fmt.Errorf("wrong passphrase or corrupt key")
+	}
+	return
+}
@@ -0,0 +1,102 @@
+package crypto
+
+import (
+	"os"
+	"testing"
+)
+
+// Secret keys survive a round trip, with and without a passphrase, and the
+// passphrase is enforced.
+func TestSecretKeyEncoding(t *testing.T) {
+	pubKey, secKey, err := CreateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// unencrypted
+	encoded, err := secKey.MarshalPEM(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := UnmarshalSecretKey(encoded, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.Public().Compare(pubKey) || decoded.D.Cmp(secKey.D) != 0 {
+		t.Error("Decoded secret key does not match the original")
+	}
+
+	// encrypted
+	passphrase := []byte("correct horse battery staple")
+	encoded, err = secKey.MarshalPEM(passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err = UnmarshalSecretKey(encoded, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.D.Cmp(secKey.D) != 0 {
+		t.Error("Decrypted secret key does not match the original")
+	}
+	_, err = UnmarshalSecretKey(encoded, []byte("wrong"))
+	if err == nil {
+		t.Error("Decrypted a secret key with the wrong passphrase")
+	}
+	_, err = UnmarshalSecretKey(encoded, nil)
+	if err == nil {
+		t.Error("Decrypted a secret key without a passphrase")
+	}
+
+	// a key loaded from disk still signs verifiably
+	err = SaveSecretKey("test.key", &secKey, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("test.key")
+	loaded, err := LoadSecretKey("test.key", passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := loaded.Sign([]byte("message"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pubKey.Verify(&signed) {
+		t.Error("Signature from a loaded key did not verify")
+	}
+
+	// bad input
+	var nilKey *SecretKey
+	_, err = nilKey.MarshalPEM(nil)
+	if err == nil {
+		t.Error("Marshalled a nil secret key")
+	}
+	_, err = UnmarshalSecretKey([]byte("not a key"), nil)
+	if err == nil {
+		t.Error("Unmarshalled garbage as a secret key")
+	}
+}
+
+func TestPublicKeyPEM(t *testing.T) {
+	pubKey, _, err := CreateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := pubKey.MarshalPEM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := UnmarshalPublicKey(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.Compare(pubKey) {
+		t.Error("Decoded public key does not match the original")
+	}
+
+	_, err = UnmarshalPublicKey([]byte("not a key"))
+	if err == nil {
+		t.Error("Unmarshalled garbage as a public key")
+	}
+}
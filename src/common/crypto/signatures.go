@@ -1,11 +1,10 @@
 package crypto
 
 import (
-	"bytes"
+	"common/encoding"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
-	"encoding/gob"
 	"fmt"
 )
 
@@ -14,22 +13,26 @@ type SignedMessage struct {
 	Message   []byte
 }
 
-// Return a []byte containing both the message and the prepended signature
+// Return a []byte containing both the message and the prepended signature,
+// in their canonical encoding
 func (sm *SignedMessage) CombinedMessage() (combinedMessage []byte, err error) {
 	if sm == nil {
 		err = fmt.Errorf("Cannot combine a nil signedMessage")
 		return
 	}
+	return encoding.Marshal(sm)
+}
 
-	w := new(bytes.Buffer)
-	encoder := gob.NewEncoder(w)
-	err = encoder.Encode(sm)
-	if err != nil {
-		return
-	}
+// EncodeTo writes the signature followed by the length-prefixed message.
+func (sm *SignedMessage) EncodeTo(e *encoding.Encoder) {
+	sm.Signature.EncodeTo(e)
+	e.WriteBytes(sm.Message)
+}
 
-	combinedMessage = w.Bytes()
-	return
+// DecodeFrom reads a SignedMessage written by EncodeTo.
+func (sm *SignedMessage) DecodeFrom(d *encoding.Decoder) {
+	sm.Signature.DecodeFrom(d)
+	sm.Message = d.ReadBytes()
 }
 
 // CreateKeyPair needs no input, produces a public key and secret key as output
@@ -42,6 +45,8 @@ func CreateKeyPair() (publicKey *PublicKey, secretKey SecretKey, err error) {
 
 // Sign takes a secret key and a message, and use the secret key to sign the message.
 // Sign returns a single SignedMessage struct containing a Message and a Signature
+// The signature covers the hash of the message, as ecdsa only uses as many
+// bytes of what it signs as the curve is wide.
 func (secKey *SecretKey) Sign(message []byte) (signedMessage SignedMessage, err error) {
 	if secKey == nil {
 		err = fmt.Errorf("Cannot sign using a nil SecretKey")
@@ -53,8 +58,12 @@ func (secKey *SecretKey) Sign(message []byte) (signedMessage SignedMessage, err
 		return
 	}
 
+	hash, err := CalculateHash(message)
+	if err != nil {
+		return
+	}
 	ecdsaKey := (*ecdsa.PrivateKey)(secKey)
-	r, s, err := ecdsa.Sign(rand.Reader, ecdsaKey, []byte(message))
+	r, s, err := ecdsa.Sign(rand.Reader, ecdsaKey, hash[:])
 	signedMessage.Signature.R = r
 	signedMessage.Signature.S = s
 	signedMessage.Message = message
@@ -67,8 +76,15 @@ func (pk *PublicKey) Verify(signedMessage *SignedMessage) (verified bool) {
 	if pk == nil || signedMessage == nil {
 		return false
 	}
+	if signedMessage.Signature.R == nil || signedMessage.Signature.S == nil {
+		return false
+	}
 
+	hash, err := CalculateHash(signedMessage.Message)
+	if err != nil {
+		return false
+	}
 	ecdsaKey := (*ecdsa.PublicKey)(pk)
-	verified = ecdsa.Verify(ecdsaKey, []byte(signedMessage.Message), signedMessage.Signature.R, signedMessage.Signature.S)
+	verified = ecdsa.Verify(ecdsaKey, hash[:], signedMessage.Signature.R, signedMessage.Signature.S)
 	return
 }
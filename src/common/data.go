@@ -20,29 +20,43 @@ func NewSector(data []byte) (s *Sector, err error) {
 }
 
 // A Segment is an erasure-coded piece of a Sector, containing both a subset of the original data and its corresponding index.
-// A set of QuorumSize Segments forms a Ring.
+// A set of one Segment per quorum participant forms a Ring.
 type Segment struct {
 	Data  []byte
 	Index uint8
 }
 
+// ServerHandlerID is the ID at which every host serves clients, through
+// "Server.UploadSegment" and "Server.DownloadSegment".
+const ServerHandlerID Identifier = 4
+
+// An Upload is a Segment sent to the host that stores it. It names the
+// Sector the segment belongs to, so that the host can check that the quorum
+// expects it.
+type Upload struct {
+	Sector  crypto.Hash
+	Segment Segment
+}
+
 // A RingHeader contains all the metadata necessary to retrieve and rebuild a Sector from a Ring.
 // This includes the hosts on which Ring Segments are stored, the encoding parameters, the hashes of each Segment.
 type RingHeader struct {
 	Hosts     Quorum
 	Params    *EncodingParams
-	SegHashes [QuorumSize]crypto.Hash
+	SegHashes []crypto.Hash // one per host
 }
 
 // EncodingParams are the parameters needed to perform erasure encoding and decoding.
-// k is the number of non-redundant segments, and b is the number of bytes per segment.
+// k is the number of non-redundant segments, n is the total number of segments,
+// and b is the number of bytes per segment.
 // The length is also stored, because the encoding process may introduce padding.
 type EncodingParams struct {
-	k, b, length int
+	k, n, b, length int
 }
 
-// CalculateParams creates a set of encoding parameters given a Sector and a k value.
-func (s *Sector) CalculateParams(k int) *EncodingParams {
+// CalculateParams creates a set of encoding parameters given a Sector, a k
+// value, and the number of segments n, which is the size of the quorum.
+func (s *Sector) CalculateParams(k int, n int) *EncodingParams {
 	// calculate length
 	length := len(s.Data)
 
@@ -52,9 +66,14 @@ func (s *Sector) CalculateParams(k int) *EncodingParams {
 		b += 64 - (b % 64) // round up to nearest multiple of 64
 	}
 
-	return &EncodingParams{k, b, length}
+	return &EncodingParams{k, n, b, length}
 }
 
 func (e *EncodingParams) GetValues() (int, int, int) {
 	return e.k, e.b, e.length
 }
+
+// RingSize returns the number of segments in a Ring, n.
+func (e *EncodingParams) RingSize() int {
+	return e.n
+}
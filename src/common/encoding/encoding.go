@@ -0,0 +1,262 @@
+// Package encoding is the canonical binary encoding of everything that is
+// hashed or signed. Unlike gob, it produces exactly one encoding for each
+// value, on every node and every version of Go, so a signature made by one
+// node verifies on every other.
+//
+// The rules are:
+//   - unsigned integers are big-endian, in exactly the width of their type
+//   - signed integers are encoded as the two's complement unsigned integer
+//     of the same width
+//   - booleans are one byte, 0 or 1
+//   - fixed-size arrays are their bytes, with no length
+//   - byte slices and strings are a uint32 length followed by their bytes
+//   - lists are a uint32 count followed by each element in order
+//   - structs are their fields in declaration order, with no tags or names
+//
+// New types, such as blocks, must be encoded by these rules, and their
+// layout documented next to their EncodeTo method. Decoders reject
+// anything that is not the canonical encoding, including trailing bytes, so
+// that two different byte strings never decode to the same value.
+package encoding
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// MaxLength bounds the length of any slice or list, so that a corrupt length
+// cannot make a decoder allocate an unreasonable amount of memory.
+const MaxLength = 1 << 24
+
+var errTrailingBytes = errors.New("canonical encoding has trailing bytes")
+var errTruncated = errors.New("canonical encoding is truncated")
+
+// Encodable is implemented by types with a canonical encoding.
+type Encodable interface {
+	EncodeTo(e *Encoder)
+}
+
+// Decodable is implemented by types that can be decoded from their
+// canonical encoding.
+type Decodable interface {
+	DecodeFrom(d *Decoder)
+}
+
+// Marshal returns the canonical encoding of v.
+func Marshal(v Encodable) (b []byte, err error) {
+	e := new(Encoder)
+	v.EncodeTo(e)
+	return e.Bytes(), e.Err()
+}
+
+// Unmarshal decodes b into v, failing unless b is exactly the canonical
+// encoding of a value.
+func Unmarshal(b []byte, v Decodable) error {
+	d := NewDecoder(b)
+	v.DecodeFrom(d)
+	return d.Finish()
+}
+
+// An Encoder appends canonical encodings to a buffer. Like a Decoder, it
+// keeps the first error, which is returned by Err.
+type Encoder struct {
+	buf []byte
+	err error
+}
+
+// Bytes returns everything encoded so far.
+func (e *Encoder) Bytes() []byte {
+	return e.buf
+}
+
+// Err returns the first error encountered.
+func (e *Encoder) Err() error {
+	return e.err
+}
+
+// Fail records err, unless an error has already been recorded. It lets
+// types refuse to encode values that are not valid.
+func (e *Encoder) Fail(err error) {
+	if e.err == nil {
+		e.err = err
+	}
+}
+
+func (e *Encoder) WriteUint8(v uint8) {
+	e.buf = append(e.buf, v)
+}
+
+func (e *Encoder) WriteUint16(v uint16) {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], v)
+	e.buf = append(e.buf, b[:]...)
+}
+
+func (e *Encoder) WriteUint32(v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	e.buf = append(e.buf, b[:]...)
+}
+
+func (e *Encoder) WriteUint64(v uint64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	e.buf = append(e.buf, b[:]...)
+}
+
+func (e *Encoder) WriteInt64(v int64) {
+	e.WriteUint64(uint64(v))
+}
+
+func (e *Encoder) WriteBool(v bool) {
+	if v {
+		e.WriteUint8(1)
+	} else {
+		e.WriteUint8(0)
+	}
+}
+
+// WriteFixed writes the bytes of a fixed-size array, with no length.
+func (e *Encoder) WriteFixed(b []byte) {
+	e.buf = append(e.buf, b...)
+}
+
+// WriteBytes writes a length-prefixed byte slice.
+func (e *Encoder) WriteBytes(b []byte) {
+	e.WriteUint32(uint32(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+func (e *Encoder) WriteString(s string) {
+	e.WriteBytes([]byte(s))
+}
+
+// WriteLength writes the count that precedes the elements of a list.
+func (e *Encoder) WriteLength(n int) {
+	e.WriteUint32(uint32(n))
+}
+
+// A Decoder reads canonical encodings from a byte slice. The first error is
+// kept, and every read after it returns zero values, so a sequence of reads
+// only needs to be checked once, by Finish.
+type Decoder struct {
+	data []byte
+	err  error
+}
+
+// NewDecoder creates a Decoder that reads from data.
+func NewDecoder(data []byte) *Decoder {
+	return &Decoder{data: data}
+}
+
+// Err returns the first error encountered.
+func (d *Decoder) Err() error {
+	return d.err
+}
+
+// Fail records err, unless an error has already been recorded. It lets
+// types reject values that decode but are not valid.
+func (d *Decoder) Fail(err error) {
+	if d.err == nil {
+		d.err = err
+	}
+}
+
+// Finish returns the first error encountered, or an error if any bytes were
+// left unread.
+func (d *Decoder) Finish() error {
+	if d.err == nil && len(d.data) != 0 {
+		d.err = errTrailingBytes
+	}
+	return d.err
+}
+
+// next consumes n bytes, returning nil if there are not enough.
+func (d *Decoder) next(n int) (b []byte) {
+	if d.err != nil {
+		return
+	}
+	if n > len(d.data) {
+		d.err = errTruncated
+		return
+	}
+	b = d.data[:n]
+	d.data = d.data[n:]
+	return
+}
+
+func (d *Decoder) ReadUint8() uint8 {
+	b := d.next(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (d *Decoder) ReadUint16() uint16 {
+	b := d.next(2)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint16(b)
+}
+
+func (d *Decoder) ReadUint32() uint32 {
+	b := d.next(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (d *Decoder) ReadUint64() uint64 {
+	b := d.next(8)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
+
+func (d *Decoder) ReadInt64() int64 {
+	return int64(d.ReadUint64())
+}
+
+// ReadBool rejects any byte other than 0 or 1.
+func (d *Decoder) ReadBool() bool {
+	switch d.ReadUint8() {
+	case 0:
+		return false
+	case 1:
+		return true
+	}
+	d.Fail(fmt.Errorf("boolean is neither 0 nor 1"))
+	return false
+}
+
+// ReadFixed fills b with the bytes of a fixed-size array.
+func (d *Decoder) ReadFixed(b []byte) {
+	copy(b, d.next(len(b)))
+}
+
+// ReadLength reads the count that precedes a list or slice.
+func (d *Decoder) ReadLength() int {
+	n := d.ReadUint32()
+	if n > MaxLength {
+		d.Fail(fmt.Errorf("length %v exceeds the maximum of %v", n, MaxLength))
+		return 0
+	}
+	return int(n)
+}
+
+// ReadBytes reads a length-prefixed byte slice. The result is a copy, and is
+// never nil, even when empty.
+func (d *Decoder) ReadBytes() []byte {
+	n := d.ReadLength()
+	b := d.next(n)
+	return append([]byte{}, b...)
+}
+
+func (d *Decoder) ReadString() string {
+	return string(d.ReadBytes())
+}
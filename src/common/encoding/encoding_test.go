@@ -0,0 +1,72 @@
+package encoding
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+// Every primitive encodes to exactly the bytes described in the package
+// documentation.
+func TestGoldenPrimitives(t *testing.T) {
+	e := new(Encoder)
+	e.WriteUint8(0x01)
+	e.WriteUint16(0x0203)
+	e.WriteUint32(0x04050607)
+	e.WriteUint64(0x08090a0b0c0d0e0f)
+	e.WriteInt64(-2)
+	e.WriteBool(true)
+	e.WriteBool(false)
+	e.WriteFixed([]byte{0xaa, 0xbb})
+	e.WriteBytes([]byte{0xcc})
+	e.WriteString("sia")
+	e.WriteLength(0)
+	if e.Err() != nil {
+		t.Fatal(e.Err())
+	}
+
+	golden := "01" + "0203" + "04050607" + "08090a0b0c0d0e0f" + "fffffffffffffffe" +
+		"01" + "00" + "aabb" + "00000001cc" + "00000003736961" + "00000000"
+	if hex.EncodeToString(e.Bytes()) != golden {
+		t.Fatalf("encoding changed:\n got %x\nwant %v", e.Bytes(), golden)
+	}
+
+	d := NewDecoder(e.Bytes())
+	fixed := make([]byte, 2)
+	if d.ReadUint8() != 0x01 || d.ReadUint16() != 0x0203 || d.ReadUint32() != 0x04050607 ||
+		d.ReadUint64() != 0x08090a0b0c0d0e0f || d.ReadInt64() != -2 || !d.ReadBool() || d.ReadBool() {
+		t.Error("integers decoded incorrectly")
+	}
+	d.ReadFixed(fixed)
+	if !bytes.Equal(fixed, []byte{0xaa, 0xbb}) || !bytes.Equal(d.ReadBytes(), []byte{0xcc}) ||
+		d.ReadString() != "sia" || d.ReadLength() != 0 {
+		t.Error("bytes decoded incorrectly")
+	}
+	if err := d.Finish(); err != nil {
+		t.Error(err)
+	}
+}
+
+// Only canonical encodings decode.
+func TestNonCanonical(t *testing.T) {
+	bad := map[string]string{
+		"trailing bytes": "0100",
+		"truncated":      "00000005aabb",
+		"bad boolean":    "02",
+		"huge length":    "ffffffff",
+	}
+	for name, encoded := range bad {
+		b, _ := hex.DecodeString(encoded)
+		d := NewDecoder(b)
+		if name == "bad boolean" {
+			d.ReadBool()
+		} else if name == "trailing bytes" {
+			d.ReadUint8()
+		} else {
+			d.ReadBytes()
+		}
+		if d.Finish() == nil {
+			t.Error("decoded a value with", name)
+		}
+	}
+}
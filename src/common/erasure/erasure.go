@@ -21,20 +21,26 @@ import (
 	"unsafe"
 )
 
-// EncodeRing takes a Sector and encodes it as a Ring: a set of common.QuorumSize Segments that include redundancy.
+// EncodeRing takes a Sector and encodes it as a Ring: a set of n Segments that include redundancy.
 // The encoding parameters are stored in params.
-// k is the number of non-redundant segments, and b is the size of each segment. b is calculated from k.
+// k is the number of non-redundant segments, n is the total number of segments, and b is the size of each segment.
+// b is calculated from k.
 // The erasure-coding algorithm requires that the original data must be k*b in size, so it is padded here as needed.
 //
 // The return value is a Ring.
 // The first k Segments of the Ring are the original data split up.
 // The remaining Segments are newly generated redundant data.
-func EncodeRing(sec *common.Sector, params *common.EncodingParams) (ring [common.QuorumSize]common.Segment, err error) {
+func EncodeRing(sec *common.Sector, params *common.EncodingParams) (ring []common.Segment, err error) {
 	k, b, length := params.GetValues()
+	n := params.RingSize()
 
-	// check for legal size of k
-	if k <= 0 || k >= common.QuorumSize {
-		err = fmt.Errorf("k must be greater than 0 and smaller than %v", common.QuorumSize)
+	// check for legal size of n and k
+	err = common.ValidateQuorumSize(n)
+	if err != nil {
+		return
+	}
+	if k <= 0 || k >= n {
+		err = fmt.Errorf("k must be greater than 0 and smaller than %v", n)
 		return
 	}
 
@@ -48,8 +54,8 @@ func EncodeRing(sec *common.Sector, params *common.EncodingParams) (ring [common
 	if length != len(sec.Data) {
 		err = fmt.Errorf("length mismatch: sector length %v != parameter length %v", len(sec.Data), length)
 		return
-	} else if length > common.MaxSegmentSize*common.QuorumSize {
-		err = fmt.Errorf("length must be smaller than %v", common.MaxSegmentSize*common.QuorumSize)
+	} else if length > common.MaxSegmentSize*n {
+		err = fmt.Errorf("length must be smaller than %v", common.MaxSegmentSize*n)
 	}
 
 	// pad data as needed
@@ -57,11 +63,12 @@ func EncodeRing(sec *common.Sector, params *common.EncodingParams) (ring [common
 	paddedData := append(sec.Data, bytes.Repeat([]byte{0x00}, padding)...)
 
 	// call the encoding function
-	m := common.QuorumSize - k
+	m := n - k
 	redundantChunk := C.encodeRedundancy(C.int(k), C.int(m), C.int(b), (*C.char)(unsafe.Pointer(&paddedData[0])))
 	redundantBytes := C.GoBytes(unsafe.Pointer(redundantChunk), C.int(m*b))
 
 	// split paddedData into ring
+	ring = make([]common.Segment, n)
 	for i := 0; i < k; i++ {
 		ring[i] = common.Segment{
 			paddedData[i*b : (i+1)*b],
@@ -70,7 +77,7 @@ func EncodeRing(sec *common.Sector, params *common.EncodingParams) (ring [common
 	}
 
 	// split redundantString into ring
-	for i := k; i < common.QuorumSize; i++ {
+	for i := k; i < n; i++ {
 		ring[i] = common.Segment{
 			redundantBytes[(i-k)*b : (i-k+1)*b],
 			uint8(i),
@@ -91,14 +98,15 @@ func EncodeRing(sec *common.Sector, params *common.EncodingParams) (ring [common
 // Each Segment's Data must have the correct Index from when it was encoded.
 func RebuildSector(ring []common.Segment, params *common.EncodingParams) (sec *common.Sector, err error) {
 	k, b, length := params.GetValues()
+	n := params.RingSize()
 	if k == 0 && b == 0 {
 		err = fmt.Errorf("could not rebuild using uninitialized encoding parameters")
 		return
 	}
 
 	// check for legal size of k
-	if k > common.QuorumSize || k < 1 {
-		err = fmt.Errorf("k must be greater than 0 but smaller than %v", common.QuorumSize)
+	if k > n || k < 1 {
+		err = fmt.Errorf("k must be greater than 0 but smaller than %v", n)
 		return
 	}
 
@@ -109,8 +117,8 @@ func RebuildSector(ring []common.Segment, params *common.EncodingParams) (sec *c
 	}
 
 	// check for legal size of length
-	if length > common.MaxSegmentSize*common.QuorumSize {
-		err = fmt.Errorf("length must be smaller than %v", common.MaxSegmentSize*common.QuorumSize)
+	if length > common.MaxSegmentSize*n {
+		err = fmt.Errorf("length must be smaller than %v", common.MaxSegmentSize*n)
 	}
 
 	// check for correct number of segments
@@ -135,7 +143,7 @@ func RebuildSector(ring []common.Segment, params *common.EncodingParams) (sec *c
 
 	}
 	// call the recovery function
-	C.recoverData(C.int(k), C.int(common.QuorumSize-k), C.int(b), (*C.uchar)(unsafe.Pointer(&segmentData[0])), (*C.uchar)(unsafe.Pointer(&segmentIndices[0])))
+	C.recoverData(C.int(k), C.int(n-k), C.int(b), (*C.uchar)(unsafe.Pointer(&segmentData[0])), (*C.uchar)(unsafe.Pointer(&segmentIndices[0])))
 
 	// remove padding introduced by EncodeRing()
 	sec, err = common.NewSector(segmentData[:length])
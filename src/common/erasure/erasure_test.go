@@ -10,8 +10,9 @@ import (
 // will produce the correct results.
 func TestCoding(t *testing.T) {
 	// set encoding parameters
-	k := common.QuorumSize / 2
-	m := common.QuorumSize - k
+	n := common.DefaultQuorumSize
+	k := n / 2
+	m := n - k
 	b := 1024
 
 	// create sector data
@@ -27,7 +28,7 @@ func TestCoding(t *testing.T) {
 	}
 
 	// calculate encoding parameters
-	params := sec.CalculateParams(k)
+	params := sec.CalculateParams(k, n)
 
 	// encode data into a Ring
 	ring, err := EncodeRing(sec, params)
@@ -37,7 +38,7 @@ func TestCoding(t *testing.T) {
 
 	// create Ring from subset of encoded segments
 	var newRing []common.Segment
-	for i := m; i < common.QuorumSize; i++ {
+	for i := m; i < n; i++ {
 		newRing = append(newRing, ring[i])
 	}
 
@@ -1,7 +1,11 @@
 package common
 
 import (
+	"common/encoding"
+	"context"
+	"fmt"
 	"net/rpc"
+	"time"
 )
 
 // An Identifier uniquely identifies a participant on a host.
@@ -14,6 +18,25 @@ type Address struct {
 	Port int
 }
 
+// EncodeTo writes the ID as one byte, the host as a string, and the port as
+// a uint16.
+func (a *Address) EncodeTo(e *encoding.Encoder) {
+	if a.Port < 0 || a.Port > 65535 {
+		e.Fail(fmt.Errorf("Cannot encode port %v", a.Port))
+		return
+	}
+	e.WriteUint8(uint8(a.ID))
+	e.WriteString(a.Host)
+	e.WriteUint16(uint16(a.Port))
+}
+
+// DecodeFrom reads an Address written by EncodeTo.
+func (a *Address) DecodeFrom(d *encoding.Decoder) {
+	a.ID = Identifier(d.ReadUint8())
+	a.Host = d.ReadString()
+	a.Port = int(d.ReadUint16())
+}
+
 // A Message is for sending requests over the network.
 // It consists of an Address and an RPC. It is the MessageRouter's job to
 // route a message to its intended destination.
@@ -25,11 +48,53 @@ type Message struct {
 }
 
 // A MessageRouter both transmits outgoing messages and processes incoming messages.
-// It dispenses Identifiers to objects that register themselves on the server.
+// It dispenses Identifiers to objects that register themselves on the server,
+// and routes each incoming message to the handler named by its Identifier.
 type MessageRouter interface {
 	Address() Address
 	RegisterHandler(interface{}) Identifier
+	UnregisterHandler(Identifier) error
 	SendMessage(*Message) error
 	SendAsyncMessage(*Message) *rpc.Call
+	SendMessageContext(context.Context, *Message) error
+	SendAsyncMessageContext(context.Context, *Message) *rpc.Call
 	Close()
 }
+
+// A RetryPolicy bounds how often an idempotent message is resent after a
+// failed delivery. Backoff is the delay before the first retry; it doubles
+// after every attempt.
+type RetryPolicy struct {
+	Attempts int
+	Backoff  time.Duration
+}
+
+// DefaultRetry is suitable for small idempotent requests to other hosts.
+var DefaultRetry = RetryPolicy{
+	Attempts: 3,
+	Backoff:  100 * time.Millisecond,
+}
+
+// SendWithRetry sends a message, retrying delivery failures according to
+// policy until ctx is done. Errors returned by the remote procedure itself
+// are not retried. Only use SendWithRetry for procedures that are safe to
+// run more than once.
+func SendWithRetry(ctx context.Context, mr MessageRouter, m *Message, policy RetryPolicy) (err error) {
+	backoff := policy.Backoff
+	for attempt := 0; attempt < policy.Attempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(backoff):
+				backoff *= 2
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		err = mr.SendMessageContext(ctx, m)
+		if _, remote := err.(rpc.ServerError); err == nil || remote || ctx.Err() != nil {
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,118 @@
+package common
+
+import (
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// A RandomStream is a deterministic stream of random numbers, drawn from a
+// seed of Entropy. Every participant that seeds a stream with the same
+// entropy draws the same numbers from it, in the same order, so it is used
+// wherever the quorum must agree on a random choice.
+//
+// The stream is the SHA-512 of the seed followed by a little endian counter,
+// for counter values 0, 1, 2 and so on, read 8 bytes at a time as little
+// endian uint64s. Bounded draws reject the values that would favour some
+// results over others, so they are free of modulo bias.
+type RandomStream struct {
+	seed    Entropy
+	counter uint64
+	block   [sha512.Size]byte
+	used    int // bytes of block already drawn
+}
+
+var rserrBadBound = errors.New("Bound of a random number must be positive")
+var rserrNoWeight = errors.New("Weights must not all be zero")
+var rserrWeightOverflow = errors.New("Weights add up to more than the maximum uint64")
+
+// NewRandomStream returns the stream seeded with seed.
+func NewRandomStream(seed Entropy) *RandomStream {
+	return &RandomStream{
+		seed: seed,
+		used: sha512.Size,
+	}
+}
+
+// Uint64 returns the next 64 bits of the stream.
+func (r *RandomStream) Uint64() uint64 {
+	if r.used == len(r.block) {
+		var counter [8]byte
+		binary.LittleEndian.PutUint64(counter[:], r.counter)
+		r.block = sha512.Sum512(append(r.seed[:], counter[:]...))
+		r.counter++
+		r.used = 0
+	}
+	n := binary.LittleEndian.Uint64(r.block[r.used:])
+	r.used += 8
+	return n
+}
+
+// Uint64n returns a uniformly random uint64 in [0, n).
+func (r *RandomStream) Uint64n(n uint64) (random uint64, err error) {
+	if n == 0 {
+		err = rserrBadBound
+		return
+	}
+
+	// the first 2^64 - excess values hold a whole number of copies of
+	// [0, n); values past them are drawn again
+	excess := (math.MaxUint64%n + 1) % n
+	for {
+		random = r.Uint64()
+		if excess == 0 || random <= math.MaxUint64-excess {
+			random %= n
+			return
+		}
+	}
+}
+
+// Intn returns a uniformly random int in [0, n).
+func (r *RandomStream) Intn(n int) (random int, err error) {
+	if n <= 0 {
+		err = rserrBadBound
+		return
+	}
+	u, err := r.Uint64n(uint64(n))
+	random = int(u)
+	return
+}
+
+// Shuffle puts n elements in a uniformly random order, calling swap to
+// exchange the elements at i and j.
+func (r *RandomStream) Shuffle(n int, swap func(i, j int)) {
+	for i := n - 1; i > 0; i-- {
+		j, _ := r.Intn(i + 1)
+		swap(i, j)
+	}
+}
+
+// Weighted returns a random index into weights, each index picked with
+// probability proportional to its weight.
+func (r *RandomStream) Weighted(weights []uint64) (index int, err error) {
+	var total uint64
+	for _, w := range weights {
+		if total+w < total {
+			err = rserrWeightOverflow
+			return
+		}
+		total += w
+	}
+	if total == 0 {
+		err = rserrNoWeight
+		return
+	}
+
+	pick, err := r.Uint64n(total)
+	if err != nil {
+		return
+	}
+	for i, w := range weights {
+		if pick < w {
+			return i, nil
+		}
+		pick -= w
+	}
+	return
+}
@@ -0,0 +1,153 @@
+package common
+
+import (
+	"math"
+	"testing"
+)
+
+// chiSquare returns the chi-square statistic of counts against an equal
+// expectation for each.
+func chiSquare(counts []int, expected float64) (chi float64) {
+	for _, c := range counts {
+		d := float64(c) - expected
+		chi += d * d / expected
+	}
+	return
+}
+
+// Streams with the same seed draw the same numbers, and streams with
+// different seeds do not.
+func TestRandomStreamDeterministic(t *testing.T) {
+	a := NewRandomStream(Entropy{1})
+	b := NewRandomStream(Entropy{1})
+	c := NewRandomStream(Entropy{2})
+	same := 0
+	for i := 0; i < 100; i++ {
+		x := a.Uint64()
+		if x != b.Uint64() {
+			t.Fatal("streams with the same seed diverged at draw", i)
+		}
+		if x == c.Uint64() {
+			same++
+		}
+	}
+	if same != 0 {
+		t.Error("streams with different seeds drew the same numbers", same, "times")
+	}
+
+	// the layout of the stream never changes
+	if x := NewRandomStream(Entropy{}).Uint64(); x != 0x39c89ce371f88010 {
+		t.Errorf("stream changed: %x", x)
+	}
+}
+
+func TestIntn(t *testing.T) {
+	r := NewRandomStream(Entropy{3})
+	if _, err := r.Intn(0); err != rserrBadBound {
+		t.Error("accepted a bound of 0:", err)
+	}
+	if _, err := r.Intn(-1); err != rserrBadBound {
+		t.Error("accepted a negative bound:", err)
+	}
+
+	// 5 degrees of freedom; 20.5 is exceeded with probability 0.001
+	counts := make([]int, 6)
+	draws := 60000
+	for i := 0; i < draws; i++ {
+		n, err := r.Intn(6)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n < 0 || n >= 6 {
+			t.Fatal("Intn out of bounds:", n)
+		}
+		counts[n]++
+	}
+	if chi := chiSquare(counts, float64(draws)/6); chi > 20.5 {
+		t.Error("Intn is not uniform:", counts, chi)
+	}
+}
+
+// For a bound of 3 * 2^62, reducing a uint64 modulo the bound would give
+// results below 2^62 half the time instead of a third of the time.
+func TestUint64nUnbiased(t *testing.T) {
+	r := NewRandomStream(Entropy{4})
+	bound := uint64(3) << 62
+	low := 0
+	draws := 30000
+	for i := 0; i < draws; i++ {
+		n, err := r.Uint64n(bound)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n >= bound {
+			t.Fatal("Uint64n out of bounds:", n)
+		}
+		if n < 1<<62 {
+			low++
+		}
+	}
+	if fraction := float64(low) / float64(draws); math.Abs(fraction-1.0/3) > 0.02 {
+		t.Error("Uint64n is biased:", fraction)
+	}
+
+	// a bound of 1 always gives 0, and the largest bound takes any value
+	if n, _ := r.Uint64n(1); n != 0 {
+		t.Error("Uint64n(1) gave", n)
+	}
+	if _, err := r.Uint64n(math.MaxUint64); err != nil {
+		t.Error(err)
+	}
+}
+
+// Every ordering of four elements is equally likely.
+func TestShuffle(t *testing.T) {
+	r := NewRandomStream(Entropy{5})
+	orderings := make(map[[4]int]int)
+	draws := 24000
+	for i := 0; i < draws; i++ {
+		a := [4]int{0, 1, 2, 3}
+		r.Shuffle(len(a), func(i, j int) {
+			a[i], a[j] = a[j], a[i]
+		})
+		orderings[a]++
+	}
+	if len(orderings) != 24 {
+		t.Fatal("Shuffle gave", len(orderings), "orderings, expected 24")
+	}
+
+	// 23 degrees of freedom; 49.7 is exceeded with probability 0.001
+	var counts []int
+	for _, c := range orderings {
+		counts = append(counts, c)
+	}
+	if chi := chiSquare(counts, float64(draws)/24); chi > 49.7 {
+		t.Error("Shuffle is not uniform:", orderings, chi)
+	}
+}
+
+func TestWeighted(t *testing.T) {
+	r := NewRandomStream(Entropy{6})
+	if _, err := r.Weighted([]uint64{0, 0}); err != rserrNoWeight {
+		t.Error("picked from zero weights:", err)
+	}
+	if _, err := r.Weighted([]uint64{math.MaxUint64, 1}); err != rserrWeightOverflow {
+		t.Error("accepted weights that overflow:", err)
+	}
+
+	counts := make([]int, 3)
+	draws := 40000
+	for i := 0; i < draws; i++ {
+		n, err := r.Weighted([]uint64{1, 0, 3})
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[n]++
+	}
+	if counts[1] != 0 {
+		t.Error("picked an index with no weight")
+	}
+	if fraction := float64(counts[2]) / float64(draws); math.Abs(fraction-0.75) > 0.01 {
+		t.Error("Weighted is not proportional to the weights:", counts)
+	}
+}
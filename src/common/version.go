@@ -0,0 +1,147 @@
+package common
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// ProtocolVersion is the version of the wire protocol spoken by this build.
+// It must be incremented whenever the encoding of any message changes, and
+// every decoder must go on accepting the layout of the previous version.
+//
+// Version 2 replaced gob with the canonical encoding for signed data.
+// Version 3 added the measured latency to heartbeats.
+// Version 4 added the quorum time to heartbeats.
+// Version 5 added transactions to heartbeats.
+// Version 6 added sector top ups to transactions.
+// Version 7 added sector updates to heartbeats.
+// Version 8 added departures to heartbeats.
+// Version 9 made departures signed announcements.
+// Version 10 added entropy commitments to heartbeats.
+// Version 11 replied to joins with the participant the joiner succeeds.
+// Version 12 replied to joins with the current step duration.
+// Version 13 recorded joins in heartbeats.
+// Version 14 appointed successors in the block instead of in replies to
+// joins, and signed hand-off requests.
+// Version 15 sent new participants a snapshot of the quorum's state.
+const ProtocolVersion uint16 = 15
+
+// MinProtocolVersion is the oldest version this build still speaks.
+// Messages and peers older than this are rejected. Each build speaks the
+// version before its own, so that a quorum can be upgraded one participant
+// at a time: every message is encoded at the version negotiated with the
+// peer it is sent to, and every decoder accepts the layouts of both
+// versions.
+const MinProtocolVersion uint16 = ProtocolVersion - 1
+
+// A VersionedEncoder can encode itself in the layout of any version from
+// MinProtocolVersion to ProtocolVersion, wrapped in a VersionedEnvelope. The
+// network uses it to send each message at the version negotiated with its
+// destination.
+type VersionedEncoder interface {
+	EncodeVersion(version uint16) ([]byte, error)
+}
+
+// Features is a set of optional capabilities, advertised in the handshake.
+// A feature may only be used with a peer that advertises it too.
+type Features uint32
+
+const (
+	// FeatureObservedAddress: the peer reports the host it observes a
+	// connection coming from.
+	FeatureObservedAddress Features = 1 << iota
+)
+
+// SupportedFeatures is every feature implemented by this build.
+const SupportedFeatures = FeatureObservedAddress
+
+// Hello is what each side of a connection advertises about itself.
+type Hello struct {
+	Version    uint16 // newest version spoken
+	MinVersion uint16 // oldest version understood
+	Features   Features
+}
+
+// HelloSize is the length of an encoded Hello.
+const HelloSize = 8
+
+var errIncompatibleVersion = errors.New("no protocol version is understood by both peers")
+var errShortEnvelope = errors.New("versioned message is too short")
+
+// LocalHello describes this build.
+func LocalHello() Hello {
+	return Hello{
+		Version:    ProtocolVersion,
+		MinVersion: MinProtocolVersion,
+		Features:   SupportedFeatures,
+	}
+}
+
+// Has returns true if every feature in f is in the set.
+func (fs Features) Has(f Features) bool {
+	return fs&f == f
+}
+
+// Negotiate picks the protocol used between two peers: the newest version
+// both speak, and the features both support.
+func Negotiate(local, remote Hello) (version uint16, features Features, err error) {
+	version = local.Version
+	if remote.Version < version {
+		version = remote.Version
+	}
+	if version < local.MinVersion || version < remote.MinVersion {
+		err = fmt.Errorf("%v: local %v-%v, remote %v-%v", errIncompatibleVersion,
+			local.MinVersion, local.Version, remote.MinVersion, remote.Version)
+		return
+	}
+	features = local.Features & remote.Features
+	return
+}
+
+// Bytes encodes the Hello for the handshake.
+func (h Hello) Bytes() []byte {
+	b := make([]byte, HelloSize)
+	binary.BigEndian.PutUint16(b[0:], h.Version)
+	binary.BigEndian.PutUint16(b[2:], h.MinVersion)
+	binary.BigEndian.PutUint32(b[4:], uint32(h.Features))
+	return b
+}
+
+// DecodeHello reads a Hello encoded by Bytes.
+func DecodeHello(b []byte) (h Hello, err error) {
+	if len(b) < HelloSize {
+		err = fmt.Errorf("hello is %v bytes, expected %v", len(b), HelloSize)
+		return
+	}
+	h.Version = binary.BigEndian.Uint16(b[0:])
+	h.MinVersion = binary.BigEndian.Uint16(b[2:])
+	h.Features = Features(binary.BigEndian.Uint32(b[4:]))
+	return
+}
+
+// VersionedEnvelope prefixes an encoded message with the protocol version
+// it was encoded with, so that the decoder can adapt to older layouts.
+func VersionedEnvelope(version uint16, body []byte) []byte {
+	envelope := make([]byte, 2, 2+len(body))
+	binary.BigEndian.PutUint16(envelope, version)
+	return append(envelope, body...)
+}
+
+// OpenEnvelope splits a message produced by VersionedEnvelope into its
+// version and body. Versions outside MinProtocolVersion to ProtocolVersion
+// are rejected, as this build cannot know their layout.
+func OpenEnvelope(envelope []byte) (version uint16, body []byte, err error) {
+	if len(envelope) < 2 {
+		err = errShortEnvelope
+		return
+	}
+	version = binary.BigEndian.Uint16(envelope)
+	if version < MinProtocolVersion || version > ProtocolVersion {
+		err = fmt.Errorf("%v: message has version %v, expected %v-%v", errIncompatibleVersion,
+			version, MinProtocolVersion, ProtocolVersion)
+		return
+	}
+	body = envelope[2:]
+	return
+}
@@ -0,0 +1,69 @@
+package common
+
+import (
+	"testing"
+)
+
+// Peers settle on the newest version both speak, and only if it is new
+// enough for both.
+func TestNegotiate(t *testing.T) {
+	local := Hello{Version: 3, MinVersion: 2, Features: 0x3}
+	version, features, err := Negotiate(local, Hello{Version: 5, MinVersion: 1, Features: 0x6})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 3 || features != 0x2 {
+		t.Error("negotiated the wrong protocol:", version, features)
+	}
+
+	// an older peer that is still understood
+	version, _, err = Negotiate(local, Hello{Version: 2, MinVersion: 1})
+	if err != nil || version != 2 {
+		t.Error("failed to negotiate down to an older version:", version, err)
+	}
+
+	// peers too old or too new
+	if _, _, err = Negotiate(local, Hello{Version: 1, MinVersion: 1}); err == nil {
+		t.Error("negotiated with a peer that is too old")
+	}
+	if _, _, err = Negotiate(local, Hello{Version: 9, MinVersion: 4}); err == nil {
+		t.Error("negotiated with a peer that is too new")
+	}
+}
+
+func TestHelloEncoding(t *testing.T) {
+	h := Hello{Version: 0x0102, MinVersion: 0x0304, Features: 0x05060708}
+	decoded, err := DecodeHello(h.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded != h {
+		t.Error("hello changed in encoding:", decoded)
+	}
+	if _, err = DecodeHello(h.Bytes()[:HelloSize-1]); err == nil {
+		t.Error("decoded a truncated hello")
+	}
+}
+
+func TestEnvelope(t *testing.T) {
+	version, body, err := OpenEnvelope(VersionedEnvelope(ProtocolVersion, []byte("body")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != ProtocolVersion || string(body) != "body" {
+		t.Error("envelope changed its contents:", version, body)
+	}
+
+	if _, _, err = OpenEnvelope(VersionedEnvelope(ProtocolVersion+1, nil)); err == nil {
+		t.Error("opened an envelope from a newer version")
+	}
+	if _, _, err = OpenEnvelope(VersionedEnvelope(ProtocolVersion-1, nil)); err != nil {
+		t.Error("could not open an envelope from the previous version:", err)
+	}
+	if _, _, err = OpenEnvelope(VersionedEnvelope(ProtocolVersion-2, nil)); err == nil {
+		t.Error("opened an envelope from before the previous version")
+	}
+	if _, _, err = OpenEnvelope([]byte{0}); err == nil {
+		t.Error("opened a truncated envelope")
+	}
+}
@@ -1,6 +1,7 @@
 package common
 
 import (
+	"context"
 	"net/rpc"
 	"sync"
 )
@@ -18,6 +19,10 @@ func (z *ZeroNetwork) RegisterHandler(handler interface{}) (i Identifier) {
 	return
 }
 
+func (z *ZeroNetwork) UnregisterHandler(id Identifier) error {
+	return nil
+}
+
 func (z *ZeroNetwork) SendMessage(m *Message) error {
 	z.messagesLock.Lock()
 	z.messages = append(z.messages, m)
@@ -32,6 +37,14 @@ func (z *ZeroNetwork) SendAsyncMessage(m *Message) *rpc.Call {
 	return nil
 }
 
+func (z *ZeroNetwork) SendMessageContext(ctx context.Context, m *Message) error {
+	return z.SendMessage(m)
+}
+
+func (z *ZeroNetwork) SendAsyncMessageContext(ctx context.Context, m *Message) *rpc.Call {
+	return z.SendAsyncMessage(m)
+}
+
 func (z *ZeroNetwork) Close() {
 	return
 }
@@ -0,0 +1,186 @@
+// Package discovery lets hosts and clients find the network without
+// hand-entered addresses. Every host runs a Discovery handler that shares a
+// signed list of the peers it knows about. Starting from a configured list
+// of seeds, a node asks each seed for its list, verifies it, and merges the
+// result into its local PeerDB.
+package discovery
+
+import (
+	"common"
+	"common/crypto"
+	"common/encoding"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// The Discovery handler is registered directly after the host's State, so
+// the State has ID 1 and Discovery has ID 2.
+const HandlerID common.Identifier = 2
+
+// requestTimeout bounds a peer list request to a single seed, including
+// retries.
+const requestTimeout = 5 * time.Second
+
+// MaxPeerListAge is how old a peer list may be before it is rejected.
+const MaxPeerListAge = 10 * time.Minute
+
+var errPeerListSignature = errors.New("peer list has an invalid signature")
+var errPeerListKey = errors.New("peer list was signed by a different key than the one pinned for this seed")
+var errPeerListAge = errors.New("peer list is too old")
+
+// A PeerList is a host's view of the network, signed with its identity key.
+type PeerList struct {
+	Peers     []common.Address
+	Timestamp int64 // unix seconds
+	PublicKey *crypto.PublicKey
+	Signature crypto.Signature
+}
+
+// EncodeTo writes the canonical encoding of the signed part of the list:
+//
+//	Peers     []common.Address
+//	Timestamp int64
+func (pl *PeerList) EncodeTo(e *encoding.Encoder) {
+	e.WriteLength(len(pl.Peers))
+	for i := range pl.Peers {
+		pl.Peers[i].EncodeTo(e)
+	}
+	e.WriteInt64(pl.Timestamp)
+}
+
+// message returns the bytes covered by the signature.
+func (pl *PeerList) message() ([]byte, error) {
+	return encoding.Marshal(pl)
+}
+
+// signPeerList creates a PeerList of the given peers, signed by secKey.
+func signPeerList(peers []common.Address, secKey *crypto.SecretKey) (pl PeerList, err error) {
+	pl.Peers = peers
+	pl.Timestamp = time.Now().Unix()
+	pl.PublicKey = secKey.Public()
+	m, err := pl.message()
+	if err != nil {
+		return
+	}
+	signed, err := secKey.Sign(m)
+	if err != nil {
+		return
+	}
+	pl.Signature = signed.Signature
+	return
+}
+
+// verify checks that the list was signed by the key it carries.
+func (pl *PeerList) verify() bool {
+	if pl.Signature.R == nil || pl.Signature.S == nil {
+		return false
+	}
+	m, err := pl.message()
+	if err != nil {
+		return false
+	}
+	return pl.PublicKey.Verify(&crypto.SignedMessage{
+		Signature: pl.Signature,
+		Message:   m,
+	})
+}
+
+// Discovery is the message handler that shares this host's peer list.
+type Discovery struct {
+	self      func() common.Address // current address of this host's State
+	secretKey crypto.SecretKey
+	db        *PeerDB
+}
+
+// New creates a Discovery handler and registers it with messageRouter.
+// self returns the address advertised for this host, which is included in
+// every list it shares. It is called for each list, so that an address the
+// host learns after starting is shared.
+func New(messageRouter common.MessageRouter, secKey crypto.SecretKey, self func() common.Address, db *PeerDB) (d *Discovery, err error) {
+	if messageRouter == nil {
+		err = fmt.Errorf("Cannot initialize with a nil messageRouter")
+		return
+	}
+	if self == nil {
+		err = fmt.Errorf("Cannot initialize without an address")
+		return
+	}
+	d = &Discovery{
+		self:      self,
+		secretKey: secKey,
+		db:        db,
+	}
+	id := messageRouter.RegisterHandler(d)
+	if id != HandlerID {
+		err = fmt.Errorf("Discovery registered with ID %v, expected %v", id, HandlerID)
+	}
+	return
+}
+
+// SharePeers returns this host's signed peer list.
+func (d *Discovery) SharePeers(arb struct{}, pl *PeerList) (err error) {
+	peers := append([]common.Address{d.self()}, d.db.Addresses()...)
+	*pl, err = signPeerList(peers, &d.secretKey)
+	return
+}
+
+// RequestPeers fetches and verifies the peer list of the host at seed. Seed
+// addresses refer to the Discovery handler of the host, so their ID is
+// always HandlerID.
+func RequestPeers(messageRouter common.MessageRouter, seed common.Address) (pl PeerList, err error) {
+	seed.ID = HandlerID
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	err = common.SendWithRetry(ctx, messageRouter, &common.Message{
+		Dest: seed,
+		Proc: "Discovery.SharePeers",
+		Args: struct{}{},
+		Resp: &pl,
+	}, common.DefaultRetry)
+	if err != nil {
+		return
+	}
+	if !pl.verify() {
+		err = errPeerListSignature
+		return
+	}
+	if time.Since(time.Unix(pl.Timestamp, 0)) > MaxPeerListAge {
+		err = errPeerListAge
+	}
+	return
+}
+
+// Discover asks every seed for its peer list and adds the peers to db. A
+// seed whose list fails verification, or is signed by a key other than the
+// one it used before, is skipped. Discover returns an error only if no seed
+// could be used.
+func Discover(messageRouter common.MessageRouter, seeds []common.Address, db *PeerDB) (err error) {
+	if len(seeds) == 0 {
+		return
+	}
+
+	succeeded := false
+	for _, seed := range seeds {
+		seed.ID = HandlerID
+		pl, requestErr := RequestPeers(messageRouter, seed)
+		if requestErr == nil && !db.pin(seed, pl.PublicKey) {
+			requestErr = errPeerListKey
+		}
+		if requestErr != nil {
+			err = requestErr
+			continue
+		}
+
+		seen := time.Unix(pl.Timestamp, 0)
+		for _, a := range pl.Peers {
+			db.Add(a, seen)
+		}
+		succeeded = true
+	}
+	if succeeded {
+		err = nil
+	}
+	return
+}
@@ -0,0 +1,145 @@
+package discovery
+
+import (
+	"common"
+	"common/crypto"
+	"network"
+	"os"
+	"testing"
+	"time"
+)
+
+// newTestHost starts an RPCServer with a placeholder State handler and a
+// Discovery handler, mirroring the registration order used by the server.
+func newTestHost(t *testing.T, port int, db *PeerDB) (*network.RPCServer, *Discovery) {
+	rpcs, err := network.NewRPCServer(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	self := rpcs.Address()
+	self.ID = rpcs.RegisterHandler(new(State))
+	_, secKey, err := crypto.CreateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := New(rpcs, secKey, func() common.Address { return self }, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rpcs, d
+}
+
+// State stands in for quorum.State so the handler IDs line up.
+type State struct{}
+
+func (s *State) Ping(arb struct{}, resp *struct{}) error {
+	return nil
+}
+
+// A node learns a seed's State address and the seed's own peers.
+func TestDiscover(t *testing.T) {
+	seedDB, _ := LoadPeerDB("")
+	known := common.Address{ID: 1, Host: "10.0.0.5", Port: 9988}
+	seedDB.Add(known, time.Now())
+	seed, _ := newTestHost(t, 9960, seedDB)
+	defer seed.Close()
+
+	db, _ := LoadPeerDB("")
+	node, _ := newTestHost(t, 9961, db)
+	defer node.Close()
+
+	err := Discover(node, []common.Address{{Host: "localhost", Port: 9960}}, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addresses := db.Addresses()
+	if len(addresses) != 2 {
+		t.Fatal("expected 2 peers, got", addresses)
+	}
+	found := map[common.Address]bool{}
+	for _, a := range addresses {
+		found[a] = true
+	}
+	seedState := seed.Address()
+	seedState.ID = 1
+	if !found[known] || !found[seedState] {
+		t.Error("discovered the wrong peers:", addresses)
+	}
+
+	// no usable seeds is an error
+	err = Discover(node, []common.Address{{Host: "localhost", Port: 9962}}, db)
+	if err == nil {
+		t.Error("Discover succeeded without reaching any seed")
+	}
+}
+
+// Tampered lists and key changes are rejected.
+func TestPeerListVerification(t *testing.T) {
+	_, secKey, err := crypto.CreateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pl, err := signPeerList([]common.Address{{ID: 1, Host: "a", Port: 1}}, &secKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pl.verify() {
+		t.Fatal("valid peer list did not verify")
+	}
+	pl.Peers[0].Port = 2
+	if pl.verify() {
+		t.Error("tampered peer list verified")
+	}
+
+	db, _ := LoadPeerDB("")
+	seed := common.Address{ID: HandlerID, Host: "a", Port: 1}
+	if !db.pin(seed, pl.PublicKey) {
+		t.Error("failed to pin the first key seen for a seed")
+	}
+	otherKey, _, err := crypto.CreateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.pin(seed, otherKey) {
+		t.Error("accepted a second key for a pinned seed")
+	}
+}
+
+// The database survives a save and load, keeping pinned keys.
+func TestPeerDBPersistence(t *testing.T) {
+	defer os.Remove("peers.json")
+	db, err := LoadPeerDB("peers.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	older := common.Address{ID: 1, Host: "old", Port: 1}
+	newer := common.Address{ID: 1, Host: "new", Port: 1}
+	db.Add(older, time.Unix(100, 0))
+	db.Add(newer, time.Unix(200, 0))
+	pubKey, _, err := crypto.CreateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.pin(newer, pubKey)
+	err = db.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadPeerDB("peers.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addresses := loaded.Addresses()
+	if len(addresses) != 2 || addresses[0] != newer || addresses[1] != older {
+		t.Error("loaded peers in the wrong order:", addresses)
+	}
+	if !loaded.pin(newer, pubKey) {
+		t.Error("pinned key was not restored")
+	}
+
+	loaded.Remove(older)
+	if len(loaded.Addresses()) != 1 {
+		t.Error("Remove did not forget the peer")
+	}
+}
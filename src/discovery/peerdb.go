@@ -0,0 +1,158 @@
+package discovery
+
+import (
+	"common"
+	"common/crypto"
+	"encoding/json"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A Peer is a known address, along with when it was last heard about.
+type Peer struct {
+	Address  common.Address
+	LastSeen time.Time
+}
+
+// peerFile is the on-disk form of a PeerDB. Public keys are stored in their
+// PEM encoding.
+type peerFile struct {
+	Peers []Peer
+	Keys  []pinnedKey
+}
+
+type pinnedKey struct {
+	Address   common.Address
+	PublicKey string
+}
+
+// PeerDB is the local database of known peers. It also pins the public key
+// each seed has signed its peer lists with, so that a seed cannot later be
+// impersonated by a different key.
+type PeerDB struct {
+	filename string
+	peers    map[common.Address]*Peer
+	keys     map[common.Address]*crypto.PublicKey
+	lock     sync.RWMutex
+}
+
+// LoadPeerDB opens the peer database stored in filename. A missing file
+// yields an empty database; an empty filename yields one that is never saved.
+func LoadPeerDB(filename string) (db *PeerDB, err error) {
+	db = &PeerDB{
+		filename: filename,
+		peers:    make(map[common.Address]*Peer),
+		keys:     make(map[common.Address]*crypto.PublicKey),
+	}
+	if filename == "" {
+		return
+	}
+
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		err = nil
+		return
+	} else if err != nil {
+		return
+	}
+	defer file.Close()
+
+	var pf peerFile
+	err = json.NewDecoder(file).Decode(&pf)
+	if err != nil {
+		return
+	}
+	for i := range pf.Peers {
+		db.peers[pf.Peers[i].Address] = &pf.Peers[i]
+	}
+	for _, pk := range pf.Keys {
+		db.keys[pk.Address], err = crypto.UnmarshalPublicKey([]byte(pk.PublicKey))
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Save writes the database to its file.
+func (db *PeerDB) Save() (err error) {
+	if db.filename == "" {
+		return
+	}
+
+	db.lock.RLock()
+	var pf peerFile
+	for _, p := range db.peers {
+		pf.Peers = append(pf.Peers, *p)
+	}
+	for a, pk := range db.keys {
+		var encoded []byte
+		encoded, err = pk.MarshalPEM()
+		if err != nil {
+			db.lock.RUnlock()
+			return
+		}
+		pf.Keys = append(pf.Keys, pinnedKey{a, string(encoded)})
+	}
+	db.lock.RUnlock()
+
+	file, err := os.Create(db.filename)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	return json.NewEncoder(file).Encode(&pf)
+}
+
+// Add records that a peer was seen at the given time. An older sighting
+// never replaces a newer one.
+func (db *PeerDB) Add(a common.Address, seen time.Time) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	p, exists := db.peers[a]
+	if !exists {
+		db.peers[a] = &Peer{a, seen}
+	} else if seen.After(p.LastSeen) {
+		p.LastSeen = seen
+	}
+}
+
+// Remove forgets a peer.
+func (db *PeerDB) Remove(a common.Address) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	delete(db.peers, a)
+}
+
+// Addresses returns every known peer, most recently seen first.
+func (db *PeerDB) Addresses() (addresses []common.Address) {
+	db.lock.RLock()
+	peers := make([]*Peer, 0, len(db.peers))
+	for _, p := range db.peers {
+		peers = append(peers, p)
+	}
+	db.lock.RUnlock()
+
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].LastSeen.After(peers[j].LastSeen)
+	})
+	for _, p := range peers {
+		addresses = append(addresses, p.Address)
+	}
+	return
+}
+
+// pin checks pk against the key pinned for a seed, pinning it if the seed
+// has not been seen before. It returns false if a different key is pinned.
+func (db *PeerDB) pin(seed common.Address, pk *crypto.PublicKey) bool {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	pinned, exists := db.keys[seed]
+	if !exists {
+		db.keys[seed] = pk
+		return true
+	}
+	return pinned.Compare(pk)
+}
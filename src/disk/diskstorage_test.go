@@ -1,8 +1,12 @@
 package disk
 
 import (
+	"bytes"
+	"io"
 	"os"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"testing"
 )
 
@@ -28,7 +32,7 @@ func Test_Parallel(t *testing.T) {
 	for c := 0; c < 100; c++ {
 		wg.Add(1)
 		go func(c int) {
-			i.CreateFile(string(c), uint64(c))
+			i.CreateFile(strconv.Itoa(c), uint64(c))
 			wg.Done()
 		}(c)
 	}
@@ -84,3 +88,161 @@ func Test_Swarm(t *testing.T) {
 	}
 
 }
+
+// Fill several files with known data and check that every global index maps
+// onto the correct byte, including ranges that cross file boundaries.
+func Test_RandomSampling(t *testing.T) {
+	i, err := CreateSwarmSystem("sampling")
+	defer i.Delete()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the files are laid out in sorted order: a, b (empty), c
+	var expected []byte
+	contents := map[string][]byte{
+		"a": {1, 2, 3, 4, 5},
+		"b": {},
+		"c": {6, 7, 8},
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		_, err = i.CreateFile(name, uint64(len(contents[name])))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = i.WriteFile(name, 0, contents[name])
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected = append(expected, contents[name]...)
+	}
+
+	if i.StoredBytes() != uint64(len(expected)) {
+		t.Fatal("StoredBytes returned", i.StoredBytes(), "expected", len(expected))
+	}
+
+	// every single byte
+	for index := range expected {
+		b, err := i.GetRandomByte(uint64(index))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b != expected[index] {
+			t.Error("index", index, "returned", b, "expected", expected[index])
+		}
+	}
+
+	// a range spanning all three files
+	data, err := i.GetRandomBytes(3, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, expected[3:7]) {
+		t.Error("spanning range returned", data, "expected", expected[3:7])
+	}
+
+	// out of range requests must fail
+	_, err = i.GetRandomByte(uint64(len(expected)))
+	if err == nil {
+		t.Error("sampled a byte past the end of storage")
+	}
+	_, err = i.GetRandomBytes(6, 3)
+	if err == nil {
+		t.Error("sampled a range that runs past the end of storage")
+	}
+
+	// growing a file must be reflected in the index
+	err = i.WriteFile("c", 3, []byte{9})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := i.GetRandomByte(uint64(len(expected)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b != 9 {
+		t.Error("sampling after growing a file returned", b, "expected 9")
+	}
+}
+
+// Run thousands of concurrent creates, writes, reads, deletes and samples
+// over a small set of files, then check that the metadata agrees with the
+// disk. The number of files and of operations are coprime, so every file sees
+// every operation. Each operation must succeed or fail only because the file
+// is missing or too short. Run with -race to check the locking.
+func Test_Stress(t *testing.T) {
+	i, err := CreateSwarmSystem("stress")
+	defer i.Delete()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	operations := 4000
+	if testing.Short() {
+		operations = 1000
+	}
+	var succeeded [5]int64
+	wg := &sync.WaitGroup{}
+	for c := 0; c < operations; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			name := strconv.Itoa(c % 7)
+			var err error
+			switch c % 5 {
+			case 0:
+				_, err = i.CreateFile(name, uint64(c%64))
+			case 1:
+				err = i.WriteFile(name, uint64(c%32), bytes.Repeat([]byte{byte(c)}, c%16))
+				if err == errUnknownFile {
+					return
+				}
+			case 2:
+				err = i.ReadFile(name, 0, make([]byte, 8))
+				if err == errUnknownFile || err == io.EOF {
+					return
+				}
+			case 3:
+				err = i.DeleteFile(name)
+				if os.IsNotExist(err) {
+					return
+				}
+			case 4:
+				if total := i.StoredBytes(); total > 0 {
+					_, err = i.GetRandomBytes(uint64(c)%total, 1)
+				}
+				// the sampled file may be deleted or shrunk before it is read
+				if err == errSampleRange || err == errUnknownFile || err == io.EOF {
+					return
+				}
+			}
+			if err != nil {
+				t.Errorf("operation %v on file %v failed: %v", c%5, name, err)
+				return
+			}
+			atomic.AddInt64(&succeeded[c%5], 1)
+		}(c)
+	}
+	wg.Wait()
+	for op, n := range succeeded {
+		if n == 0 {
+			t.Error("operation", op, "never succeeded, so it never ran against the others")
+		}
+	}
+
+	// every recorded file must exist on disk with the recorded size
+	var total uint64
+	for name, size := range i.fileSizes() {
+		info, err := os.Stat(i.getFileName(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if uint64(info.Size()) != size {
+			t.Error("file", name, "is", info.Size(), "bytes on disk, recorded as", size)
+		}
+		total += size
+	}
+	if total != i.StoredBytes() || total != i.amountused {
+		t.Error("stored bytes", i.StoredBytes(), "and amount used", i.amountused, "disagree with file sizes", total)
+	}
+}
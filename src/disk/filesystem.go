@@ -2,171 +2,395 @@ package disk
 
 import (
 	"encoding/json"
+	"errors"
 	"os"
 	"sort"
 	"sync"
 )
 
+var errSampleRange = errors.New("sample extends beyond the amount of data stored")
+
 /*
 A type returned by the create swarm option.
 Contains information related to metadata such as filehash associated with filesize and other such things.
+
+Locking: mapLock guards every field below it. Each file additionally has its
+own mutex in fileLocks, held for the whole of any disk operation on that
+file. When both are needed the file lock is always taken first, and mapLock
+is never held during disk I/O.
 */
 type SwarmStorage struct {
-	SwarmId      string            "swid"
-	amountused   uint64            "amtused"
-	files        map[string]uint64 "files"
-	fileordering []string          "fileorder"
-	MapLock      *sync.RWMutex
-	FileLocks    map[string]*sync.Mutex
+	SwarmId string
+
+	mapLock      sync.RWMutex
+	amountused   uint64
+	files        map[string]uint64
+	fileordering []string
+	fileLocks    map[string]*sync.Mutex
+
+	// sampleIndex[i] is the total size of fileordering[0] through
+	// fileordering[i]. It is rebuilt lazily after any file changes size, and
+	// is nil whenever it is stale.
+	sampleIndex []uint64
+}
+
+// swarmMetadata is the part of a SwarmStorage that is saved to the .conf file
+type swarmMetadata struct {
+	SwarmId    string
+	AmountUsed uint64
+	Files      map[string]uint64
 }
 
 //helper function to produce the correct filename
-func (r SwarmStorage) getFileName(filehash string) string {
+func (r *SwarmStorage) getFileName(filehash string) string {
 	return r.SwarmId + string(os.PathSeparator) + filehash
 }
 
+// fileLock returns the mutex for filehash, creating it if needed. Locks are
+// never removed, so a goroutine waiting on a deleted file's lock and one
+// recreating the file always agree on the same mutex.
+func (r *SwarmStorage) fileLock(filehash string) *sync.Mutex {
+	r.mapLock.RLock()
+	l := r.fileLocks[filehash]
+	r.mapLock.RUnlock()
+	if l != nil {
+		return l
+	}
+
+	r.mapLock.Lock()
+	defer r.mapLock.Unlock()
+	l = r.fileLocks[filehash]
+	if l == nil {
+		l = new(sync.Mutex)
+		r.fileLocks[filehash] = l
+	}
+	return l
+}
+
 //Opens or creates directory for swarm info, and if it exists, obtains the correct amount of space used by its
 //files
 func CreateSwarmSystem(swarmid string) (r *SwarmStorage, err error) {
-	r = new(SwarmStorage)
-	r.SwarmId = swarmid
-	r.amountused = 0
-	r.MapLock = new(sync.RWMutex)
-	r.files = make(map[string]uint64)
-	r.FileLocks = make(map[string]*sync.Mutex)
+	r = &SwarmStorage{
+		SwarmId:   swarmid,
+		files:     make(map[string]uint64),
+		fileLocks: make(map[string]*sync.Mutex),
+	}
 	err = os.Mkdir(swarmid, os.ModeDir|os.ModePerm)
+	if err == nil || !os.IsExist(err) {
+		return
+	}
+
+	// the swarm already exists; load its metadata if any was saved
+	err = nil
+	meta, e := os.Open(swarmid + ".conf")
+	if e != nil {
+		return
+	}
+	defer meta.Close()
+	var sm swarmMetadata
+	err = json.NewDecoder(meta).Decode(&sm)
 	if err != nil {
-		if os.IsExist(err) {
-			meta, e := os.Open(swarmid + ".conf")
-			if e != nil {
-			}
-			defer meta.Close()
-			c := json.NewDecoder(meta)
-			if e != nil {
-				print(e.Error())
-			}
-			r.MapLock.Lock()
-			if err = c.Decode(r); e != nil {
-
-			}
-			r.MapLock.Unlock()
-		}
+		return
+	}
+	r.amountused = sm.AmountUsed
+	for filehash, size := range sm.Files {
+		r.files[filehash] = size
+		r.fileordering = append(r.fileordering, filehash)
 	}
+	sort.Strings(r.fileordering)
 	return
 }
 
-func (r SwarmStorage) Delete() {
+func (r *SwarmStorage) Delete() {
 	os.RemoveAll(r.SwarmId)
 	os.Remove(r.SwarmId + ".conf")
 }
 
-func (r SwarmStorage) CreateFile(filehash string, length uint64) (written int64, err error) {
-	file, err := os.Create(r.SwarmId + string(os.PathSeparator) + filehash)
-	r.MapLock.Lock()
-	if err != nil && os.IsExist(err) {
-		//in which case, it should be safe to ignore the error
-		err = nil
-		if r.files[filehash] == length {
-			return
-		}
+// CreateFile creates a file of the given length, or resizes it if it already
+// exists.
+func (r *SwarmStorage) CreateFile(filehash string, length uint64) (written int64, err error) {
+	l := r.fileLock(filehash)
+	l.Lock()
+	defer l.Unlock()
+
+	file, err := os.OpenFile(r.getFileName(filehash), os.O_RDWR|os.O_CREATE, os.ModePerm)
+	if err != nil {
+		return
 	}
 	defer file.Close()
-	r.FileLocks[filehash] = new(sync.Mutex)
-	r.FileLocks[filehash].Lock()
-	defer r.FileLocks[filehash].Unlock()
 	err = file.Truncate(int64(length))
-
-	if _, ok := r.files[filehash]; !ok {
-		r.fileordering = append(r.fileordering, filehash)
-		sort.Strings(r.fileordering)
+	if err != nil {
+		return
 	}
-	r.files[filehash] = uint64(length)
-	r.MapLock.Unlock()
+
+	r.mapLock.Lock()
+	r.recordFile(filehash, length)
+	r.mapLock.Unlock()
 	written = int64(length)
 	return
 }
-func (r SwarmStorage) FileExists(filehash string) bool {
+
+// recordFile sets the recorded size of a file, adding it to the swarm if it
+// is new. mapLock must be write-locked by the caller.
+func (r *SwarmStorage) recordFile(filehash string, length uint64) {
+	size, ok := r.files[filehash]
+	if !ok {
+		i := sort.SearchStrings(r.fileordering, filehash)
+		r.fileordering = append(r.fileordering, "")
+		copy(r.fileordering[i+1:], r.fileordering[i:])
+		r.fileordering[i] = filehash
+	}
+	r.amountused = r.amountused - size + length
+	r.files[filehash] = length
+	r.sampleIndex = nil
+}
+
+// stagingName returns a path in the swarm's directory that is not part of
+// the swarm, where a file can be prepared before adoptFile makes it visible.
+func (r *SwarmStorage) stagingName(filehash string) string {
+	return r.getFileName(filehash) + ".staging"
+}
+
+// adoptFile moves a file prepared at stagingName(filehash) into the swarm,
+// replacing any file of that name. Until then the file is neither counted nor
+// sampled.
+func (r *SwarmStorage) adoptFile(filehash string) (err error) {
+	l := r.fileLock(filehash)
+	l.Lock()
+	defer l.Unlock()
+
+	info, err := os.Stat(r.stagingName(filehash))
+	if err != nil {
+		return
+	}
+	err = os.Rename(r.stagingName(filehash), r.getFileName(filehash))
+	if err != nil {
+		return
+	}
+	r.mapLock.Lock()
+	r.recordFile(filehash, uint64(info.Size()))
+	r.mapLock.Unlock()
+	return
+}
+
+func (r *SwarmStorage) FileExists(filehash string) bool {
+	r.mapLock.RLock()
 	_, ok := r.files[filehash]
+	r.mapLock.RUnlock()
 	return ok
 }
 
-func (r SwarmStorage) DeleteFile(filehash string) error {
-	l := r.FileLocks[filehash]
-	if l == nil {
-		r.FileLocks[filehash] = new(sync.Mutex)
-		l = r.FileLocks[filehash]
+// fileSizes returns a snapshot of every stored file and its size.
+func (r *SwarmStorage) fileSizes() (sizes map[string]uint64) {
+	r.mapLock.RLock()
+	defer r.mapLock.RUnlock()
+	sizes = make(map[string]uint64, len(r.files))
+	for filehash, size := range r.files {
+		sizes[filehash] = size
 	}
+	return
+}
+
+func (r *SwarmStorage) DeleteFile(filehash string) error {
+	l := r.fileLock(filehash)
 	l.Lock()
 	defer l.Unlock()
-	size, err := os.Stat(r.getFileName(filehash))
-	if err == nil {
-		r.amountused -= uint64(size.Size())
-		err = os.Remove(r.SwarmId + string(os.PathSeparator) + filehash)
+
+	err := os.Remove(r.getFileName(filehash))
+	if err != nil {
+		return err
 	}
-	r.files[filehash] = uint64(0)
-	return err
+
+	// forget the file entirely so it is no longer listed or sampled
+	r.mapLock.Lock()
+	r.amountused -= r.files[filehash]
+	delete(r.files, filehash)
+	i := sort.SearchStrings(r.fileordering, filehash)
+	if i < len(r.fileordering) && r.fileordering[i] == filehash {
+		r.fileordering = append(r.fileordering[:i], r.fileordering[i+1:]...)
+	}
+	r.sampleIndex = nil
+	r.mapLock.Unlock()
+	return nil
 }
 
-func (r SwarmStorage) WriteFile(filehash string, start uint64, data []byte) error {
-	r.FileLocks[filehash].Lock()
-	defer r.FileLocks[filehash].Unlock()
-	path := r.SwarmId + string(os.PathSeparator) + filehash
-	file, err := os.Open(path)
+// WriteFile writes data into an existing file, growing it if the write runs
+// past the current end.
+func (r *SwarmStorage) WriteFile(filehash string, start uint64, data []byte) error {
+	l := r.fileLock(filehash)
+	l.Lock()
+	defer l.Unlock()
+
+	if !r.FileExists(filehash) {
+		return errUnknownFile
+	}
+	file, err := os.OpenFile(r.getFileName(filehash), os.O_WRONLY, 0)
 	if err != nil {
 		return err
 	}
-	r.MapLock.RLock()
-	size, ok := r.files[filehash]
-	r.MapLock.RUnlock()
-	if uint64(start)+uint64(len(data)) >= size && ok {
-		r.amountused += uint64(start) + uint64(uint64(len(data))-size)
-		r.files[filehash] = uint64(start) + uint64(len(data))
+	defer file.Close()
+	_, err = file.WriteAt(data, int64(start))
+	if err != nil {
+		return err
 	}
-	file.WriteAt(data, int64(start))
-	file.Close()
-	return nil
 
+	r.mapLock.Lock()
+	if end := start + uint64(len(data)); end > r.files[filehash] {
+		r.amountused += end - r.files[filehash]
+		r.files[filehash] = end
+		r.sampleIndex = nil
+	}
+	r.mapLock.Unlock()
+	return nil
 }
-func (r SwarmStorage) ReadFile(filehash string, start uint64, data []byte) (err error) {
-	r.FileLocks[filehash].Lock()
-	defer r.FileLocks[filehash].Unlock()
+
+func (r *SwarmStorage) ReadFile(filehash string, start uint64, data []byte) (err error) {
+	l := r.fileLock(filehash)
+	l.Lock()
+	defer l.Unlock()
+
+	if !r.FileExists(filehash) {
+		return errUnknownFile
+	}
 	file, err := os.Open(r.getFileName(filehash))
-	file.ReadAt(data, int64(start))
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	_, err = file.ReadAt(data, int64(start))
 	return
 }
-func (r SwarmStorage) SaveSwarm() {
+
+// SaveSwarm writes the swarm's metadata to <swarm id>.conf, from which
+// CreateSwarmSystem restores it.
+func (r *SwarmStorage) SaveSwarm() (err error) {
+	r.mapLock.RLock()
+	sm := swarmMetadata{
+		SwarmId:    r.SwarmId,
+		AmountUsed: r.amountused,
+		Files:      make(map[string]uint64, len(r.files)),
+	}
+	for filehash, size := range r.files {
+		sm.Files[filehash] = size
+	}
+	r.mapLock.RUnlock()
+
 	s, err := os.Create(r.SwarmId + ".conf")
-	if err != nil && os.IsExist(err) {
-		s, err = os.Open(r.SwarmId + ".conf")
+	if err != nil {
+		return
 	}
 	defer s.Close()
-	r.MapLock.RLock()
-	js := json.NewEncoder(s)
-	if err = js.Encode(&r); err != nil {
-		print("From SaveSwarm")
-		print(err.Error())
-	}
-	r.MapLock.RUnlock()
-
-}
-func (r SwarmStorage) GetRandomByte(index uint64) byte {
-
-	var u uint64
-	c := uint64(0)
-	v := ""
-	for i := range r.fileordering {
-		d := r.fileordering[i]
-		if u+r.files[d] >= index {
-			c = index - u + index
-			v = d
-			break
-		}
-		u += r.files[d]
+	return json.NewEncoder(s).Encode(&sm)
+}
+
+// buildSampleIndex computes the prefix sums of the file sizes in
+// fileordering. mapLock must be write-locked by the caller.
+func (r *SwarmStorage) buildSampleIndex() {
+	r.sampleIndex = make([]uint64, len(r.fileordering))
+	var total uint64
+	for i, filehash := range r.fileordering {
+		total += r.files[filehash]
+		r.sampleIndex[i] = total
+	}
+}
+
+// StoredBytes returns the total number of bytes that can be sampled, which
+// is the exclusive upper bound for the index given to GetRandomBytes.
+func (r *SwarmStorage) StoredBytes() uint64 {
+	r.mapLock.Lock()
+	defer r.mapLock.Unlock()
+	if r.sampleIndex == nil {
+		r.buildSampleIndex()
 	}
-	if v == "" {
+	if len(r.sampleIndex) == 0 {
 		return 0
 	}
-	b := []byte{0}
-	r.ReadFile(v, c, b)
-	return b[0]
+	return r.sampleIndex[len(r.sampleIndex)-1]
+}
+
+// locate maps a global byte index onto the file containing it and the offset
+// of the byte within that file. Files are laid out end to end in the order
+// given by fileordering. mapLock must be write-locked by the caller.
+func (r *SwarmStorage) locate(index uint64) (i int, offset uint64, err error) {
+	if r.sampleIndex == nil {
+		r.buildSampleIndex()
+	}
+
+	// find the first file whose end lies beyond index; empty files are
+	// skipped because their end is equal to the end of the previous file
+	i = sort.Search(len(r.sampleIndex), func(j int) bool {
+		return r.sampleIndex[j] > index
+	})
+	if i == len(r.sampleIndex) {
+		err = errSampleRange
+		return
+	}
+
+	offset = index
+	if i > 0 {
+		offset -= r.sampleIndex[i-1]
+	}
+	return
+}
+
+// GetRandomBytes returns length bytes starting at the global index, where
+// the global index treats every stored file as concatenated in fileordering.
+// A range may span several files. Storage proofs pick the index from quorum
+// entropy in the range [0, StoredBytes()).
+func (r *SwarmStorage) GetRandomBytes(index uint64, length uint64) (data []byte, err error) {
+	type piece struct {
+		filehash string
+		offset   uint64
+		data     []byte
+	}
+
+	// resolve the range into per-file pieces while holding the map lock
+	r.mapLock.Lock()
+	if index+length < index {
+		r.mapLock.Unlock()
+		err = errSampleRange
+		return
+	}
+	i, offset, err := r.locate(index)
+	if err != nil || index+length > r.sampleIndex[len(r.sampleIndex)-1] {
+		r.mapLock.Unlock()
+		err = errSampleRange
+		return
+	}
+	data = make([]byte, length)
+	var pieces []piece
+	for remaining := data; len(remaining) > 0; i++ {
+		filehash := r.fileordering[i]
+		n := r.files[filehash] - offset
+		if n == 0 {
+			offset = 0
+			continue
+		}
+		if n > uint64(len(remaining)) {
+			n = uint64(len(remaining))
+		}
+		pieces = append(pieces, piece{filehash, offset, remaining[:n]})
+		remaining = remaining[n:]
+		offset = 0
+	}
+	r.mapLock.Unlock()
+
+	for _, p := range pieces {
+		err = r.ReadFile(p.filehash, p.offset, p.data)
+		if err != nil {
+			data = nil
+			return
+		}
+	}
+	return
+}
+
+// GetRandomByte returns the single byte at the global index.
+func (r *SwarmStorage) GetRandomByte(index uint64) (b byte, err error) {
+	data, err := r.GetRandomBytes(index, 1)
+	if err != nil {
+		return
+	}
+	b = data[0]
+	return
 }
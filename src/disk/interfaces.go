@@ -2,9 +2,11 @@ package disk
 
 type DiskStorage interface {
 	CreateFile(filehash string, length uint64) (int64, error)
-	ReadFile(filehash string, offset uint64, length uint64) []byte
+	ReadFile(filehash string, start uint64, data []byte) error
 	WriteFile(filehash string, start uint64, data []byte) error
 	DeleteFile(filehash string) error
 	FileExists(filehash string) bool
-	GetRandomByte(index uint64) byte
+	StoredBytes() uint64
+	GetRandomBytes(index uint64, length uint64) ([]byte, error)
+	GetRandomByte(index uint64) (byte, error)
 }
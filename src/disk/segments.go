@@ -0,0 +1,305 @@
+package disk
+
+import (
+	"common/crypto"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+var errHashMismatch = errors.New("segment data does not match its hash")
+var errUnknownSegment = errors.New("segment is not stored")
+
+// segmentEntry tracks a stored segment: its size, and the sectors that
+// currently reference it.
+type segmentEntry struct {
+	size    uint64
+	sectors map[crypto.Hash]bool
+}
+
+// segmentRecord is the on-disk form of a segmentEntry. The index file maps
+// the name of each segment to its record, and sectors are named the same way.
+type segmentRecord struct {
+	Size    uint64
+	Sectors []string
+}
+
+// SegmentStore is a content-addressed store layered over any DiskStorage.
+// Every segment is keyed by the crypto.Hash of its data, so identical
+// segments are only ever stored once. Each sector that stores a segment holds
+// one reference to it, however many times the segment is put for that
+// sector; the segment is deleted when the last sector releases it. The
+// references are kept in an index file, so that segments stored before a
+// restart can still be read and released.
+//
+// Locking: segmentsLock guards segments and segmentLocks, and is never held
+// during disk I/O. Each segment additionally has its own mutex in
+// segmentLocks, held while it is written or deleted, and taken first.
+type SegmentStore struct {
+	filename     string
+	storage      DiskStorage
+	segments     map[crypto.Hash]*segmentEntry
+	segmentLocks map[crypto.Hash]*sync.Mutex
+	segmentsLock sync.Mutex
+}
+
+// NewSegmentStore creates a SegmentStore that keeps its segments in storage,
+// and whose references are never saved.
+func NewSegmentStore(storage DiskStorage) *SegmentStore {
+	return &SegmentStore{
+		storage:      storage,
+		segments:     make(map[crypto.Hash]*segmentEntry),
+		segmentLocks: make(map[crypto.Hash]*sync.Mutex),
+	}
+}
+
+// LoadSegmentStore creates a SegmentStore over storage, taking the references
+// from the index in filename. A missing file yields an empty store; an empty
+// filename yields one that is never saved. Segments in the index that storage
+// no longer holds are dropped.
+func LoadSegmentStore(storage DiskStorage, filename string) (ss *SegmentStore, err error) {
+	ss = NewSegmentStore(storage)
+	ss.filename = filename
+	if filename == "" {
+		return
+	}
+
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		err = nil
+		return
+	} else if err != nil {
+		return
+	}
+	defer file.Close()
+
+	var records map[string]segmentRecord
+	err = json.NewDecoder(file).Decode(&records)
+	if err != nil {
+		return
+	}
+	for name, record := range records {
+		var hash crypto.Hash
+		hash, err = parseSegmentName(name)
+		if err != nil {
+			return
+		}
+		entry := &segmentEntry{size: record.Size, sectors: make(map[crypto.Hash]bool)}
+		for _, sectorName := range record.Sectors {
+			var sector crypto.Hash
+			sector, err = parseSegmentName(sectorName)
+			if err != nil {
+				return
+			}
+			entry.sectors[sector] = true
+		}
+		if len(entry.sectors) > 0 && storage.FileExists(name) {
+			ss.segments[hash] = entry
+		}
+	}
+	return
+}
+
+// Save writes the references to the index file.
+func (ss *SegmentStore) Save() (err error) {
+	if ss.filename == "" {
+		return
+	}
+
+	ss.segmentsLock.Lock()
+	records := make(map[string]segmentRecord, len(ss.segments))
+	for hash, entry := range ss.segments {
+		record := segmentRecord{Size: entry.size}
+		for sector := range entry.sectors {
+			record.Sectors = append(record.Sectors, segmentName(sector))
+		}
+		records[segmentName(hash)] = record
+	}
+	ss.segmentsLock.Unlock()
+
+	file, err := os.Create(ss.filename)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	return json.NewEncoder(file).Encode(records)
+}
+
+// segmentName converts a hash into the filehash used by the DiskStorage.
+func segmentName(hash crypto.Hash) string {
+	return hex.EncodeToString(hash[:])
+}
+
+// parseSegmentName converts a name made by segmentName back into its hash.
+func parseSegmentName(name string) (hash crypto.Hash, err error) {
+	decoded, err := hex.DecodeString(name)
+	if err != nil {
+		return
+	}
+	if len(decoded) != len(hash) {
+		err = fmt.Errorf("Cannot load segment %v: wrong length", name)
+		return
+	}
+	copy(hash[:], decoded)
+	return
+}
+
+// segmentLock returns the mutex for a segment, creating it if needed. As in
+// SwarmStorage, locks are never removed.
+func (ss *SegmentStore) segmentLock(hash crypto.Hash) *sync.Mutex {
+	ss.segmentsLock.Lock()
+	defer ss.segmentsLock.Unlock()
+	l := ss.segmentLocks[hash]
+	if l == nil {
+		l = new(sync.Mutex)
+		ss.segmentLocks[hash] = l
+	}
+	return l
+}
+
+// Put stores data for sector under its hash and returns the hash. If the
+// segment is already stored, sector is only added to its references.
+func (ss *SegmentStore) Put(sector crypto.Hash, data []byte) (hash crypto.Hash, err error) {
+	hash, err = crypto.CalculateHash(data)
+	if err != nil {
+		return
+	}
+	err = ss.put(sector, hash, data)
+	return
+}
+
+// PutVerified stores data for sector under the hash the caller expects it to
+// have, rejecting the write if the data does not hash to that value.
+func (ss *SegmentStore) PutVerified(sector crypto.Hash, hash crypto.Hash, data []byte) (err error) {
+	actual, err := crypto.CalculateHash(data)
+	if err != nil {
+		return
+	}
+	if actual != hash {
+		return errHashMismatch
+	}
+	return ss.put(sector, hash, data)
+}
+
+// put adds sector to the references of a segment whose hash has already been
+// verified, writing it to disk if this is the first reference.
+func (ss *SegmentStore) put(sector crypto.Hash, hash crypto.Hash, data []byte) (err error) {
+	l := ss.segmentLock(hash)
+	l.Lock()
+	defer l.Unlock()
+
+	ss.segmentsLock.Lock()
+	entry, exists := ss.segments[hash]
+	if exists {
+		entry.sectors[sector] = true
+	}
+	ss.segmentsLock.Unlock()
+	if exists {
+		return
+	}
+
+	name := segmentName(hash)
+	_, err = ss.storage.CreateFile(name, uint64(len(data)))
+	if err != nil {
+		return
+	}
+	err = ss.storage.WriteFile(name, 0, data)
+	if err != nil {
+		ss.storage.DeleteFile(name)
+		return
+	}
+	ss.segmentsLock.Lock()
+	ss.segments[hash] = &segmentEntry{
+		size:    uint64(len(data)),
+		sectors: map[crypto.Hash]bool{sector: true},
+	}
+	ss.segmentsLock.Unlock()
+	return
+}
+
+// Get reads the segment with the given hash. The data is checked against
+// the hash before it is returned, so corruption on disk is reported as an
+// error rather than handed out.
+func (ss *SegmentStore) Get(hash crypto.Hash) (data []byte, err error) {
+	ss.segmentsLock.Lock()
+	entry, exists := ss.segments[hash]
+	var size uint64
+	if exists {
+		size = entry.size
+	}
+	ss.segmentsLock.Unlock()
+	if !exists {
+		err = errUnknownSegment
+		return
+	}
+
+	data = make([]byte, size)
+	err = ss.storage.ReadFile(segmentName(hash), 0, data)
+	if err != nil {
+		data = nil
+		return
+	}
+	actual, err := crypto.CalculateHash(data)
+	if err != nil {
+		data = nil
+		return
+	}
+	if actual != hash {
+		data = nil
+		err = errHashMismatch
+	}
+	return
+}
+
+// Release drops sector's reference to the segment, deleting it from disk
+// once no sector references it.
+func (ss *SegmentStore) Release(sector crypto.Hash, hash crypto.Hash) (err error) {
+	l := ss.segmentLock(hash)
+	l.Lock()
+	defer l.Unlock()
+
+	ss.segmentsLock.Lock()
+	entry, exists := ss.segments[hash]
+	if !exists || !entry.sectors[sector] {
+		ss.segmentsLock.Unlock()
+		return errUnknownSegment
+	}
+	if len(entry.sectors) > 1 {
+		delete(entry.sectors, sector)
+		ss.segmentsLock.Unlock()
+		return
+	}
+	ss.segmentsLock.Unlock()
+
+	err = ss.storage.DeleteFile(segmentName(hash))
+	if err != nil {
+		return
+	}
+	ss.segmentsLock.Lock()
+	delete(ss.segments, hash)
+	ss.segmentsLock.Unlock()
+	return
+}
+
+// Holds returns true if sector references the segment.
+func (ss *SegmentStore) Holds(sector crypto.Hash, hash crypto.Hash) bool {
+	ss.segmentsLock.Lock()
+	defer ss.segmentsLock.Unlock()
+	entry, exists := ss.segments[hash]
+	return exists && entry.sectors[sector]
+}
+
+// References returns the number of sectors that reference a segment, which
+// is zero if the segment is not stored.
+func (ss *SegmentStore) References(hash crypto.Hash) int {
+	ss.segmentsLock.Lock()
+	defer ss.segmentsLock.Unlock()
+	entry, exists := ss.segments[hash]
+	if !exists {
+		return 0
+	}
+	return len(entry.sectors)
+}
@@ -0,0 +1,214 @@
+package disk
+
+import (
+	"bytes"
+	"common/crypto"
+	"os"
+	"sync"
+	"testing"
+)
+
+// Identical segments are stored once, and only deleted when the last sector
+// referencing them releases them.
+func Test_SegmentDeduplication(t *testing.T) {
+	storage, err := CreateSwarmSystem("segments")
+	defer storage.Delete()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss := NewSegmentStore(storage)
+
+	data := []byte{3, 1, 4, 1, 5, 9, 2, 6}
+	hash, err := ss.Put(crypto.Hash{1}, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, _ := crypto.CalculateHash(data)
+	if hash != expected {
+		t.Fatal("Put returned a key that is not the hash of the data")
+	}
+
+	// a retried upload for the same sector adds no reference
+	err = ss.PutVerified(crypto.Hash{1}, hash, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ss.References(hash) != 1 {
+		t.Error("retried upload added a reference, got", ss.References(hash))
+	}
+
+	// a second sector uploads the same segment
+	err = ss.PutVerified(crypto.Hash{2}, hash, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ss.References(hash) != 2 || !ss.Holds(crypto.Hash{2}, hash) {
+		t.Error("expected 2 references, got", ss.References(hash))
+	}
+	if storage.StoredBytes() != uint64(len(data)) {
+		t.Error("duplicate segment was stored twice")
+	}
+
+	// releasing one reference keeps the data, and a sector can only release
+	// its own reference once
+	err = ss.Release(crypto.Hash{1}, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ss.Release(crypto.Hash{1}, hash) != errUnknownSegment {
+		t.Error("a sector released the same segment twice")
+	}
+	read, err := ss.Get(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(read, data) {
+		t.Error("Get returned", read, "expected", data)
+	}
+
+	// releasing the last reference deletes it
+	err = ss.Release(crypto.Hash{2}, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if storage.FileExists(segmentName(hash)) {
+		t.Error("segment still on disk after last reference was released")
+	}
+	if _, err = ss.Get(hash); err != errUnknownSegment {
+		t.Error("expected errUnknownSegment, got", err)
+	}
+	if ss.Release(crypto.Hash{2}, hash) != errUnknownSegment {
+		t.Error("released a segment that is not stored")
+	}
+}
+
+// Concurrent puts of the same segment, some of them retries, store it once
+// and record one reference per sector. Run with -race to check the locking.
+func Test_SegmentConcurrentPut(t *testing.T) {
+	storage, err := CreateSwarmSystem("concurrentsegments")
+	defer storage.Delete()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss := NewSegmentStore(storage)
+
+	data := []byte{1, 4, 1, 4, 2, 1, 3, 5}
+	wg := &sync.WaitGroup{}
+	for c := 0; c < 64; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			_, err := ss.Put(crypto.Hash{byte(c % 4)}, data)
+			if err != nil {
+				t.Error(err)
+			}
+		}(c)
+	}
+	wg.Wait()
+
+	hash, _ := crypto.CalculateHash(data)
+	if ss.References(hash) != 4 {
+		t.Error("expected 4 references, got", ss.References(hash))
+	}
+	if storage.StoredBytes() != uint64(len(data)) {
+		t.Error("segment was stored", storage.StoredBytes(), "bytes, expected", len(data))
+	}
+
+	// releasing and re-putting concurrently leaves the store consistent
+	for c := 0; c < 64; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			if c%2 == 0 {
+				ss.Release(crypto.Hash{byte(c % 4)}, hash)
+			} else {
+				ss.Put(crypto.Hash{byte(c % 4)}, data)
+			}
+		}(c)
+	}
+	wg.Wait()
+	if (ss.References(hash) > 0) != storage.FileExists(segmentName(hash)) {
+		t.Error("references and storage disagree:", ss.References(hash), storage.FileExists(segmentName(hash)))
+	}
+}
+
+// Writes and reads are checked against the segment's hash.
+func Test_SegmentVerification(t *testing.T) {
+	storage, err := CreateSwarmSystem("verification")
+	defer storage.Delete()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss := NewSegmentStore(storage)
+
+	data := []byte{2, 7, 1, 8}
+	wrong, _ := crypto.CalculateHash([]byte{0})
+	if ss.PutVerified(crypto.Hash{}, wrong, data) != errHashMismatch {
+		t.Error("stored a segment under a hash that does not match its data")
+	}
+	if ss.References(wrong) != 0 {
+		t.Error("rejected segment was recorded")
+	}
+
+	// corrupt a stored segment on disk
+	hash, err := ss.Put(crypto.Hash{}, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = storage.WriteFile(segmentName(hash), 0, []byte{0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ss.Get(hash); err != errHashMismatch {
+		t.Error("expected errHashMismatch reading a corrupt segment, got", err)
+	}
+}
+
+// References survive a restart through the index file.
+func Test_SegmentIndex(t *testing.T) {
+	storage, err := CreateSwarmSystem("index")
+	defer storage.Delete()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("index.json")
+	ss, err := LoadSegmentStore(storage, "index.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte{1, 6, 1, 8}
+	hash, err := ss.Put(crypto.Hash{1}, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss.Put(crypto.Hash{2}, data)
+	gone, err := ss.Put(crypto.Hash{1}, []byte{0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ss.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.DeleteFile(segmentName(gone))
+
+	reloaded, err := LoadSegmentStore(storage, "index.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.References(hash) != 2 || !reloaded.Holds(crypto.Hash{2}, hash) {
+		t.Fatal("expected 2 references after reloading, got", reloaded.References(hash))
+	}
+	if reloaded.References(gone) != 0 {
+		t.Error("segment missing from storage was loaded")
+	}
+	if read, err := reloaded.Get(hash); err != nil || !bytes.Equal(read, data) {
+		t.Error("could not read a segment after reloading:", err)
+	}
+	reloaded.Release(crypto.Hash{1}, hash)
+	reloaded.Release(crypto.Hash{2}, hash)
+	if storage.FileExists(segmentName(hash)) {
+		t.Error("segment still on disk after its references were released")
+	}
+}
@@ -0,0 +1,457 @@
+package disk
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+)
+
+var errNoVolume = errors.New("no volume has enough free space for the file")
+var errUnknownFile = errors.New("file is not stored on any volume")
+
+// A Volume is a single root directory, usually a whole disk, that holds part
+// of a swarm's files. Capacity is the most bytes the volume may hold.
+type Volume struct {
+	Path     string
+	Capacity uint64
+	storage  *SwarmStorage
+	draining bool
+
+	// reserved is the space promised to writes and migrations in progress.
+	// It is read atomically, and only increased under volumesLock.
+	reserved uint64
+}
+
+// Used returns the number of bytes stored on the volume.
+func (v *Volume) Used() uint64 {
+	return v.storage.StoredBytes()
+}
+
+// Free returns the number of bytes that can still be placed on the volume.
+func (v *Volume) Free() uint64 {
+	used := v.Used() + atomic.LoadUint64(&v.reserved)
+	if used >= v.Capacity {
+		return 0
+	}
+	return v.Capacity - used
+}
+
+// reserve sets aside n bytes of free space, returning false if there is not
+// enough. volumesLock must be write-locked by the caller, so that two
+// reservations cannot both take the same space.
+func (v *Volume) reserve(n uint64) bool {
+	if v.Free() < n {
+		return false
+	}
+	atomic.AddUint64(&v.reserved, n)
+	return true
+}
+
+// release returns n reserved bytes, once they are stored or no longer needed.
+func (v *Volume) release(n uint64) {
+	atomic.AddUint64(&v.reserved, -n)
+}
+
+// A PlacementPolicy picks the volume that a new file of the given length is
+// created on. It only ever sees volumes that are accepting files, and returns
+// nil if none of them are suitable.
+type PlacementPolicy func(volumes []*Volume, length uint64) *Volume
+
+// MostFree places each file on the volume with the most free space, which
+// keeps the volumes evenly filled.
+func MostFree(volumes []*Volume, length uint64) (best *Volume) {
+	var bestFree uint64
+	for _, v := range volumes {
+		free := v.Free()
+		if free >= length && (best == nil || free > bestFree) {
+			best = v
+			bestFree = free
+		}
+	}
+	return
+}
+
+// FirstFit places each file on the first volume, in the order the volumes
+// were added, that has room for it.
+func FirstFit(volumes []*Volume, length uint64) *Volume {
+	for _, v := range volumes {
+		if v.Free() >= length {
+			return v
+		}
+	}
+	return nil
+}
+
+// MultiVolumeStorage spreads the files of a single swarm across several
+// volumes. Each volume holds an ordinary SwarmStorage rooted at
+// <volume path>/<swarm id>, and every file lives on exactly one volume.
+type MultiVolumeStorage struct {
+	SwarmId string
+	policy  PlacementPolicy
+
+	// volumesLock guards volumes, locations and fileLocks; the file contents
+	// are guarded by the SwarmStorage of each volume. Each file additionally
+	// has a mutex in fileLocks, held while it is migrated and for any
+	// operation on it, so that a migration does not lose a write. When both
+	// are needed the file lock is taken first, and volumesLock is never held
+	// while a file is copied.
+	volumes     []*Volume
+	locations   map[string]*Volume
+	fileLocks   map[string]*sync.Mutex
+	volumesLock sync.RWMutex
+}
+
+// CreateMultiVolumeStorage creates a storage layer with no volumes. If policy
+// is nil, MostFree is used.
+func CreateMultiVolumeStorage(swarmid string, policy PlacementPolicy) *MultiVolumeStorage {
+	if policy == nil {
+		policy = MostFree
+	}
+	return &MultiVolumeStorage{
+		SwarmId:   swarmid,
+		policy:    policy,
+		locations: make(map[string]*Volume),
+		fileLocks: make(map[string]*sync.Mutex),
+	}
+}
+
+// fileLock returns the mutex for filehash, creating it if needed. As in
+// SwarmStorage, locks are never removed.
+func (m *MultiVolumeStorage) fileLock(filehash string) *sync.Mutex {
+	m.volumesLock.Lock()
+	defer m.volumesLock.Unlock()
+	l := m.fileLocks[filehash]
+	if l == nil {
+		l = new(sync.Mutex)
+		m.fileLocks[filehash] = l
+	}
+	return l
+}
+
+// AddVolume opens or creates the swarm directory under path and makes it
+// available for new files. Files already present on the volume are adopted.
+func (m *MultiVolumeStorage) AddVolume(path string, capacity uint64) (err error) {
+	m.volumesLock.Lock()
+	defer m.volumesLock.Unlock()
+	for _, v := range m.volumes {
+		if v.Path == path {
+			return fmt.Errorf("volume %v has already been added", path)
+		}
+	}
+
+	storage, err := CreateSwarmSystem(filepath.Join(path, m.SwarmId))
+	if err != nil {
+		return
+	}
+	v := &Volume{
+		Path:     path,
+		Capacity: capacity,
+		storage:  storage,
+	}
+	for filehash := range storage.fileSizes() {
+		if _, exists := m.locations[filehash]; exists {
+			return fmt.Errorf("file %v is stored on more than one volume", filehash)
+		}
+	}
+	for filehash := range storage.fileSizes() {
+		m.locations[filehash] = v
+	}
+	m.volumes = append(m.volumes, v)
+	return
+}
+
+// Volumes returns the volumes in the order they were added.
+func (m *MultiVolumeStorage) Volumes() (volumes []*Volume) {
+	m.volumesLock.RLock()
+	defer m.volumesLock.RUnlock()
+	volumes = make([]*Volume, len(m.volumes))
+	copy(volumes, m.volumes)
+	return
+}
+
+// DrainVolume stops new files from being placed on the volume at path, moves
+// every file it holds onto the remaining volumes, and then removes it. Other
+// operations continue while the files are migrated; only the file being
+// moved is unavailable. If a file cannot be placed, draining stops and the
+// volume stays in the draining state, holding the files not yet moved.
+func (m *MultiVolumeStorage) DrainVolume(path string) (err error) {
+	m.volumesLock.Lock()
+	var v *Volume
+	for _, candidate := range m.volumes {
+		if candidate.Path == path {
+			v = candidate
+		}
+	}
+	if v == nil {
+		m.volumesLock.Unlock()
+		return fmt.Errorf("volume %v does not exist", path)
+	}
+	v.draining = true
+	m.volumesLock.Unlock()
+
+	for filehash := range v.storage.fileSizes() {
+		err = m.migrate(filehash, v)
+		if err != nil {
+			return
+		}
+	}
+
+	// remove the now empty volume
+	m.volumesLock.Lock()
+	for i, candidate := range m.volumes {
+		if candidate == v {
+			m.volumes = append(m.volumes[:i], m.volumes[i+1:]...)
+			break
+		}
+	}
+	m.volumesLock.Unlock()
+	v.storage.Delete()
+	return
+}
+
+// migrate copies a file from one volume to another chosen by the placement
+// policy, then deletes the original. Only the file's own lock is held during
+// the copy. The copy is prepared outside the destination swarm, with its
+// space reserved, and swapped in under volumesLock, so that the file is never
+// counted or sampled twice, nor read half written.
+func (m *MultiVolumeStorage) migrate(filehash string, from *Volume) (err error) {
+	l := m.fileLock(filehash)
+	l.Lock()
+	defer l.Unlock()
+
+	// the file may have been deleted since the drain began
+	m.volumesLock.Lock()
+	if m.locations[filehash] != from {
+		m.volumesLock.Unlock()
+		return
+	}
+	size := from.storage.fileSizes()[filehash]
+	to := m.policy(m.accepting(), size)
+	if to == nil || !to.reserve(size) {
+		m.volumesLock.Unlock()
+		return errNoVolume
+	}
+	m.volumesLock.Unlock()
+	defer to.release(size)
+
+	data := make([]byte, size)
+	err = from.storage.ReadFile(filehash, 0, data)
+	if err != nil {
+		return
+	}
+	staging := to.storage.stagingName(filehash)
+	err = ioutil.WriteFile(staging, data, os.ModePerm)
+	if err != nil {
+		os.Remove(staging)
+		return
+	}
+
+	m.volumesLock.Lock()
+	defer m.volumesLock.Unlock()
+	err = to.storage.adoptFile(filehash)
+	if err != nil {
+		os.Remove(staging)
+		return
+	}
+	m.locations[filehash] = to
+	return from.storage.DeleteFile(filehash)
+}
+
+// accepting returns the volumes that new files may be placed on. volumesLock
+// must be held by the caller.
+func (m *MultiVolumeStorage) accepting() (volumes []*Volume) {
+	for _, v := range m.volumes {
+		if !v.draining {
+			volumes = append(volumes, v)
+		}
+	}
+	return
+}
+
+// locate returns the volume that holds filehash.
+func (m *MultiVolumeStorage) locate(filehash string) (v *Volume, err error) {
+	m.volumesLock.RLock()
+	v = m.locations[filehash]
+	m.volumesLock.RUnlock()
+	if v == nil {
+		err = errUnknownFile
+	}
+	return
+}
+
+// CreateFile creates the file on the volume chosen by the placement policy.
+// If the file already exists, it is resized on the volume that holds it.
+func (m *MultiVolumeStorage) CreateFile(filehash string, length uint64) (written int64, err error) {
+	l := m.fileLock(filehash)
+	l.Lock()
+	defer l.Unlock()
+	m.volumesLock.Lock()
+	defer m.volumesLock.Unlock()
+	v := m.locations[filehash]
+	if v == nil {
+		v = m.policy(m.accepting(), length)
+		if v == nil {
+			err = errNoVolume
+			return
+		}
+	} else if size := v.storage.fileSizes()[filehash]; length > size && length-size > v.Free() {
+		err = errNoVolume
+		return
+	}
+	written, err = v.storage.CreateFile(filehash, length)
+	if err != nil {
+		return
+	}
+	m.locations[filehash] = v
+	return
+}
+
+func (m *MultiVolumeStorage) ReadFile(filehash string, start uint64, data []byte) error {
+	l := m.fileLock(filehash)
+	l.Lock()
+	defer l.Unlock()
+	v, err := m.locate(filehash)
+	if err != nil {
+		return err
+	}
+	return v.storage.ReadFile(filehash, start, data)
+}
+
+// WriteFile writes to the file on the volume that holds it, refusing writes
+// that would grow the volume past its capacity. The growth is reserved
+// before writing, so concurrent writes to other files on the volume cannot
+// together exceed it.
+func (m *MultiVolumeStorage) WriteFile(filehash string, start uint64, data []byte) error {
+	l := m.fileLock(filehash)
+	l.Lock()
+	defer l.Unlock()
+
+	m.volumesLock.Lock()
+	v := m.locations[filehash]
+	if v == nil {
+		m.volumesLock.Unlock()
+		return errUnknownFile
+	}
+	var growth uint64
+	if end, size := start+uint64(len(data)), v.storage.fileSizes()[filehash]; end > size {
+		growth = end - size
+	}
+	if !v.reserve(growth) {
+		m.volumesLock.Unlock()
+		return errNoVolume
+	}
+	m.volumesLock.Unlock()
+	defer v.release(growth)
+	return v.storage.WriteFile(filehash, start, data)
+}
+
+func (m *MultiVolumeStorage) DeleteFile(filehash string) (err error) {
+	l := m.fileLock(filehash)
+	l.Lock()
+	defer l.Unlock()
+	m.volumesLock.Lock()
+	defer m.volumesLock.Unlock()
+	v := m.locations[filehash]
+	if v == nil {
+		return errUnknownFile
+	}
+	err = v.storage.DeleteFile(filehash)
+	if err != nil {
+		return
+	}
+	delete(m.locations, filehash)
+	return
+}
+
+func (m *MultiVolumeStorage) FileExists(filehash string) bool {
+	_, err := m.locate(filehash)
+	return err == nil
+}
+
+// StoredBytes returns the total number of bytes stored across all volumes.
+func (m *MultiVolumeStorage) StoredBytes() (total uint64) {
+	m.volumesLock.RLock()
+	defer m.volumesLock.RUnlock()
+	for _, v := range m.volumes {
+		total += v.Used()
+	}
+	return
+}
+
+// GetRandomBytes treats the volumes as concatenated in the order they were
+// added, and the files within each volume as concatenated in the same way
+// SwarmStorage does. A range may span several volumes.
+func (m *MultiVolumeStorage) GetRandomBytes(index uint64, length uint64) (data []byte, err error) {
+	m.volumesLock.RLock()
+	defer m.volumesLock.RUnlock()
+	if index+length < index {
+		err = errSampleRange
+		return
+	}
+
+	data = make([]byte, 0, length)
+	for _, v := range m.volumes {
+		used := v.Used()
+		if index >= used {
+			index -= used
+			continue
+		}
+
+		n := used - index
+		if n > length-uint64(len(data)) {
+			n = length - uint64(len(data))
+		}
+		var piece []byte
+		piece, err = v.storage.GetRandomBytes(index, n)
+		if err != nil {
+			data = nil
+			return
+		}
+		data = append(data, piece...)
+		index = 0
+		if uint64(len(data)) == length {
+			return
+		}
+	}
+
+	data = nil
+	err = errSampleRange
+	return
+}
+
+func (m *MultiVolumeStorage) GetRandomByte(index uint64) (b byte, err error) {
+	data, err := m.GetRandomBytes(index, 1)
+	if err != nil {
+		return
+	}
+	b = data[0]
+	return
+}
+
+// Save writes the metadata of every volume to disk, returning the first
+// error encountered.
+func (m *MultiVolumeStorage) Save() (err error) {
+	m.volumesLock.RLock()
+	defer m.volumesLock.RUnlock()
+	for _, v := range m.volumes {
+		if saveErr := v.storage.SaveSwarm(); saveErr != nil && err == nil {
+			err = saveErr
+		}
+	}
+	return
+}
+
+// Delete removes every file on every volume.
+func (m *MultiVolumeStorage) Delete() {
+	m.volumesLock.Lock()
+	defer m.volumesLock.Unlock()
+	for _, v := range m.volumes {
+		v.storage.Delete()
+	}
+	m.volumes = nil
+	m.locations = make(map[string]*Volume)
+}
@@ -0,0 +1,278 @@
+package disk
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+// makeVolumes creates a directory for each volume and returns a function
+// that removes them all.
+func makeVolumes(t *testing.T, paths ...string) func() {
+	for _, path := range paths {
+		err := os.Mkdir(path, os.ModeDir|os.ModePerm)
+		if err != nil && !os.IsExist(err) {
+			t.Fatal(err)
+		}
+	}
+	return func() {
+		for _, path := range paths {
+			os.RemoveAll(path)
+		}
+	}
+}
+
+// Files are placed according to the policy, and capacity is enforced.
+func Test_VolumePlacement(t *testing.T) {
+	defer makeVolumes(t, "vol0", "vol1")()
+	var _ DiskStorage = (*SwarmStorage)(nil)
+	var _ DiskStorage = (*MultiVolumeStorage)(nil)
+
+	m := CreateMultiVolumeStorage("placement", nil)
+	defer m.Delete()
+	if err := m.AddVolume("vol0", 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.AddVolume("vol1", 50); err != nil {
+		t.Fatal(err)
+	}
+	if m.AddVolume("vol0", 100) == nil {
+		t.Error("added the same volume twice")
+	}
+
+	// MostFree puts the first file on vol0, then balances onto vol1
+	if _, err := m.CreateFile("a", 60); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.CreateFile("b", 30); err != nil {
+		t.Fatal(err)
+	}
+	volumes := m.Volumes()
+	if volumes[0].Used() != 60 || volumes[1].Used() != 30 {
+		t.Error("unexpected placement:", volumes[0].Used(), volumes[1].Used())
+	}
+
+	// nothing has room for a 50 byte file now
+	if _, err := m.CreateFile("c", 50); err != errNoVolume {
+		t.Error("expected errNoVolume, got", err)
+	}
+
+	// growing a file past its volume's capacity fails
+	if err := m.WriteFile("b", 40, make([]byte, 20)); err != errNoVolume {
+		t.Error("expected errNoVolume, got", err)
+	}
+
+	if m.StoredBytes() != 90 {
+		t.Error("StoredBytes returned", m.StoredBytes(), "expected 90")
+	}
+	if err := m.DeleteFile("a"); err != nil {
+		t.Fatal(err)
+	}
+	if m.FileExists("a") {
+		t.Error("file still exists after deletion")
+	}
+	if volumes[0].Used() != 0 {
+		t.Error("deleted file still counts towards volume usage")
+	}
+}
+
+// Draining a volume moves its files elsewhere without changing their contents.
+func Test_VolumeDrain(t *testing.T) {
+	defer makeVolumes(t, "vol2", "vol3")()
+
+	m := CreateMultiVolumeStorage("drain", FirstFit)
+	defer m.Delete()
+	if err := m.AddVolume("vol2", 100); err != nil {
+		t.Fatal(err)
+	}
+
+	contents := map[string][]byte{
+		"x": {1, 2, 3},
+		"y": {4, 5, 6, 7},
+	}
+	for name, data := range contents {
+		if _, err := m.CreateFile(name, uint64(len(data))); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.WriteFile(name, 0, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// with nowhere to go, draining fails and leaves the files readable
+	if err := m.DrainVolume("vol2"); err != errNoVolume {
+		t.Fatal("expected errNoVolume, got", err)
+	}
+
+	if err := m.AddVolume("vol3", 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.DrainVolume("vol2"); err != nil {
+		t.Fatal(err)
+	}
+	volumes := m.Volumes()
+	if len(volumes) != 1 || volumes[0].Path != "vol3" {
+		t.Fatal("drained volume was not removed")
+	}
+
+	for name, data := range contents {
+		read := make([]byte, len(data))
+		if err := m.ReadFile(name, 0, read); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(read, data) {
+			t.Error("file", name, "changed during migration:", read)
+		}
+	}
+
+	// sampling covers everything on the remaining volume
+	data, err := m.GetRandomBytes(0, m.StoredBytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, []byte{1, 2, 3, 4, 5, 6, 7}) {
+		t.Error("unexpected sample:", data)
+	}
+}
+
+// Files stay writable while a volume drains, and no write is lost to a
+// migration.
+func Test_VolumeDrainConcurrent(t *testing.T) {
+	defer makeVolumes(t, "vol4", "vol5")()
+
+	m := CreateMultiVolumeStorage("concurrent", FirstFit)
+	defer m.Delete()
+	if err := m.AddVolume("vol4", 1000); err != nil {
+		t.Fatal(err)
+	}
+	names := []string{"p", "q", "r", "s", "t", "u", "v", "w"}
+	for _, name := range names {
+		if _, err := m.CreateFile(name, 4); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.AddVolume("vol5", 1000); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- m.DrainVolume("vol4")
+	}()
+	for round := byte(1); round <= 20; round++ {
+		for _, name := range names {
+			if err := m.WriteFile(name, 0, []byte{round, round, round, round}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range names {
+		read := make([]byte, 4)
+		if err := m.ReadFile(name, 0, read); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(read, []byte{20, 20, 20, 20}) {
+			t.Error("write to", name, "was lost during migration:", read)
+		}
+	}
+}
+
+// Growing a file by resizing it, or by concurrent writes to several files,
+// cannot take a volume past its capacity.
+func Test_VolumeCapacity(t *testing.T) {
+	defer makeVolumes(t, "vol6")()
+
+	m := CreateMultiVolumeStorage("capacity", nil)
+	defer m.Delete()
+	if err := m.AddVolume("vol6", 10); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.CreateFile("a", 4); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.CreateFile("a", 11); err != errNoVolume {
+		t.Error("resized a file past the capacity of its volume:", err)
+	}
+	if _, err := m.CreateFile("a", 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.CreateFile("b", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// only one of two writes of 6 bytes fits in 10
+	errs := make(chan error)
+	for _, name := range []string{"a", "b"} {
+		go func(name string) {
+			errs <- m.WriteFile(name, 0, make([]byte, 6))
+		}(name)
+	}
+	failed := 0
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err == errNoVolume {
+			failed++
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if failed != 1 || m.StoredBytes() != 6 {
+		t.Error("concurrent writes stored", m.StoredBytes(), "bytes with", failed, "refused")
+	}
+}
+
+// While a volume drains, every file is counted and sampled exactly once, and
+// never read half copied.
+func Test_VolumeDrainSampling(t *testing.T) {
+	defer makeVolumes(t, "vol7", "vol8")()
+
+	m := CreateMultiVolumeStorage("sampling", FirstFit)
+	defer m.Delete()
+	if err := m.AddVolume("vol7", 1<<22); err != nil {
+		t.Fatal(err)
+	}
+	var total uint64
+	for _, name := range []string{"p", "q", "r", "s", "t", "u", "v", "w"} {
+		data := bytes.Repeat([]byte{0xff}, 1<<18)
+		if _, err := m.CreateFile(name, uint64(len(data))); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.WriteFile(name, 0, data); err != nil {
+			t.Fatal(err)
+		}
+		total += uint64(len(data))
+	}
+	if err := m.AddVolume("vol8", 1<<22); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- m.DrainVolume("vol7")
+	}()
+	for draining := true; draining; {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+			draining = false
+		default:
+		}
+		for i := 0; i < 100; i++ {
+			if stored := m.StoredBytes(); stored != total {
+				t.Fatal("stored bytes changed during the drain:", stored)
+			}
+		}
+		data, err := m.GetRandomBytes(0, total)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, bytes.Repeat([]byte{0xff}, int(total))) {
+			t.Fatal("sampled a file that was not fully copied")
+		}
+	}
+}
@@ -0,0 +1,112 @@
+// keytool generates and inspects participant identity keys.
+//
+// Usage:
+//
+//	keytool generate <keyfile>
+//	keytool inspect <keyfile>
+//
+// If the environment variable SIA_KEY_PASSPHRASE is set, generated keys are
+// encrypted with it and it is used to decrypt keys being inspected.
+package main
+
+import (
+	"common/crypto"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"quorum"
+)
+
+// fingerprint returns a short hex identifier for a public key.
+func fingerprint(pk *crypto.PublicKey) (fp string, err error) {
+	encoded, err := pk.MarshalPEM()
+	if err != nil {
+		return
+	}
+	hash, err := crypto.CalculateTruncatedHash(encoded)
+	if err != nil {
+		return
+	}
+	fp = hex.EncodeToString(hash[:8])
+	return
+}
+
+// generate creates a new key and saves it, refusing to overwrite a key.
+func generate(w io.Writer, filename string, passphrase []byte) (err error) {
+	if _, err = os.Stat(filename); err == nil {
+		return fmt.Errorf("%v already exists", filename)
+	}
+	pubKey, secKey, err := crypto.CreateKeyPair()
+	if err != nil {
+		return
+	}
+	err = crypto.SaveSecretKey(filename, &secKey, passphrase)
+	if err != nil {
+		return
+	}
+	fp, err := fingerprint(pubKey)
+	if err != nil {
+		return
+	}
+	fmt.Fprintln(w, "generated key", fp)
+	return
+}
+
+// inspect prints the fingerprint, wallet ID and public key of a secret or
+// public key file.
+func inspect(w io.Writer, filename string, passphrase []byte) (err error) {
+	encoded, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return
+	}
+	pubKey, err := crypto.UnmarshalPublicKey(encoded)
+	if err != nil {
+		var secKey crypto.SecretKey
+		secKey, err = crypto.UnmarshalSecretKey(encoded, passphrase)
+		if err != nil {
+			return
+		}
+		pubKey = secKey.Public()
+	}
+
+	fp, err := fingerprint(pubKey)
+	if err != nil {
+		return
+	}
+	wallet, err := quorum.NewWalletID(pubKey)
+	if err != nil {
+		return
+	}
+	encodedPubKey, err := pubKey.MarshalPEM()
+	if err != nil {
+		return
+	}
+	fmt.Fprintln(w, "fingerprint:", fp)
+	fmt.Fprintln(w, "wallet:", wallet)
+	fmt.Fprint(w, string(encodedPubKey))
+	return
+}
+
+func main() {
+	if len(os.Args) != 3 {
+		fmt.Fprintln(os.Stderr, "usage: keytool generate|inspect <keyfile>")
+		os.Exit(2)
+	}
+	passphrase := []byte(os.Getenv("SIA_KEY_PASSPHRASE"))
+
+	var err error
+	switch os.Args[1] {
+	case "generate":
+		err = generate(os.Stdout, os.Args[2], passphrase)
+	case "inspect":
+		err = inspect(os.Stdout, os.Args[2], passphrase)
+	default:
+		err = fmt.Errorf("unrecognized command %q", os.Args[1])
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+// A generated key can be inspected, and is not overwritten by a second generate.
+func TestGenerateInspect(t *testing.T) {
+	defer os.Remove("test.key")
+	passphrase := []byte("passphrase")
+
+	var out bytes.Buffer
+	err := generate(&out, "test.key", passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp := strings.TrimPrefix(strings.TrimSpace(out.String()), "generated key ")
+
+	err = generate(&out, "test.key", passphrase)
+	if err == nil {
+		t.Error("generate overwrote an existing key")
+	}
+
+	out.Reset()
+	err = inspect(&out, "test.key", passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "fingerprint: "+fp) {
+		t.Error("inspect reported a different fingerprint:", out.String())
+	}
+	if !strings.Contains(out.String(), "wallet: ") {
+		t.Error("inspect did not print the wallet ID")
+	}
+	if !strings.Contains(out.String(), "SIA PUBLIC KEY") {
+		t.Error("inspect did not print the public key")
+	}
+
+	err = inspect(&out, "test.key", nil)
+	if err == nil {
+		t.Error("inspected an encrypted key without its passphrase")
+	}
+}
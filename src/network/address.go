@@ -0,0 +1,95 @@
+package network
+
+import (
+	"net"
+	"time"
+)
+
+// learnThreshold is the number of distinct peers that must report the same
+// observed host before the RPCServer advertises it. Requiring agreement
+// keeps a single peer from redirecting our address.
+const learnThreshold = 2
+
+// ServerConfig describes where an RPCServer listens and what address it
+// advertises to other hosts.
+type ServerConfig struct {
+	// BindHost is the local address to listen on. An empty BindHost listens
+	// on every interface. IPv6 addresses are given without brackets.
+	BindHost string
+	Port     int
+
+	// AdvertiseHost is the host other hosts should use to reach this one,
+	// such as an external address behind a NAT. If empty, it is detected
+	// from BindHost and the local interfaces.
+	AdvertiseHost string
+
+	// LearnAddress replaces the detected host with the host that peers
+	// observe our connections coming from, once learnThreshold peers agree.
+	// It has no effect if AdvertiseHost is set.
+	LearnAddress bool
+
+	// Timeout bounds SendMessage and SendAsyncMessage. A message is useful
+	// for as long as the longest step the quorum allows, whatever duration
+	// the steps have adapted to. Zero uses DefaultTimeout.
+	Timeout time.Duration
+
+	// ProtocolVersion is the newest protocol version the server speaks,
+	// between common.MinProtocolVersion and common.ProtocolVersion. A host
+	// can keep speaking the previous version until the rest of its quorum
+	// has upgraded. Zero uses common.ProtocolVersion.
+	ProtocolVersion uint16
+}
+
+// detectHost picks the host to advertise when none is configured. A specific
+// bind address is advertised as is. Otherwise the first global unicast
+// address of the local interfaces is used, preferring IPv4, and falling
+// back to localhost if there is none.
+func detectHost(bindHost string) string {
+	if ip := net.ParseIP(bindHost); bindHost != "" && (ip == nil || !ip.IsUnspecified()) {
+		return bindHost
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return "localhost"
+	}
+	var ipv6 string
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok || !ipnet.IP.IsGlobalUnicast() {
+			continue
+		}
+		if ipnet.IP.To4() != nil {
+			return ipnet.IP.String()
+		}
+		if ipv6 == "" {
+			ipv6 = ipnet.IP.String()
+		}
+	}
+	if ipv6 != "" {
+		return ipv6
+	}
+	return "localhost"
+}
+
+// observe records that peer saw one of our connections coming from
+// observed. Loopback addresses say nothing about how remote hosts reach us,
+// so they are ignored.
+func (rpcs *RPCServer) observe(peer string, observed string) {
+	if !rpcs.learn || observed == "" {
+		return
+	}
+	if ip := net.ParseIP(observed); ip == nil || ip.IsLoopback() {
+		return
+	}
+
+	rpcs.addrLock.Lock()
+	defer rpcs.addrLock.Unlock()
+	if rpcs.observations[observed] == nil {
+		rpcs.observations[observed] = make(map[string]bool)
+	}
+	rpcs.observations[observed][peer] = true
+	if len(rpcs.observations[observed]) >= learnThreshold {
+		rpcs.addr.Host = observed
+	}
+}
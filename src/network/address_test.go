@@ -0,0 +1,112 @@
+package network
+
+import (
+	"common"
+	"net"
+	"testing"
+	"time"
+)
+
+// An explicit advertised host is used as is, and a specific bind address is
+// advertised when none is given.
+func TestAdvertisedAddress(t *testing.T) {
+	rpcs, err := NewRPCServerWithConfig(ServerConfig{BindHost: "127.0.0.1", Port: 9979, AdvertiseHost: "203.0.113.7"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rpcs.Close()
+	if a := rpcs.Address(); a.Host != "203.0.113.7" || a.Port != 9979 {
+		t.Error("advertised the wrong address:", a)
+	}
+	if rpcs.timeout != DefaultTimeout {
+		t.Error("server without a timeout did not use the default:", rpcs.timeout)
+	}
+	timed, err := NewRPCServerWithConfig(ServerConfig{BindHost: "127.0.0.1", Port: 9974, Timeout: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer timed.Close()
+	if timed.timeout != time.Minute {
+		t.Error("configured timeout was not used:", timed.timeout)
+	}
+
+	if host := detectHost("127.0.0.1"); host != "127.0.0.1" {
+		t.Error("specific bind address was not advertised:", host)
+	}
+	if host := detectHost(""); host == "" || net.ParseIP(host) != nil && net.ParseIP(host).IsUnspecified() {
+		t.Error("detected an unusable host:", host)
+	}
+}
+
+// A server bound to an IPv6 address can be reached through its Address.
+func TestIPv6(t *testing.T) {
+	rpcs, err := NewRPCServerWithConfig(ServerConfig{BindHost: "::1", Port: 9978})
+	if err != nil {
+		t.Skip("IPv6 loopback is unavailable:", err)
+	}
+	defer rpcs.Close()
+
+	tsh := new(TestStoreHandler)
+	dest := rpcs.Address()
+	if dest.Host != "::1" {
+		t.Fatal("advertised the wrong host:", dest.Host)
+	}
+	dest.ID = rpcs.RegisterHandler(tsh)
+	err = rpcs.SendMessage(&common.Message{
+		Dest: dest,
+		Proc: "TestStoreHandler.StoreMessage",
+		Args: "over ipv6",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tsh.message != "over ipv6" {
+		t.Error("message was not delivered:", tsh.message)
+	}
+}
+
+// The observed host is adopted only once enough distinct peers report it, and
+// loopback observations are ignored.
+func TestLearnAddress(t *testing.T) {
+	rpcs, err := NewRPCServerWithConfig(ServerConfig{BindHost: "127.0.0.1", Port: 9977, LearnAddress: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rpcs.Close()
+
+	// a real handshake reports a loopback address, which is ignored
+	id := rpcs.RegisterHandler(new(TestStoreHandler))
+	err = rpcs.SendMessage(&common.Message{
+		Dest: common.Address{ID: id, Host: "127.0.0.1", Port: 9977},
+		Proc: "TestStoreHandler.StoreMessage",
+		Args: "",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host := rpcs.Address().Host; host != "127.0.0.1" {
+		t.Fatal("learned a loopback address:", host)
+	}
+
+	rpcs.observe("198.51.100.1", "203.0.113.7")
+	rpcs.observe("198.51.100.1", "203.0.113.7")
+	if host := rpcs.Address().Host; host != "127.0.0.1" {
+		t.Fatal("learned an address reported by a single peer:", host)
+	}
+	rpcs.observe("198.51.100.2", "203.0.113.7")
+	if host := rpcs.Address().Host; host != "203.0.113.7" {
+		t.Error("did not learn an address reported by two peers:", host)
+	}
+
+	// an explicit advertised host is never replaced
+	fixed, err := NewRPCServerWithConfig(ServerConfig{Port: 9976, AdvertiseHost: "192.0.2.1", LearnAddress: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fixed.Close()
+	fixed.observe("198.51.100.1", "203.0.113.7")
+	fixed.observe("198.51.100.2", "203.0.113.7")
+	if host := fixed.Address().Host; host != "192.0.2.1" {
+		t.Error("replaced an explicit advertised host:", host)
+	}
+}
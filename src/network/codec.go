@@ -0,0 +1,134 @@
+package network
+
+import (
+	"bufio"
+	"common"
+	"encoding/gob"
+	"io"
+	"net/rpc"
+	"reflect"
+)
+
+// A codec is the gob codec of net/rpc, except that every message body that
+// is a common.VersionedEncoder is encoded at the version negotiated for the
+// connection rather than at common.ProtocolVersion, so that a peer that has
+// not upgraded can still decode it. Bodies are decoded as usual, as every
+// decoder accepts each version it speaks.
+type codec struct {
+	rwc     io.ReadWriteCloser
+	dec     *gob.Decoder
+	enc     *gob.Encoder
+	encBuf  *bufio.Writer
+	version uint16
+	closed  bool
+}
+
+// clientCodec and serverCodec give the codec the method sets of
+// rpc.ClientCodec and rpc.ServerCodec.
+type clientCodec struct{ *codec }
+type serverCodec struct{ *codec }
+
+func newCodec(rwc io.ReadWriteCloser, version uint16) *codec {
+	encBuf := bufio.NewWriter(rwc)
+	return &codec{
+		rwc:     rwc,
+		dec:     gob.NewDecoder(rwc),
+		enc:     gob.NewEncoder(encBuf),
+		encBuf:  encBuf,
+		version: version,
+	}
+}
+
+func newClientCodec(rwc io.ReadWriteCloser, version uint16) rpc.ClientCodec {
+	return clientCodec{newCodec(rwc, version)}
+}
+
+func newServerCodec(rwc io.ReadWriteCloser, version uint16) rpc.ServerCodec {
+	return serverCodec{newCodec(rwc, version)}
+}
+
+// write encodes a header and its body, and flushes them.
+func (c *codec) write(header interface{}, body interface{}) (err error) {
+	err = c.enc.Encode(header)
+	if err != nil {
+		return
+	}
+	err = c.enc.Encode(atVersion(body, c.version))
+	if err != nil {
+		return
+	}
+	return c.encBuf.Flush()
+}
+
+func (c *codec) Close() error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	return c.rwc.Close()
+}
+
+func (c clientCodec) WriteRequest(r *rpc.Request, body interface{}) error {
+	return c.write(r, body)
+}
+
+func (c clientCodec) ReadResponseHeader(r *rpc.Response) error {
+	return c.dec.Decode(r)
+}
+
+func (c clientCodec) ReadResponseBody(body interface{}) error {
+	return c.dec.Decode(body)
+}
+
+func (c serverCodec) ReadRequestHeader(r *rpc.Request) error {
+	return c.dec.Decode(r)
+}
+
+func (c serverCodec) ReadRequestBody(body interface{}) error {
+	return c.dec.Decode(body)
+}
+
+// WriteResponse closes the connection if the response cannot be encoded, as
+// the gob codec of net/rpc does, since the stream can no longer be trusted.
+func (c serverCodec) WriteResponse(r *rpc.Response, body interface{}) (err error) {
+	err = c.write(r, body)
+	if err != nil {
+		c.Close()
+	}
+	return
+}
+
+// A versionedBody gob encodes a message at a chosen version. The receiver
+// decodes it with the GobDecode of its own type, as gob only requires both
+// sides to be gob encoders.
+type versionedBody struct {
+	message common.VersionedEncoder
+	version uint16
+}
+
+func (b versionedBody) GobEncode() ([]byte, error) {
+	return b.message.EncodeVersion(b.version)
+}
+
+// atVersion returns body wrapped to be encoded at version, if body or a
+// pointer to it is a common.VersionedEncoder, and body unchanged otherwise.
+// Bodies passed by value are copied, so that their pointer methods can be
+// called.
+func atVersion(body interface{}, version uint16) interface{} {
+	if message, ok := body.(common.VersionedEncoder); ok {
+		if v := reflect.ValueOf(body); v.Kind() == reflect.Ptr && v.IsNil() {
+			return body
+		}
+		return versionedBody{message, version}
+	}
+	v := reflect.ValueOf(body)
+	if !v.IsValid() {
+		return body
+	}
+	p := reflect.New(v.Type())
+	p.Elem().Set(v)
+	if message, ok := p.Interface().(common.VersionedEncoder); ok {
+		return versionedBody{message, version}
+	}
+	return body
+}
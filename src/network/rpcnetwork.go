@@ -2,50 +2,168 @@ package network
 
 import (
 	"common"
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"net"
 	"net/rpc"
 	"reflect"
 	"strconv"
-	"strings"
+	"sync"
+	"time"
 )
 
+// Every connection begins with a handshake: the client writes the Identifier
+// of the handler it wants to reach followed by its common.Hello, and the
+// server answers with a status byte and its own Hello. If both support
+// common.FeatureObservedAddress, the server then sends a length byte and the
+// host it observed the connection coming from. If the status is routeOK, the
+// rest of the connection is an ordinary net/rpc session with that handler.
+// Each handler is registered on its own rpc.Server under its plain type
+// name, so procedure names never contain the Identifier. Both sides encode
+// every message of the session at the version negotiated in the handshake;
+// see codec.go.
+const (
+	routeOK byte = iota
+	routeUnknownHandler
+	routeIncompatibleVersion
+)
+
+// DefaultTimeout bounds SendMessage and SendAsyncMessage when the
+// ServerConfig gives no Timeout. A message that takes longer than a consensus
+// step to deliver is no longer useful.
+const DefaultTimeout = common.DefaultStepDuration
+
+var errUnknownHandler = errors.New("no handler is registered with that ID")
+var errIncompatiblePeer = errors.New("peer speaks an incompatible protocol version")
+
+// A peerProtocol is what was negotiated with a peer during the handshake.
+type peerProtocol struct {
+	version  uint16
+	features common.Features
+}
+
 // RPCServer is a MessageRouter that communicates using RPC over TCP.
 type RPCServer struct {
-	addr     common.Address
-	rpcServ  *rpc.Server
 	listener net.Listener
-	curID    common.Identifier
+
+	// addr is the address advertised to other hosts. If learning is
+	// enabled, its host is replaced once enough peers agree on the host
+	// they observe our connections coming from.
+	addr         common.Address
+	learn        bool
+	timeout      time.Duration
+	observations map[string]map[string]bool // observed host -> peers that reported it
+	addrLock     sync.RWMutex
+
+	// hello is what we advertise in the handshake
+	hello common.Hello
+
+	// handlers is the routing table from Identifier to the rpc.Server that
+	// serves that handler
+	handlers     map[common.Identifier]*rpc.Server
+	curID        common.Identifier
+	handlersLock sync.RWMutex
+
+	// protocols holds the protocol negotiated with each host:port dialed
+	protocols     map[string]peerProtocol
+	protocolsLock sync.RWMutex
 }
 
 func (rpcs *RPCServer) Address() common.Address {
+	rpcs.addrLock.RLock()
+	defer rpcs.addrLock.RUnlock()
 	return rpcs.addr
 }
 
 // RegisterHandler registers a message handler to the RPC server.
 // The handler is assigned an Identifier, which is returned to the caller.
-// The Identifier is appended to the service name before registration.
+// Messages addressed to that Identifier are routed to the handler, whose
+// methods are named as usual, e.g. "State.HandleJoinSia". IDs are handed out
+// in increasing order; an ID of 0 means every ID is in use.
 func (rpcs *RPCServer) RegisterHandler(handler interface{}) (id common.Identifier) {
-	id = rpcs.curID
-	name := reflect.Indirect(reflect.ValueOf(handler)).Type().Name() + string(id)
-	rpcs.rpcServ.RegisterName(name, handler)
-	rpcs.curID++
+	rpcs.handlersLock.Lock()
+	defer rpcs.handlersLock.Unlock()
+
+	// find the next free ID, skipping 0, which is reserved for the RPCServer
+	for tries := 0; tries < 255; tries++ {
+		candidate := rpcs.curID
+		rpcs.curID++
+		if rpcs.curID == 0 {
+			rpcs.curID = 1
+		}
+		if _, taken := rpcs.handlers[candidate]; !taken {
+			id = candidate
+			break
+		}
+	}
+	if id == 0 {
+		return
+	}
+
+	s := rpc.NewServer()
+	s.Register(handler)
+	rpcs.handlers[id] = s
 	return
 }
 
+// UnregisterHandler removes a handler from the routing table. Messages
+// addressed to its Identifier fail from then on, and the Identifier may be
+// handed out again.
+func (rpcs *RPCServer) UnregisterHandler(id common.Identifier) error {
+	rpcs.handlersLock.Lock()
+	defer rpcs.handlersLock.Unlock()
+	if _, exists := rpcs.handlers[id]; !exists {
+		return errUnknownHandler
+	}
+	delete(rpcs.handlers, id)
+	return nil
+}
+
 // NewRPCServer creates and initializes a server that listens for TCP connections on a specified port.
-// It then spawns a serverHandler with a specified message.
+// It listens on every interface, and advertises an address detected from the
+// local interfaces.
 // It is the callers's responsibility to close the TCP connection, via RPCServer.Close().
 func NewRPCServer(port int) (rpcs *RPCServer, err error) {
-	tcpServ, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+	return NewRPCServerWithConfig(ServerConfig{Port: port})
+}
+
+// NewRPCServerWithConfig creates and initializes a server as described by
+// config, then spawns a serverHandler.
+// It is the callers's responsibility to close the TCP connection, via RPCServer.Close().
+func NewRPCServerWithConfig(config ServerConfig) (rpcs *RPCServer, err error) {
+	hello := common.LocalHello()
+	if config.ProtocolVersion != 0 {
+		if config.ProtocolVersion < common.MinProtocolVersion || config.ProtocolVersion > common.ProtocolVersion {
+			err = fmt.Errorf("Cannot speak protocol version %v, only %v to %v", config.ProtocolVersion, common.MinProtocolVersion, common.ProtocolVersion)
+			return
+		}
+		hello.Version = config.ProtocolVersion
+	}
+	tcpServ, err := net.Listen("tcp", net.JoinHostPort(config.BindHost, strconv.Itoa(config.Port)))
 	if err != nil {
 		return
 	}
 
+	host := config.AdvertiseHost
+	if host == "" {
+		host = detectHost(config.BindHost)
+	}
+	timeout := config.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
 	rpcs = &RPCServer{
-		addr:     common.Address{0, "localhost", port},
-		rpcServ:  rpc.NewServer(),
-		listener: tcpServ,
-		curID:    1, // ID 0 is reserved for the RPCServer itself
+		addr:         common.Address{ID: 0, Host: host, Port: config.Port},
+		learn:        config.LearnAddress && config.AdvertiseHost == "",
+		timeout:      timeout,
+		hello:        hello,
+		observations: make(map[string]map[string]bool),
+		listener:     tcpServ,
+		handlers:     make(map[common.Identifier]*rpc.Server),
+		curID:        1, // ID 0 is reserved for the RPCServer itself
+		protocols:    make(map[string]peerProtocol),
 	}
 
 	go rpcs.serverHandler()
@@ -65,37 +183,207 @@ func (rpcs *RPCServer) serverHandler() {
 		if err != nil {
 			return
 		} else {
-			go func() {
-				rpcs.rpcServ.ServeConn(conn)
-				conn.Close()
-			}()
+			go rpcs.serveConn(conn)
 		}
 	}
 }
 
-// SendRPCMessage (synchronously) delivers a Message to its recipient and returns any errors.
-func (rpcs *RPCServer) SendMessage(m *common.Message) error {
-	conn, err := rpc.Dial("tcp", net.JoinHostPort(m.Dest.Host, strconv.Itoa(m.Dest.Port)))
+// PeerProtocol returns the protocol version and features negotiated with the
+// host at a, at which messages to it are encoded. known is false if a has
+// not been dialed yet.
+func (rpcs *RPCServer) PeerProtocol(a common.Address) (version uint16, features common.Features, known bool) {
+	rpcs.protocolsLock.RLock()
+	defer rpcs.protocolsLock.RUnlock()
+	p, known := rpcs.protocols[net.JoinHostPort(a.Host, strconv.Itoa(a.Port))]
+	return p.version, p.features, known
+}
+
+// serveConn reads the handshake of a connection and hands the connection to
+// the handler it names.
+func (rpcs *RPCServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+	var header [1 + common.HelloSize]byte
+	_, err := io.ReadFull(conn, header[:])
 	if err != nil {
-		return err
+		return
+	}
+	remote, err := common.DecodeHello(header[1:])
+	if err != nil {
+		return
+	}
+
+	rpcs.handlersLock.RLock()
+	s, exists := rpcs.handlers[common.Identifier(header[0])]
+	rpcs.handlersLock.RUnlock()
+	status := routeOK
+	if !exists {
+		status = routeUnknownHandler
 	}
-	// add identifier to service name
-	name := strings.Replace(m.Proc, ".", string(m.Dest.ID)+".", 1)
-	return conn.Call(name, m.Args, m.Resp)
+	version, features, err := common.Negotiate(rpcs.hello, remote)
+	if err != nil {
+		status = routeIncompatibleVersion
+	}
+	reply := append([]byte{status}, rpcs.hello.Bytes()...)
+
+	// tell the client which host its connection came from
+	if features.Has(common.FeatureObservedAddress) {
+		observed, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+		if err != nil || len(observed) > 255 {
+			observed = ""
+		}
+		reply = append(append(reply, byte(len(observed))), observed...)
+	}
+	_, err = conn.Write(reply)
+	if err != nil || status != routeOK {
+		return
+	}
+	s.ServeCodec(newServerCodec(conn, version))
 }
 
-// SendAsyncRPCMessage (asynchronously) delivers a Message to its recipient.
-// It returns a *Call, which contains the fields "Done channel" and "Error error".
+// dial connects to the handler at dest, returning an error if no handler is
+// registered with dest.ID or the host's protocol is incompatible.
+func (rpcs *RPCServer) dial(ctx context.Context, dest common.Address) (client *rpc.Client, err error) {
+	var d net.Dialer
+	hostport := net.JoinHostPort(dest.Host, strconv.Itoa(dest.Port))
+	conn, err := d.DialContext(ctx, "tcp", hostport)
+	if err != nil {
+		return
+	}
+
+	// bound the handshake by the context's deadline; the call itself is
+	// bounded by the caller selecting on ctx.Done()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	version, err := rpcs.handshake(conn, dest, hostport)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	client = rpc.NewClientWithCodec(newClientCodec(conn, version))
+	return
+}
+
+// handshake performs the client side of the handshake on conn, recording the
+// negotiated protocol and the observed address.
+func (rpcs *RPCServer) handshake(conn net.Conn, dest common.Address, hostport string) (version uint16, err error) {
+	_, err = conn.Write(append([]byte{byte(dest.ID)}, rpcs.hello.Bytes()...))
+	if err != nil {
+		return
+	}
+	var reply [1 + common.HelloSize]byte
+	_, err = io.ReadFull(conn, reply[:])
+	if err != nil {
+		return
+	}
+	remote, err := common.DecodeHello(reply[1:])
+	if err != nil {
+		return
+	}
+	version, features, err := common.Negotiate(rpcs.hello, remote)
+	if err != nil || reply[0] == routeIncompatibleVersion {
+		err = fmt.Errorf("%v: %v", dest, errIncompatiblePeer)
+		return
+	}
+	rpcs.protocolsLock.Lock()
+	rpcs.protocols[hostport] = peerProtocol{version, features}
+	rpcs.protocolsLock.Unlock()
+
+	if features.Has(common.FeatureObservedAddress) {
+		var length [1]byte
+		_, err = io.ReadFull(conn, length[:])
+		if err != nil {
+			return
+		}
+		observed := make([]byte, length[0])
+		_, err = io.ReadFull(conn, observed)
+		if err != nil {
+			return
+		}
+		rpcs.observe(dest.Host, string(observed))
+	}
+	if reply[0] != routeOK {
+		err = fmt.Errorf("%v: %v", dest, errUnknownHandler)
+	}
+	return
+}
+
+// SendMessage (synchronously) delivers a Message to its recipient and
+// returns any errors. It gives up after the server's timeout.
+func (rpcs *RPCServer) SendMessage(m *common.Message) error {
+	ctx, cancel := context.WithTimeout(context.Background(), rpcs.timeout)
+	defer cancel()
+	return rpcs.SendMessageContext(ctx, m)
+}
+
+// SendAsyncMessage (asynchronously) delivers a Message to its recipient,
+// giving up after the server's timeout. It returns a *Call, which contains
+// the fields "Done channel" and "Error error".
 func (rpcs *RPCServer) SendAsyncMessage(m *common.Message) *rpc.Call {
-	conn, err := rpc.Dial("tcp", net.JoinHostPort(m.Dest.Host, strconv.Itoa(m.Dest.Port)))
-	d := make(chan *rpc.Call, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), rpcs.timeout)
+	return rpcs.sendAsync(ctx, m, cancel)
+}
+
+// SendMessageContext delivers a Message to its recipient, returning ctx.Err()
+// if ctx is done before the reply arrives.
+func (rpcs *RPCServer) SendMessageContext(ctx context.Context, m *common.Message) error {
+	client, err := rpcs.dial(ctx, m.Dest)
 	if err != nil {
-		// make a dummy *Call
-		errCall := &rpc.Call{"", nil, nil, err, d}
-		errCall.Done <- nil
-		return errCall
-	}
-	// add identifier to service name
-	name := strings.Replace(m.Proc, ".", string(m.Dest.ID)+".", 1)
-	return conn.Go(name, m.Args, m.Resp, d)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	defer client.Close()
+
+	// the reply is decoded into a private value, so that a reply still
+	// arriving after ctx is done cannot write to m.Resp behind the caller
+	reply, private := privateReply(m.Resp)
+	call := client.Go(m.Proc, m.Args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		if call.Error == nil && private {
+			reflect.ValueOf(m.Resp).Elem().Set(reflect.ValueOf(reply).Elem())
+		}
+		return call.Error
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// privateReply returns a new value of the type resp points to. Anything other
+// than a non-nil pointer is returned as is, for net/rpc to handle.
+func privateReply(resp interface{}) (reply interface{}, private bool) {
+	v := reflect.ValueOf(resp)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return resp, false
+	}
+	return reflect.New(v.Type().Elem()).Interface(), true
+}
+
+// SendAsyncMessageContext delivers a Message in the background. The returned
+// Call is sent on its own Done channel once delivery completes, with Error
+// set if delivery failed or ctx was done first.
+func (rpcs *RPCServer) SendAsyncMessageContext(ctx context.Context, m *common.Message) *rpc.Call {
+	return rpcs.sendAsync(ctx, m, nil)
+}
+
+// sendAsync delivers m in the background, calling cancel (if non-nil) once
+// delivery completes.
+func (rpcs *RPCServer) sendAsync(ctx context.Context, m *common.Message, cancel context.CancelFunc) *rpc.Call {
+	call := &rpc.Call{
+		ServiceMethod: m.Proc,
+		Args:          m.Args,
+		Reply:         m.Resp,
+		Done:          make(chan *rpc.Call, 1),
+	}
+	go func() {
+		call.Error = rpcs.SendMessageContext(ctx, m)
+		if cancel != nil {
+			cancel()
+		}
+		call.Done <- call
+	}()
+	return call
 }
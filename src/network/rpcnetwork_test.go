@@ -2,7 +2,11 @@ package network
 
 import (
 	"common"
+	"context"
+	"io"
+	"net"
 	"testing"
+	"time"
 )
 
 // a simple message handler
@@ -60,3 +64,243 @@ func TestRPCSendMessage(t *testing.T) {
 		t.Fatal("Bad response: expected \"hello, world!\", got \"" + tsh.message + "\"")
 	}
 }
+
+// Several handlers of the same type can share a server, messages to an
+// unknown ID fail, and unregistered handlers stop receiving messages.
+func TestRPCRouting(t *testing.T) {
+	rpcs, err := NewRPCServer(9986)
+	if err != nil {
+		t.Fatal("Failed to initialize TCPServer:", err)
+	}
+	defer rpcs.Close()
+
+	tsh1 := new(TestStoreHandler)
+	tsh2 := new(TestStoreHandler)
+	id1 := rpcs.RegisterHandler(tsh1)
+	id2 := rpcs.RegisterHandler(tsh2)
+	if id1 == id2 || id1 == 0 || id2 == 0 {
+		t.Fatal("handlers were given IDs", id1, id2)
+	}
+
+	// each message reaches only its own handler
+	m := &common.Message{
+		Dest: common.Address{ID: id2, Host: "localhost", Port: 9986},
+		Proc: "TestStoreHandler.StoreMessage",
+		Args: "for handler 2",
+	}
+	err = rpcs.SendMessage(m)
+	if err != nil {
+		t.Fatal("Failed to send message:", err)
+	}
+	if tsh2.message != "for handler 2" || tsh1.message != "" {
+		t.Error("message was routed to the wrong handler")
+	}
+
+	// an ID that was never registered
+	m.Dest.ID = id2 + 1
+	if rpcs.SendMessage(m) == nil {
+		t.Error("sent a message to an unregistered ID")
+	}
+	async := rpcs.SendAsyncMessage(m)
+	<-async.Done
+	if async.Error == nil {
+		t.Error("sent an async message to an unregistered ID")
+	}
+
+	// unregistering removes the route
+	err = rpcs.UnregisterHandler(id1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Dest.ID = id1
+	if rpcs.SendMessage(m) == nil {
+		t.Error("sent a message to an unregistered handler")
+	}
+	if rpcs.UnregisterHandler(id1) == nil {
+		t.Error("unregistered the same handler twice")
+	}
+}
+
+// a handler that never replies
+type TestHangHandler struct{}
+
+func (thh *TestHangHandler) Hang(arb struct{}, resp *struct{}) error {
+	select {}
+}
+
+// TestSlowHandler replies after its caller has given up.
+type TestSlowHandler struct{}
+
+func (tsh *TestSlowHandler) Reply(arb struct{}, resp *string) error {
+	time.Sleep(200 * time.Millisecond)
+	*resp = "late"
+	return nil
+}
+
+// A reply that arrives after the send has timed out is not written into the
+// caller's Resp.
+func TestRPCLateReply(t *testing.T) {
+	rpcs, err := NewRPCServer(9973)
+	if err != nil {
+		t.Fatal("Failed to initialize TCPServer:", err)
+	}
+	defer rpcs.Close()
+	id := rpcs.RegisterHandler(new(TestSlowHandler))
+	resp := "unchanged"
+	m := &common.Message{
+		Dest: common.Address{ID: id, Host: "localhost", Port: 9973},
+		Proc: "TestSlowHandler.Reply",
+		Args: struct{}{},
+		Resp: &resp,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if rpcs.SendMessageContext(ctx, m) != context.DeadlineExceeded {
+		t.Fatal("expected the slow call to time out")
+	}
+	time.Sleep(300 * time.Millisecond)
+	if resp != "unchanged" {
+		t.Error("late reply was written into Resp:", resp)
+	}
+
+	// a reply in time is delivered
+	err = rpcs.SendMessage(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp != "late" {
+		t.Error("reply was not delivered:", resp)
+	}
+}
+
+// Sends give up when their context is done, and failed async sends report
+// their error on a non-nil Call.
+func TestRPCTimeouts(t *testing.T) {
+	rpcs, err := NewRPCServer(9984)
+	if err != nil {
+		t.Fatal("Failed to initialize TCPServer:", err)
+	}
+	defer rpcs.Close()
+	id := rpcs.RegisterHandler(new(TestHangHandler))
+	m := &common.Message{
+		Dest: common.Address{ID: id, Host: "localhost", Port: 9984},
+		Proc: "TestHangHandler.Hang",
+		Args: struct{}{},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err = rpcs.SendMessageContext(ctx, m)
+	if err != context.DeadlineExceeded {
+		t.Error("expected a hung call to time out, got", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	call := <-rpcs.SendAsyncMessageContext(ctx, m).Done
+	if call == nil || call.Error != context.DeadlineExceeded {
+		t.Error("expected a hung async call to time out, got", call)
+	}
+
+	// an unreachable peer
+	m.Dest.Port = 9983
+	call = <-rpcs.SendAsyncMessage(m).Done
+	if call == nil || call.Error == nil {
+		t.Error("async send to an unreachable peer did not report an error")
+	}
+}
+
+// SendWithRetry keeps trying until the peer comes up.
+func TestSendWithRetry(t *testing.T) {
+	sender, err := NewRPCServer(9982)
+	if err != nil {
+		t.Fatal("Failed to initialize TCPServer:", err)
+	}
+	defer sender.Close()
+
+	tsh := new(TestStoreHandler)
+	started := make(chan *RPCServer, 1)
+	go func() {
+		time.Sleep(150 * time.Millisecond)
+		rpcs, err := NewRPCServer(9981)
+		if err != nil {
+			started <- nil
+			return
+		}
+		rpcs.RegisterHandler(tsh)
+		started <- rpcs
+	}()
+
+	m := &common.Message{
+		Dest: common.Address{ID: 1, Host: "localhost", Port: 9981},
+		Proc: "TestStoreHandler.StoreMessage",
+		Args: "retried",
+	}
+	policy := common.RetryPolicy{Attempts: 6, Backoff: 50 * time.Millisecond}
+	err = common.SendWithRetry(context.Background(), sender, m, policy)
+	if rpcs := <-started; rpcs != nil {
+		defer rpcs.Close()
+	}
+	if err != nil {
+		t.Fatal("retried send failed:", err)
+	}
+	if tsh.message != "retried" {
+		t.Error("message was not delivered")
+	}
+
+	// remote errors are returned without retrying
+	m.Proc = "TestStoreHandler.Missing"
+	start := time.Now()
+	err = common.SendWithRetry(context.Background(), sender, m, policy)
+	if err == nil {
+		t.Error("call to a missing procedure succeeded")
+	}
+	if time.Since(start) > 50*time.Millisecond {
+		t.Error("remote error was retried")
+	}
+}
+
+// Peers negotiate a protocol during the handshake, and a peer with no
+// version in common is refused.
+func TestVersionHandshake(t *testing.T) {
+	rpcs, err := NewRPCServer(9975)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rpcs.Close()
+	id := rpcs.RegisterHandler(new(TestStoreHandler))
+
+	dest := common.Address{ID: id, Host: "localhost", Port: 9975}
+	if _, _, known := rpcs.PeerProtocol(dest); known {
+		t.Fatal("knew the protocol of a peer before dialing it")
+	}
+	err = rpcs.SendMessage(&common.Message{Dest: dest, Proc: "TestStoreHandler.StoreMessage", Args: ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	version, features, known := rpcs.PeerProtocol(dest)
+	if !known || version != common.ProtocolVersion || features != common.SupportedFeatures {
+		t.Error("recorded the wrong protocol:", version, features, known)
+	}
+
+	// a client that only speaks a future version
+	conn, err := net.Dial("tcp", "localhost:9975")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	future := common.Hello{Version: common.ProtocolVersion + 5, MinVersion: common.ProtocolVersion + 5}
+	_, err = conn.Write(append([]byte{byte(id)}, future.Bytes()...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reply [1 + common.HelloSize]byte
+	_, err = io.ReadFull(conn, reply[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply[0] != routeIncompatibleVersion {
+		t.Error("accepted a client with an incompatible version, status", reply[0])
+	}
+}
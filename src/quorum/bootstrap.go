@@ -3,56 +3,287 @@ package quorum
 import (
 	"common"
 	"common/crypto"
+	"common/encoding"
 	"fmt"
+	"time"
 )
 
-// Announce ourself to the bootstrap address, who will announce us to the quorum
+// A JoinReply is the bootstrap's reply to a join. It carries the step
+// duration of the current block, which the quorum has adjusted since it
+// started and a joiner cannot work out for itself.
+type JoinReply struct {
+	StepDuration time.Duration
+}
+
+// SetBootstrapAddress changes the address that JoinSia announces to. It must
+// be called before any State joins Sia.
+func SetBootstrapAddress(a common.Address) {
+	bootstrapAddress = a
+}
+
+// Announce ourself to the bootstrap address, who records our join in its
+// next heartbeat. We take part once a participant sends us the state of the
+// quorum that gave us a place; see snapshot.go. If the quorum is full, we are
+// first told the departing participant we succeed.
 func (s *State) JoinSia() (err error) {
-	m := &common.Message{
+	// announce the address we are reached at now, which may have been
+	// learned since the State was created; gob can only call
+	// Participant.GobEncode through a pointer
+	s.participantsLock.Lock()
+	s.refreshAddress()
+	self := *s.self
+	s.participantsLock.Unlock()
+	var reply JoinReply
+	err = s.messageRouter.SendMessage(&common.Message{
 		Dest: bootstrapAddress,
 		Proc: "State.HandleJoinSia",
-		Args: *s.self,
-		Resp: nil,
+		Args: &self,
+		Resp: &reply,
+	})
+	if err != nil {
+		return
+	}
+	if reply.StepDuration != 0 {
+		err = s.setStepDuration(reply.StepDuration)
 	}
-	s.messageRouter.SendAsyncMessage(m)
 	return
 }
 
-// Adds a new Participants, and then announces them with their index
-// Currently not safe - Participants need to be added during compile()
-func (s *State) HandleJoinSia(p Participant, arb *struct{}) (err error) {
-	// find index for Participant
+// setStepDuration takes the step duration the bootstrap reports. A duration
+// outside our bounds means the quorum was configured differently, so we
+// cannot take part.
+func (s *State) setStepDuration(d time.Duration) error {
+	s.stepLock.Lock()
+	defer s.stepLock.Unlock()
+	if d < s.minStep || d > s.maxStep {
+		return fmt.Errorf("Cannot join a quorum with a step of %v, outside %v to %v", d, s.minStep, s.maxStep)
+	}
+	s.stepDuration = d
+	return nil
+}
+
+// maxHeartbeatJoins is the most joins a participant may record in one
+// heartbeat; no quorum has places for more.
+const maxHeartbeatJoins = common.MaxQuorumSize
+
+// Records a joining Participant in our next heartbeat. The quorum admits it,
+// appoints it the successor of a departing participant, or has it wait for a
+// place, when that heartbeat is compiled; see admitJoins. A bootstrap that
+// does not take part yet has no heartbeat to record the join in, so it adds
+// the Participant at once and announces it, which is how a new quorum forms.
+func (s *State) HandleJoinSia(p Participant, reply *JoinReply) (err error) {
+	stepDuration := s.StepDuration()
+
+	// count the places a join could take, less those the joins we have
+	// already recorded will
 	s.participantsLock.Lock()
-	i := 0
-	for i = 0; i < common.QuorumSize; i++ {
+	participating := s.participating()
+	places := 0
+	free := s.quorumSize
+	for i := s.quorumSize - 1; i >= 0; i-- {
+		_, departing := s.departures[byte(i)]
 		if s.participants[i] == nil {
-			break
+			places++
+			free = i
+		} else if departing && s.successors[byte(i)] == nil && participating {
+			places++
+		}
+	}
+	if participating {
+		places += s.quorumSize - len(s.waiting) - len(s.pendingJoins)
+		if places > 0 {
+			p.index = 255
+			s.pendingJoins = append(s.pendingJoins, &p)
 		}
 	}
 	s.participantsLock.Unlock()
-	p.index = byte(i)
-	err = s.AddNewParticipant(p, nil)
+
+	// see if the quorum is full
+	if places <= 0 {
+		return fmt.Errorf("failed to add Participant")
+	}
+
+	if !participating {
+		p.index = byte(free)
+		err = s.AddNewParticipant(p, nil)
+		if err != nil {
+			return
+		}
+
+		// now announce a new Participant at index free
+		s.broadcast(&common.Message{
+			Proc: "State.AddNewParticipant",
+			Args: p,
+			Resp: nil,
+		})
+	}
+
+	// the joiner is told the step duration
+	if reply != nil {
+		reply.StepDuration = stepDuration
+	}
+	return
+}
+
+// takePendingJoins returns the joins for our next heartbeat.
+func (s *State) takePendingJoins() (joins []*Participant) {
+	s.participantsLock.Lock()
+	defer s.participantsLock.Unlock()
+	n := len(s.pendingJoins)
+	if n > maxHeartbeatJoins {
+		n = maxHeartbeatJoins
+	}
+	joins = s.pendingJoins[:n]
+	s.pendingJoins = s.pendingJoins[n:]
+	return
+}
+
+// admitJoins adds the participants waiting to join, then those whose joins
+// were recorded in the block, in the order their heartbeats were processed,
+// each to the lowest free place. Once there is none, each is appointed the
+// successor of the departing participant with the lowest index that has
+// none yet; see departure.go. Either way its down payment is locked, and
+// participants that cannot afford it are not admitted. Those that find no
+// place wait for one, up to a quorum of them, so that the places of removed
+// participants are refilled at the compile that removes them. A join
+// recorded by more than one heartbeat admits the participant once. As it
+// decides from the block alone, every participant admits the same joins,
+// whatever order it heard of them in. admitJoins only runs during compile().
+func (s *State) admitJoins(joins []*Participant) (joined []byte, appointed []byte) {
+	candidates := append(s.waiting, joins...)
+	s.waiting = nil
+	for _, p := range candidates {
+		if s.holdsPlace(p) {
+			continue
+		}
+		i := 0
+		for i < s.quorumSize && s.participants[i] != nil {
+			i++
+		}
+		successor := i == s.quorumSize
+		if successor {
+			for i = 0; i < s.quorumSize; i++ {
+				_, departing := s.departures[byte(i)]
+				if departing && s.successors[byte(i)] == nil {
+					break
+				}
+			}
+		}
+		if i == s.quorumSize {
+			if len(s.waiting) < s.quorumSize {
+				s.waiting = append(s.waiting, p)
+			}
+			continue
+		}
+		if s.lockDeposit(p) != nil {
+			continue
+		}
+
+		joiner := *p
+		joiner.index = byte(i)
+		if successor {
+			s.successors[joiner.index] = &joiner
+			s.appoint(&joiner)
+			appointed = append(appointed, joiner.index)
+			continue
+		}
+
+		// the new participant only starts ticking once it is told, so it
+		// gets the default heartbeat for its first block
+		s.participants[i] = &joiner
+		s.heartbeats[i] = make(map[crypto.TruncatedHash]*heartbeat)
+		s.heartbeats[i][emptyHash] = new(heartbeat)
+		s.introduce(&joiner)
+		joined = append(joined, joiner.index)
+	}
+	return
+}
+
+// holdsPlace returns true if the key of p already holds or awaits a place.
+// The caller must hold participantsLock.
+func (s *State) holdsPlace(p *Participant) bool {
+	for _, q := range s.participants {
+		if q != nil && q.publicKey.Compare(p.publicKey) {
+			return true
+		}
+	}
+	for _, q := range s.waiting {
+		if q.publicKey.Compare(p.publicKey) {
+			return true
+		}
+	}
+	for _, q := range s.successors {
+		if q.publicKey.Compare(p.publicKey) {
+			return true
+		}
+	}
+	return false
+}
+
+// introduce has a participant that has just taken its place sent the agreed
+// state at the end of compile(); see snapshot.go. The caller must hold
+// participantsLock.
+func (s *State) introduce(p *Participant) {
+	s.admitted = append(s.admitted, p)
+}
+
+// EncodeTo writes the canonical encoding of the reply:
+//
+//	stepDuration uint32, in ms
+func (r *JoinReply) EncodeTo(e *encoding.Encoder) {
+	e.WriteUint32(uint32(r.StepDuration / time.Millisecond))
+}
+
+// DecodeFrom reads a reply written by EncodeTo.
+func (r *JoinReply) DecodeFrom(d *encoding.Decoder) {
+	r.StepDuration = time.Duration(d.ReadUint32()) * time.Millisecond
+}
+
+func (r *JoinReply) GobEncode() ([]byte, error) {
+	return r.EncodeVersion(common.ProtocolVersion)
+}
+
+func (r *JoinReply) EncodeVersion(version uint16) (gobReply []byte, err error) {
+	if r == nil {
+		err = fmt.Errorf("Cannot encode nil value r")
+		return
+	}
+	var encoded []byte
+	switch version {
+	case 14, 15:
+		encoded, err = encoding.Marshal(r)
+	default:
+		err = fmt.Errorf("Cannot encode a JoinReply at version %v", version)
+	}
 	if err != nil {
 		return
 	}
+	gobReply = common.VersionedEnvelope(version, encoded)
+	return
+}
 
-	// see if the quorum is full
-	if i == common.QuorumSize {
-		return fmt.Errorf("failed to add Participant")
+func (r *JoinReply) GobDecode(gobReply []byte) (err error) {
+	if r == nil {
+		err = fmt.Errorf("Cannot decode into nil JoinReply")
+		return
 	}
 
-	// now announce a new Participant at index i
-	s.broadcast(&common.Message{
-		Proc: "State.AddNewParticipant",
-		Args: p,
-		Resp: nil,
-	})
+	version, body, err := common.OpenEnvelope(gobReply)
+	if err != nil {
+		return
+	}
+	switch version {
+	case 14, 15:
+		err = encoding.Unmarshal(body, r)
+	default:
+		err = fmt.Errorf("Cannot decode a JoinReply of version %v", version)
+	}
 	return
 }
 
 // Add a Participant to the state, tell the Participant about ourselves
 func (s *State) AddNewParticipant(p Participant, arb *struct{}) (err error) {
-	if int(p.index) > len(s.participants) {
+	if int(p.index) >= len(s.participants) {
 		err = fmt.Errorf("Corrupt Input")
 		return
 	}
@@ -63,6 +294,7 @@ func (s *State) AddNewParticipant(p Participant, arb *struct{}) (err error) {
 		return
 	}
 	s.participantsLock.RUnlock()
+
 	// for this Participant, make the heartbeat map and add the default heartbeat
 	hb := new(heartbeat)
 	s.heartbeatsLock.Lock()
@@ -81,6 +313,10 @@ func (s *State) AddNewParticipant(p Participant, arb *struct{}) (err error) {
 		s.tickingLock.Unlock()
 		go s.tick()
 	} else {
+		// the down payments of new participants are taken by admitJoins,
+		// from the block, so a participant we are told about here is never
+		// charged, in whatever order the introductions arrive
+
 		// add the Participant to Participants
 		s.participants[p.index] = &p
 
@@ -93,5 +329,15 @@ func (s *State) AddNewParticipant(p Participant, arb *struct{}) (err error) {
 		})
 	}
 	s.participantsLock.Unlock()
+
+	// when gossiping, not every participant heard the announcement from the
+	// bootstrap, so pass it on
+	if !compare && s.gossiping() {
+		s.broadcast(&common.Message{
+			Proc: "State.AddNewParticipant",
+			Args: p,
+			Resp: nil,
+		})
+	}
 	return
 }
@@ -2,7 +2,9 @@ package quorum
 
 import (
 	"common"
+	"common/crypto"
 	"testing"
+	"time"
 )
 
 // Bootstrap a state to the network, then another
@@ -25,7 +27,7 @@ func TestJoinQuorum(t *testing.T) {
 	if m == nil {
 		t.Fatal("message 0 never received")
 	}
-	s0.HandleJoinSia(m.Args.(Participant), nil)
+	s0.HandleJoinSia(*m.Args.(*Participant), nil)
 
 	// Verify that a broadcast message went out indicating a new participant
 
@@ -55,23 +57,155 @@ func TestJoinQuorum(t *testing.T) {
 	}
 	s1.JoinSia()
 
-	// Verify message for correctness
-
-	// Deliver message to bootstrap
+	// Deliver message to bootstrap, which records the join in its next
+	// heartbeat rather than adding the joiner
 	m = z.RecentMessage(2)
-	s0.HandleJoinSia(m.Args.(Participant), nil)
+	s0.HandleJoinSia(*m.Args.(*Participant), nil)
+	if s0.participants[1] != nil {
+		t.Fatal("joiner was added before the join was compiled")
+	}
+	compileJoins(s0)
+	if s0.participants[1] == nil || !s0.participants[1].compare(s1.self) {
+		t.Fatal("joiner was not admitted at the compile")
+	}
+	if b := s0.LastBlock(); len(b.Joined) != 1 || b.Joined[0] != 1 {
+		t.Error("admission was not recorded:", b.Joined)
+	}
 
-	// Deliver the broadcasted messages
-	m = z.RecentMessage(3)
-	s0.AddNewParticipant(m.Args.(Participant), nil)
-	m = z.RecentMessage(4)
-	s1.AddNewParticipant(m.Args.(Participant), nil)
+	// Deliver the snapshot of the quorum, which gives the joiner its place
+	m = sentMessage(z, "State.HandleSnapshot")
+	if m == nil || m.Dest != s1.self.address {
+		t.Fatal("joiner was not sent a snapshot")
+	}
+	err = s1.HandleSnapshot(m.Args.(Snapshot), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	// Verify the messages made it
+	// Verify the snapshot made it
 	s1.tickingLock.Lock()
 	if !s1.ticking {
 		t.Error("s1 did not start ticking")
 	}
+	s1.tickingLock.Unlock()
+	if s1.participants[0] == nil || !s1.participants[0].compare(s0.self) {
+		t.Error("s1 does not know the bootstrap")
+	}
+	if s1.self.index != 1 || s1.participants[1] != s1.self || s1.height != s0.height {
+		t.Error("s1 did not take the place and height of the snapshot")
+	}
+}
+
+// compileJoins gives every participant a single heartbeat, recording the
+// joins announced to s in its own, then compiles, holding the stepLock as
+// tick() does.
+func compileJoins(s *State) {
+	for i, p := range s.participants {
+		if p == nil {
+			continue
+		}
+		hb := goldenHeartbeat()
+		if p == s.self {
+			hb.joins = s.takePendingJoins()
+		}
+		s.heartbeats[i] = map[crypto.TruncatedHash]*heartbeat{{byte(i)}: hb}
+	}
+	s.stepLock.Lock()
+	s.compile()
+	s.stepLock.Unlock()
+}
+
+// Joiners wait for a place while the quorum is full, and are turned away
+// once a quorum of them is waiting.
+func TestJoinFullQuorum(t *testing.T) {
+	_, secKey, err := crypto.CreateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := CreateStateWithConfig(common.NewZeroNetwork(), secKey, sizedConfig(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fillQuorum(s)
 
-	// both swarms should be aware of each other... maybe test their ongoing interactions?
+	var joiners []*State
+	for i := 0; i < 3; i++ {
+		joiner, err := CreateState(common.NewZeroNetwork())
+		if err != nil {
+			t.Fatal(err)
+		}
+		joiners = append(joiners, joiner)
+	}
+	for _, joiner := range joiners[:2] {
+		err = s.HandleJoinSia(*joiner.self, nil)
+		if err != nil {
+			t.Fatal("joiner was turned away before the waiting list was full:", err)
+		}
+	}
+	if s.HandleJoinSia(*joiners[2].self, nil) == nil {
+		t.Error("accepted more joiners than can wait")
+	}
+	compileJoins(s)
+	if len(s.waiting) != 2 || !s.waiting[0].compare(joiners[0].self) || !s.waiting[1].compare(joiners[1].self) {
+		t.Fatal("joiners are not waiting in order:", s.waiting)
+	}
+	if s.HandleJoinSia(*joiners[2].self, nil) == nil {
+		t.Error("accepted a joiner while the waiting list was full")
+	}
+}
+
+// A joiner takes the step duration the quorum has adjusted to, which is
+// carried in the reply to its join.
+func TestJoinReply(t *testing.T) {
+	s, err := CreateState(common.NewZeroNetwork())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.stepDuration = s.minStep + 250*time.Millisecond
+	joiner, err := CreateState(common.NewZeroNetwork())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reply JoinReply
+	err = s.HandleJoinSia(*joiner.self, &reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.StepDuration != s.stepDuration {
+		t.Fatal("wrong reply to a join:", reply)
+	}
+	err = joiner.setStepDuration(reply.StepDuration)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if joiner.StepDuration() != s.stepDuration {
+		t.Error("joiner did not take the step duration:", joiner.StepDuration())
+	}
+	if joiner.setStepDuration(joiner.maxStep+time.Millisecond) == nil {
+		t.Error("took a step duration outside the configured bounds")
+	}
+
+	gobReply, err := reply.GobEncode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded JoinReply
+	err = decoded.GobDecode(gobReply)
+	if err != nil || decoded != reply {
+		t.Error("reply changed in encoding:", decoded, err)
+	}
+
+	// the previous version has the same layout
+	encoded, err := reply.EncodeVersion(common.MinProtocolVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var old JoinReply
+	err = old.GobDecode(encoded)
+	if err != nil || old != reply {
+		t.Error("reply of the previous version was decoded wrong:", old, err)
+	}
+	if _, err = reply.EncodeVersion(common.MinProtocolVersion - 1); err == nil {
+		t.Error("encoded a reply at an unsupported version")
+	}
 }
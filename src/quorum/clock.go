@@ -0,0 +1,126 @@
+package quorum
+
+import (
+	"sort"
+	"time"
+)
+
+// Participants keep a quorum clock: their local clock plus an estimated
+// offset. Every heartbeat carries the quorum time at which it was created,
+// which is the start of the sender's block.
+//
+// When a heartbeat arrives directly from its creator, the difference between
+// its timestamp and our quorum time is a sample of how far the creator's
+// clock is ahead of ours. At compile the offset is moved by the fault
+// tolerant midpoint of the samples, so the clocks of the honest participants
+// converge, and up to a third of the participants cannot pull them apart.
+// The network delay makes every sample read behind by the time the heartbeat
+// spent in transit. Left alone, this would set every clock back by about one
+// delay each block, so that the quorum clock falls ever further behind real
+// time. The delay is estimated as half the median latency reported in the
+// block's heartbeats, which every participant compiles alike, and added back
+// to the samples.
+//
+// The clock alone does not line up the steps, because each participant
+// started ticking whenever it joined. The heartbeats compiled in a block are
+// the same for every participant, so the fault tolerant midpoint of their
+// timestamps is an agreed start for the block. At compile, each participant
+// moves the end of its block toward the agreed start plus the length of the
+// block, by at most half a step, so that a single faulty block cannot throw
+// the schedule off.
+
+// faultTolerantMidpoint discards the f lowest and f highest of the values,
+// where f is the number of faulty values that can be tolerated among them,
+// and returns the midpoint of the rest. values must not be empty.
+func faultTolerantMidpoint(values []int64) int64 {
+	sorted := append([]int64{}, values...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	f := (len(sorted) - 1) / 3
+	low, high := sorted[f], sorted[len(sorted)-1-f]
+	return low + (high-low)/2
+}
+
+// toMillis converts a time into whole milliseconds since the epoch, the
+// precision of heartbeat timestamps.
+func toMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// quorumTime returns the current time on the quorum clock.
+func (s *State) quorumTime() time.Time {
+	s.clockLock.Lock()
+	defer s.clockLock.Unlock()
+	return time.Now().Add(s.clockOffset)
+}
+
+// recordClockSample notes the timestamp of a heartbeat that arrived directly
+// from participant at arrival, local time.
+func (s *State) recordClockSample(participant byte, timestamp int64, arrival time.Time) {
+	s.clockLock.Lock()
+	defer s.clockLock.Unlock()
+	s.clockSamples[participant] = timestamp - toMillis(arrival.Add(s.clockOffset))
+}
+
+// delayEstimate returns the estimated network delay of a heartbeat, given
+// the latencies reported in a block: half the median report.
+func delayEstimate(reports []uint32) time.Duration {
+	if len(reports) == 0 {
+		return 0
+	}
+	return time.Duration(medianLatency(reports)) * time.Millisecond / 2
+}
+
+// updateClock moves the clock offset by the midpoint of the samples taken
+// this block, corrected for the network delay, then discards them.
+func (s *State) updateClock(delay time.Duration) {
+	s.clockLock.Lock()
+	defer s.clockLock.Unlock()
+	if len(s.clockSamples) > 0 {
+		var samples []int64
+		for _, sample := range s.clockSamples {
+			samples = append(samples, sample)
+		}
+		s.clockOffset += time.Duration(faultTolerantMidpoint(samples))*time.Millisecond + delay
+	}
+	s.clockSamples = make(map[byte]int64)
+}
+
+// alignBlock moves the end of the current block toward the agreed start of
+// the block plus its length, given the timestamps of the block's heartbeats.
+// The caller must hold stepLock, and stepDuration must still be the duration
+// used during the block.
+func (s *State) alignBlock(timestamps []int64) {
+	if len(timestamps) == 0 || s.stepDeadline.IsZero() {
+		return
+	}
+	blockLength := time.Duration(s.quorumSize) * s.stepDuration
+	agreedEnd := time.Unix(0, faultTolerantMidpoint(timestamps)*int64(time.Millisecond)).Add(blockLength)
+	correction := agreedEnd.Sub(s.stepDeadline)
+	if correction > s.stepDuration/2 {
+		correction = s.stepDuration / 2
+	}
+	if correction < -s.stepDuration/2 {
+		correction = -s.stepDuration / 2
+	}
+	s.stepDeadline = s.stepDeadline.Add(correction)
+}
+
+// ClockOffset returns how far the quorum clock is estimated to be ahead of
+// the local clock.
+func (s *State) ClockOffset() time.Duration {
+	s.clockLock.Lock()
+	defer s.clockLock.Unlock()
+	return s.clockOffset
+}
+
+// StepDeadline returns the local time at which the current step ends, or the
+// zero time if the State is not ticking.
+func (s *State) StepDeadline() time.Time {
+	s.stepLock.RLock()
+	deadline := s.stepDeadline
+	s.stepLock.RUnlock()
+	if deadline.IsZero() {
+		return deadline
+	}
+	return deadline.Add(-s.ClockOffset())
+}
@@ -0,0 +1,141 @@
+package quorum
+
+import (
+	"common"
+	"testing"
+	"time"
+)
+
+func TestFaultTolerantMidpoint(t *testing.T) {
+	cases := []struct {
+		values   []int64
+		midpoint int64
+	}{
+		{[]int64{5}, 5},
+		{[]int64{0, 10}, 5},
+		{[]int64{20, 1000, 0, 10}, 15},
+		{[]int64{-1000, 0, 10, 20}, 5},
+		{[]int64{1, 2, 3, 4, 5, 6, 7}, 4},
+	}
+	for _, c := range cases {
+		if m := faultTolerantMidpoint(c.values); m != c.midpoint {
+			t.Errorf("midpoint of %v was %v, expected %v", c.values, m, c.midpoint)
+		}
+	}
+}
+
+// The honest participants agree on the quorum clock after a single block,
+// however far off a faulty participant's timestamps are.
+func TestClockSync(t *testing.T) {
+	ms := time.Millisecond
+	offsets := []time.Duration{0, 40 * ms, -70 * ms, time.Hour}
+	states := make([]*State, len(offsets))
+	for i := range states {
+		s, err := CreateState(common.NewZeroNetwork())
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.clockOffset = offsets[i]
+		states[i] = s
+	}
+
+	// every heartbeat is created and received at the same local instant
+	now := time.Unix(1e9, 0)
+	for _, receiver := range states {
+		for i, sender := range states {
+			receiver.recordClockSample(byte(i), toMillis(now.Add(sender.clockOffset)), now)
+		}
+	}
+	for _, s := range states {
+		s.updateClock(0)
+		if len(s.clockSamples) != 0 {
+			t.Error("clock samples were not discarded")
+		}
+	}
+
+	for i := 1; i < 3; i++ {
+		if states[i].ClockOffset() != states[0].ClockOffset() {
+			t.Error("honest clocks disagree:", states[i].ClockOffset(), states[0].ClockOffset())
+		}
+	}
+	if o := states[0].ClockOffset(); o < -70*ms || o > 40*ms {
+		t.Error("faulty clock pulled the quorum clock to", o)
+	}
+
+	// with no samples, the offset does not change
+	offset := states[0].ClockOffset()
+	states[0].updateClock(0)
+	if states[0].ClockOffset() != offset {
+		t.Error("offset changed without samples")
+	}
+}
+
+// Heartbeats that spend time in transit do not set the clock back, block
+// after block.
+func TestClockDelay(t *testing.T) {
+	s, err := CreateState(common.NewZeroNetwork())
+	if err != nil {
+		t.Fatal(err)
+	}
+	delay := 30 * time.Millisecond
+	if d := delayEstimate([]uint32{70, 60, 1 << 30}); d != 35*time.Millisecond {
+		t.Error("estimated a delay of", d)
+	}
+	if d := delayEstimate(nil); d != 0 {
+		t.Error("estimated a delay without reports:", d)
+	}
+
+	// every clock agrees, each heartbeat takes delay to arrive, and the
+	// slowest arrivals, which are the latencies reported, take twice as long
+	now := time.Unix(1e9, 0)
+	for block := 0; block < 10; block++ {
+		for i := 0; i < 3; i++ {
+			s.recordClockSample(byte(i), toMillis(now.Add(s.clockOffset)), now.Add(delay))
+		}
+		s.updateClock(delayEstimate([]uint32{60, 60, 60}))
+	}
+	if o := s.ClockOffset(); o != 0 {
+		t.Error("clock drifted by", o)
+	}
+}
+
+// The end of a block moves toward the agreed end, by at most half a step.
+func TestAlignBlock(t *testing.T) {
+	s, err := CreateState(common.NewZeroNetwork())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.stepDuration = 100 * time.Millisecond
+	blockLength := time.Duration(s.quorumSize) * s.stepDuration
+
+	// not ticking yet
+	s.alignBlock([]int64{0})
+	if !s.stepDeadline.IsZero() || !s.StepDeadline().IsZero() {
+		t.Fatal("aligned a state that is not ticking")
+	}
+
+	deadline := time.Unix(1e9, 0)
+	start := toMillis(deadline.Add(-blockLength))
+	s.stepDeadline = deadline
+	s.alignBlock(nil)
+	if s.stepDeadline != deadline {
+		t.Error("block moved without timestamps")
+	}
+
+	s.alignBlock([]int64{start + 20, start + 30, start + 40})
+	if s.stepDeadline != deadline.Add(30*time.Millisecond) {
+		t.Error("block was not aligned:", s.stepDeadline.Sub(deadline))
+	}
+
+	s.stepDeadline = deadline
+	s.alignBlock([]int64{start - 500})
+	if s.stepDeadline != deadline.Add(-50*time.Millisecond) {
+		t.Error("block moved more than half a step:", s.stepDeadline.Sub(deadline))
+	}
+
+	// the deadline is reported in local time
+	s.clockOffset = time.Second
+	if s.StepDeadline() != s.stepDeadline.Add(-time.Second) {
+		t.Error("step deadline was not converted to local time")
+	}
+}
@@ -1,11 +1,10 @@
 package quorum
 
 import (
-	"bytes"
 	"common"
 	"common/crypto"
+	"common/encoding"
 	"common/log"
-	"encoding/gob"
 	"errors"
 	"fmt"
 	"time"
@@ -13,7 +12,14 @@ import (
 
 // All information that needs to be passed between participants each block
 type heartbeat struct {
-	entropy common.Entropy
+	entropy      common.Entropy       // revealed; committed to in the previous heartbeat
+	commitment   crypto.TruncatedHash // to the entropy revealed in the next; see reveal.go
+	latency      uint32               // ms; see timing.go
+	timestamp    int64                // ms on the quorum clock; see clock.go
+	transactions []*Transaction
+	updates      []*SectorUpdate
+	leave        *LeaveQuorum   // if the participant is leaving; see departure.go
+	joins        []*Participant // announced to the participant; see bootstrap.go
 }
 
 // Contains a heartbeat that has been signed iteratively, is a key part of the
@@ -26,37 +32,143 @@ type SignedHeartbeat struct {
 }
 
 // Using the current State, newHeartbeat() creates a heartbeat that fulfills all
-// of the requirements of the quorum.
-func (s *State) newHeartbeat() (hb *heartbeat, err error) {
+// of the requirements of the quorum. latency is the latency we measured over
+// the previous block.
+func (s *State) newHeartbeat(latency uint32) (hb *heartbeat, err error) {
 	hb = new(heartbeat)
+	hb.latency = latency
+	hb.timestamp = toMillis(s.quorumTime())
 
-	// Generate Entropy
-	entropy, err := crypto.RandomByteSlice(common.EntropyVolume)
+	// Reveal our last entropy and commit to the next
+	hb.entropy, hb.commitment, err = s.nextReveal()
 	if err != nil {
 		return
 	}
-	copy(hb.entropy[:], entropy)
+
+	hb.transactions = s.takePendingTransactions()
+	hb.updates = s.takePendingUpdates()
+
+	hb.leave, err = s.leaveAnnouncement()
+	if err != nil {
+		return
+	}
+	hb.joins = s.takePendingJoins()
 
 	// more code will be added here
 
 	return
 }
 
-// Convert heartbeat to []byte
-func (hb *heartbeat) GobEncode() (gobHeartbeat []byte, err error) {
+// EncodeTo writes the canonical encoding of the heartbeat, which is what its
+// hash and signatures cover:
+//
+//	entropy      [EntropyVolume]byte
+//	commitment   [TruncatedHashSize]byte
+//	latency      uint32
+//	timestamp    int64
+//	transactions []Transaction
+//	updates      []SectorUpdate
+//	leave        optional LeaveQuorum, preceded by a bool
+//	joins        []Participant
+func (hb *heartbeat) EncodeTo(e *encoding.Encoder) {
 	// if hb == nil, encode a zero heartbeat
 	if hb == nil {
 		hb = new(heartbeat)
 	}
+	e.WriteFixed(hb.entropy[:])
+	e.WriteFixed(hb.commitment[:])
+	e.WriteUint32(hb.latency)
+	e.WriteInt64(hb.timestamp)
+	e.WriteLength(len(hb.transactions))
+	for _, t := range hb.transactions {
+		t.EncodeTo(e)
+	}
+	e.WriteLength(len(hb.updates))
+	for _, u := range hb.updates {
+		u.EncodeTo(e)
+	}
+	e.WriteBool(hb.leave != nil)
+	if hb.leave != nil {
+		hb.leave.EncodeTo(e)
+	}
+	e.WriteLength(len(hb.joins))
+	for _, p := range hb.joins {
+		p.EncodeTo(e)
+	}
+}
+
+// DecodeFrom reads a heartbeat written by EncodeTo.
+func (hb *heartbeat) DecodeFrom(d *encoding.Decoder) {
+	d.ReadFixed(hb.entropy[:])
+	d.ReadFixed(hb.commitment[:])
+	hb.latency = d.ReadUint32()
+	hb.timestamp = d.ReadInt64()
+	n := d.ReadLength()
+	if n > maxHeartbeatTransactions {
+		d.Fail(fmt.Errorf("heartbeat has %v transactions, more than the maximum of %v", n, maxHeartbeatTransactions))
+		return
+	}
+	hb.transactions = nil
+	for i := 0; i < n && d.Err() == nil; i++ {
+		t := new(Transaction)
+		t.DecodeFrom(d)
+		hb.transactions = append(hb.transactions, t)
+	}
+	n = d.ReadLength()
+	if n > maxHeartbeatUpdates {
+		d.Fail(fmt.Errorf("heartbeat has %v sector updates, more than the maximum of %v", n, maxHeartbeatUpdates))
+		return
+	}
+	hb.updates = nil
+	for i := 0; i < n && d.Err() == nil; i++ {
+		u := new(SectorUpdate)
+		u.DecodeFrom(d)
+		hb.updates = append(hb.updates, u)
+	}
+	hb.leave = nil
+	if d.ReadBool() {
+		hb.leave = new(LeaveQuorum)
+		hb.leave.DecodeFrom(d)
+	}
+	n = d.ReadLength()
+	if n > maxHeartbeatJoins {
+		d.Fail(fmt.Errorf("heartbeat has %v joins, more than the maximum of %v", n, maxHeartbeatJoins))
+		return
+	}
+	hb.joins = nil
+	for i := 0; i < n && d.Err() == nil; i++ {
+		p := new(Participant)
+		p.DecodeFrom(d)
+		hb.joins = append(hb.joins, p)
+	}
+}
 
-	w := new(bytes.Buffer)
-	encoder := gob.NewEncoder(w)
-	err = encoder.Encode(hb.entropy)
+// hash returns the hash of the canonical encoding of the heartbeat.
+func (hb *heartbeat) hash() (hash crypto.TruncatedHash, err error) {
+	encoded, err := encoding.Marshal(hb)
 	if err != nil {
 		return
 	}
+	return crypto.CalculateTruncatedHash(encoded)
+}
+
+// Convert heartbeat to []byte
+func (hb *heartbeat) GobEncode() ([]byte, error) {
+	return hb.EncodeVersion(common.ProtocolVersion)
+}
 
-	gobHeartbeat = w.Bytes()
+func (hb *heartbeat) EncodeVersion(version uint16) (gobHeartbeat []byte, err error) {
+	var encoded []byte
+	switch version {
+	case 14, 15:
+		encoded, err = encoding.Marshal(hb)
+	default:
+		err = fmt.Errorf("Cannot encode a heartbeat at version %v", version)
+	}
+	if err != nil {
+		return
+	}
+	gobHeartbeat = common.VersionedEnvelope(version, encoded)
 	return
 }
 
@@ -67,9 +179,16 @@ func (hb *heartbeat) GobDecode(gobHeartbeat []byte) (err error) {
 		hb = new(heartbeat)
 	}
 
-	r := bytes.NewBuffer(gobHeartbeat)
-	decoder := gob.NewDecoder(r)
-	err = decoder.Decode(&hb.entropy)
+	version, body, err := common.OpenEnvelope(gobHeartbeat)
+	if err != nil {
+		return
+	}
+	switch version {
+	case 14, 15:
+		err = encoding.Unmarshal(body, hb)
+	default:
+		err = fmt.Errorf("Cannot decode a heartbeat of version %v", version)
+	}
 	return
 }
 
@@ -80,11 +199,7 @@ func (s *State) signHeartbeat(hb *heartbeat) (sh *SignedHeartbeat, err error) {
 
 	// confirm heartbeat and hash
 	sh.heartbeat = hb
-	gobHb, err := hb.GobEncode()
-	if err != nil {
-		return
-	}
-	sh.heartbeatHash, err = crypto.CalculateTruncatedHash(gobHb)
+	sh.heartbeatHash, err = hb.hash()
 	if err != nil {
 		return
 	}
@@ -126,25 +241,33 @@ var hsherrInvalidSignature = errors.New("Received heartbeat with invalid signatu
 //
 // What sort of input error checking is needed for this function?
 func (s *State) HandleSignedHeartbeat(sh SignedHeartbeat, arb *struct{}) error {
+	arrival := time.Now()
+
 	// Check that the slices of signatures and signatories are of the same length
 	if len(sh.signatures) != len(sh.signatories) {
 		return hsherrMismatchedSignatures
 	}
 
 	// check that there are not too many signatures and signatories
-	if len(sh.signatories) > common.QuorumSize {
+	if len(sh.signatories) > s.quorumSize {
 		return hsherrOversigned
 	}
 
-	s.stepLock.Lock() // prevents a benign race condition; is here to follow best practices
+	s.stepLock.RLock()
 	currentStep := s.currentStep
-	s.stepLock.Unlock()
+	stepDuration := s.stepDuration
+	compiled := s.compiled
+	s.stepLock.RUnlock()
 	// s.CurrentStep must be less than or equal to len(sh.Signatories), unless
-	// there is a new block and s.CurrentStep is common.QuorumSize
+	// there is a new block and s.CurrentStep is s.quorumSize
 	if currentStep > len(sh.signatories) {
-		if currentStep == common.QuorumSize && len(sh.signatories) == 1 {
-			// by waiting common.StepDuration, the new block will be compiled
-			time.Sleep(common.StepDuration)
+		if currentStep == s.quorumSize && len(sh.signatories) == 1 {
+			// the sender has already compiled the new block; wait until we
+			// have too, which happens within a step
+			select {
+			case <-compiled:
+			case <-time.After(stepDuration):
+			}
 			// now continue to rest of function
 		} else {
 			return hsherrNoSync
@@ -152,7 +275,7 @@ func (s *State) HandleSignedHeartbeat(sh SignedHeartbeat, arb *struct{}) error {
 	}
 
 	// Check bounds on first signatory
-	if int(sh.signatories[0]) >= common.QuorumSize {
+	if int(sh.signatories[0]) >= s.quorumSize {
 		return hsherrBounds
 	}
 
@@ -184,7 +307,7 @@ func (s *State) HandleSignedHeartbeat(sh SignedHeartbeat, arb *struct{}) error {
 	previousSignatories := make(map[byte]bool) // which signatories have already signed
 	for i, signatory := range sh.signatories {
 		// Check bounds on the signatory
-		if int(signatory) >= common.QuorumSize {
+		if int(signatory) >= s.quorumSize {
 			return hsherrBounds
 		}
 
@@ -219,11 +342,26 @@ func (s *State) HandleSignedHeartbeat(sh SignedHeartbeat, arb *struct{}) error {
 		}
 	}
 
+	// the same message arrives once over each gossip path
+	key, err := sh.seenKey()
+	if err != nil {
+		return err
+	}
+	if !s.markSeen(key) {
+		return hsherrHaveHeartbeat
+	}
+
 	// Add heartbeat to list of seen heartbeats
 	s.heartbeats[sh.signatories[0]][sh.heartbeatHash] = sh.heartbeat
 
+	// a heartbeat with a single signature was sent at the start of the block
+	if len(sh.signatories) == 1 {
+		s.recordLatency()
+		s.recordClockSample(sh.signatories[0], sh.heartbeat.timestamp, arrival)
+	}
+
 	// Sign the stack of signatures and send it to all hosts
-	signedMessage, err := s.secretKey.Sign(signedMessage.Message)
+	signedMessage, err = s.secretKey.Sign(signedMessage.Message)
 	if err != nil {
 		log.Fatalln(err)
 	}
@@ -242,33 +380,59 @@ func (s *State) HandleSignedHeartbeat(sh SignedHeartbeat, arb *struct{}) error {
 	return nil
 }
 
-func (sh *SignedHeartbeat) GobEncode() (gobSignedHeartbeat []byte, err error) {
+// EncodeTo writes the canonical encoding of the SignedHeartbeat:
+//
+//	heartbeat     heartbeat
+//	heartbeatHash [TruncatedHashSize]byte
+//	signatories   []byte
+//	signatures    []crypto.Signature
+func (sh *SignedHeartbeat) EncodeTo(e *encoding.Encoder) {
+	sh.heartbeat.EncodeTo(e)
+	e.WriteFixed(sh.heartbeatHash[:])
+	e.WriteBytes(sh.signatories)
+	e.WriteLength(len(sh.signatures))
+	for i := range sh.signatures {
+		sh.signatures[i].EncodeTo(e)
+	}
+}
+
+// DecodeFrom reads a SignedHeartbeat written by EncodeTo.
+func (sh *SignedHeartbeat) DecodeFrom(d *encoding.Decoder) {
+	sh.heartbeat = new(heartbeat)
+	sh.heartbeat.DecodeFrom(d)
+	d.ReadFixed(sh.heartbeatHash[:])
+	sh.signatories = d.ReadBytes()
+	n := d.ReadLength()
+	sh.signatures = nil
+	for i := 0; i < n && d.Err() == nil; i++ {
+		var sig crypto.Signature
+		sig.DecodeFrom(d)
+		sh.signatures = append(sh.signatures, sig)
+	}
+}
+
+func (sh *SignedHeartbeat) GobEncode() ([]byte, error) {
+	return sh.EncodeVersion(common.ProtocolVersion)
+}
+
+func (sh *SignedHeartbeat) EncodeVersion(version uint16) (gobSignedHeartbeat []byte, err error) {
 	// error check the input
 	if sh == nil {
 		err = fmt.Errorf("Cannot encode a nil object")
 		return
 	}
 
-	w := new(bytes.Buffer)
-	encoder := gob.NewEncoder(w)
-	err = encoder.Encode(sh.heartbeat)
-	if err != nil {
-		return
-	}
-	err = encoder.Encode(sh.heartbeatHash)
-	if err != nil {
-		return
-	}
-	err = encoder.Encode(sh.signatories)
-	if err != nil {
-		return
+	var encoded []byte
+	switch version {
+	case 14, 15:
+		encoded, err = encoding.Marshal(sh)
+	default:
+		err = fmt.Errorf("Cannot encode a SignedHeartbeat at version %v", version)
 	}
-	err = encoder.Encode(sh.signatures)
 	if err != nil {
 		return
 	}
-
-	gobSignedHeartbeat = w.Bytes()
+	gobSignedHeartbeat = common.VersionedEnvelope(version, encoded)
 	return
 }
 
@@ -278,47 +442,33 @@ func (shb *SignedHeartbeat) GobDecode(gobSignedHeartbeat []byte) (err error) {
 		return
 	}
 
-	r := bytes.NewBuffer(gobSignedHeartbeat)
-	decoder := gob.NewDecoder(r)
-	err = decoder.Decode(&shb.heartbeat)
+	version, body, err := common.OpenEnvelope(gobSignedHeartbeat)
 	if err != nil {
 		return
 	}
-	err = decoder.Decode(&shb.heartbeatHash)
-	if err != nil {
-		return
+	switch version {
+	case 14, 15:
+		err = encoding.Unmarshal(body, shb)
+	default:
+		err = fmt.Errorf("Cannot decode a SignedHeartbeat of version %v", version)
 	}
-	err = decoder.Decode(&shb.signatories)
-	if err != nil {
-		return
-	}
-	err = decoder.Decode(&shb.signatures)
-	if err != nil {
-		return
-	}
-
 	return
 }
 
 // participants are processed in a random order each block, determined by the
 // entropy for the block. participantOrdering() deterministically picks that
 // order, using entropy from the state.
-func (s *State) participantOrdering() (participantOrdering [common.QuorumSize]byte) {
+func (s *State) participantOrdering() (participantOrdering []byte) {
 	// create an in-order list of participants
+	participantOrdering = make([]byte, s.quorumSize)
 	for i := range participantOrdering {
 		participantOrdering[i] = byte(i)
 	}
 
 	// shuffle the list of participants
-	for i := range participantOrdering {
-		newIndex, err := s.randInt(i, common.QuorumSize)
-		if err != nil {
-			log.Fatalln(err)
-		}
-		tmp := participantOrdering[newIndex]
-		participantOrdering[newIndex] = participantOrdering[i]
-		participantOrdering[i] = tmp
-	}
+	s.random.Shuffle(len(participantOrdering), func(i, j int) {
+		participantOrdering[i], participantOrdering[j] = participantOrdering[j], participantOrdering[i]
+	})
 
 	return
 }
@@ -328,8 +478,24 @@ func (s *State) tossParticipant(pi byte) {
 	// remove from s.Participants
 	s.participants[pi] = nil
 
-	// nil map in s.Heartbeats
+	// nil map in s.Heartbeats, and forget the commitment
 	s.heartbeats[pi] = nil
+	delete(s.commitments, pi)
+
+	// a successor takes the place of the participant, even one that is
+	// tossed before its hand-off is over
+	delete(s.departures, pi)
+	successor := s.successors[pi]
+	if successor != nil {
+		delete(s.successors, pi)
+		s.participants[pi] = successor
+
+		// the successor only starts ticking once it is told, so it gets
+		// the default heartbeat for its first block, as in admitJoins
+		s.heartbeats[pi] = make(map[crypto.TruncatedHash]*heartbeat)
+		s.heartbeats[pi][emptyHash] = new(heartbeat)
+		s.introduce(successor)
+	}
 }
 
 // Update the state according to the information presented in the heartbeat
@@ -338,54 +504,149 @@ func (s *State) processHeartbeat(hb *heartbeat, i byte) (err error) {
 	print("Confirming Participant ")
 	println(i)
 
-	// Add the entropy to UpcomingEntropy
-	th, err := crypto.CalculateTruncatedHash(append(s.upcomingEntropy[:], hb.entropy[:]...))
-	s.upcomingEntropy = common.Entropy(th)
+	// Apply the transactions in order; invalid transactions and double
+	// spends are ignored
+	for _, t := range hb.transactions {
+		s.applyTransaction(t)
+	}
+
+	// Then the sector updates, which are ignored if not authorized
+	for _, u := range hb.updates {
+		s.applySectorUpdate(u)
+	}
 
 	return
 }
 
 // compile() takes the list of heartbeats and uses them to advance the state.
-func (s *State) compile() {
+// It returns false, having changed nothing, if the external seed for the
+// block is not available yet; see entropy.go.
+func (s *State) compile() (compiled bool) {
+	// without the external seed we would fork from the quorum, so fetch it
+	// before anything changes
+	seed, err := s.externalSeed(s.height + 1)
+	if err != nil {
+		log.Warning("cannot compile yet: ", err)
+		return
+	}
+
 	// fetch a participant ordering
 	participantOrdering := s.participantOrdering()
 
 	// Lock down s.participants and s.heartbeats for editing
 	s.participantsLock.Lock()
 	s.heartbeatsLock.Lock()
+	s.height++
+	block := Block{Height: s.height}
+	participating := s.participating()
+	members := append([]*Participant(nil), s.participants...)
 
 	// Read heartbeats, process them, then archive them.
+	var latencies []uint32
+	var timestamps []int64
+	var joins []*Participant
+	inactive := 0
 	for _, participant := range participantOrdering {
 		if s.participants[participant] == nil {
 			continue
 		}
 
-		// each participant must submit exactly 1 heartbeat
+		// each participant must submit exactly 1 heartbeat, or lose its
+		// down payment
 		if len(s.heartbeats[participant]) != 1 {
+			if len(s.heartbeats[participant]) == 0 {
+				inactive++
+			}
+			s.forfeitDeposit(participant)
 			s.tossParticipant(participant)
+			block.Tossed = append(block.Tossed, participant)
 			continue
 		}
 
 		// this is the only way I know to access the only element of a map;
 		// the key is unknown
-		for _, hb := range s.heartbeats[participant] {
-			s.processHeartbeat(hb, participant)
+		var hb *heartbeat
+		for _, only := range s.heartbeats[participant] {
+			hb = only
 		}
 
+		// a participant that does not reveal the entropy it committed to
+		// loses its down payment too; see reveal.go
+		if s.acceptReveal(participant, hb) != nil {
+			s.forfeitDeposit(participant)
+			s.tossParticipant(participant)
+			block.Tossed = append(block.Tossed, participant)
+			continue
+		}
+
+		s.processHeartbeat(hb, participant)
+		latencies = append(latencies, hb.latency)
+		timestamps = append(timestamps, hb.timestamp)
+		if hb.leave != nil {
+			s.acceptDeparture(participant, hb.leave)
+		}
+		joins = append(joins, hb.joins...)
+
 		// archive heartbeats (unimplemented)
 
 		// clear heartbeat list for next block
 		s.heartbeats[participant] = make(map[crypto.TruncatedHash]*heartbeat)
 	}
 
+	// evict participants at random for those that were inactive; see
+	// integrity.go. Then remove participants whose hand-off is over, admit
+	// the participants whose joins were recorded, pay the hosts of every
+	// sector, and return the down payments of participants that left long
+	// enough ago
+	block.Evicted = s.evictRandom(evictionsPerInactive*inactive, members)
+	block.Departed = s.removeDeparted()
+	block.Joined, block.Appointed = s.admitJoins(joins)
+	s.recordBlock(block)
+	s.paySectors()
+	s.releaseRefunds()
+
+	// once we have been removed, we no longer take part
+	left := participating && s.participants[s.self.index] != s.self
+	if left {
+		s.self.index = 255
+	}
+
 	s.participantsLock.Unlock()
 	s.heartbeatsLock.Unlock()
+	s.forgetSeen()
+	s.releaseSegments()
+
+	// move UpcomingEntropy to CurrentEntropy, mixing in the external seed
+	entropy, err := mixEntropy(s.upcomingEntropy, seed)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	s.currentEntropy = entropy
+	s.random = common.NewRandomStream(s.currentEntropy)
+
+	// line the block up with the rest of the quorum, then adjust the step
+	// duration to the latencies reported in this block, and wake anyone
+	// waiting for the block to be compiled
+	s.alignBlock(timestamps)
+	s.updateClock(delayEstimate(latencies))
+	s.stepDuration = adjustStepDuration(s.stepDuration, latencies, s.minStep, s.maxStep)
+	close(s.compiled)
+	s.compiled = make(chan struct{})
 
-	// move UpcomingEntropy to CurrentEntropy
-	s.currentEntropy = s.upcomingEntropy
+	// send the participants that took their place the state they join in
+	s.sendSnapshots()
+
+	// once we have been removed, we stop ticking
+	if left {
+		s.tickingLock.Lock()
+		s.ticking = false
+		s.leaving = false
+		s.tickingLock.Unlock()
+		return true
+	}
 
 	// generate, sign, and announce new heartbeat
-	hb, err := s.newHeartbeat()
+	hb, err := s.newHeartbeat(s.startBlock())
 	if err != nil {
 		log.Fatalln(err)
 	}
@@ -397,22 +658,43 @@ func (s *State) compile() {
 	if err != nil {
 		log.Fatalln(err)
 	}
+	return true
 }
 
 // Tick() updates s.CurrentStep, and calls compile() when all steps are complete
 func (s *State) tick() {
-	// Every common.StepDuration, advance the state stage
-	ticker := time.Tick(common.StepDuration)
-	for _ = range ticker {
+	// Every step duration, advance the state stage. Steps end at deadlines
+	// on the quorum clock, which compile() can move to line up with the rest
+	// of the quorum, so they are not timed by a fixed ticker.
+	s.stepLock.Lock()
+	s.stepDeadline = s.quorumTime().Add(s.stepDuration)
+	s.stepLock.Unlock()
+	for {
+		time.Sleep(time.Until(s.StepDeadline()))
+
 		s.stepLock.Lock()
-		if s.currentStep == common.QuorumSize {
+		if s.currentStep == s.quorumSize {
+			// a block that cannot be compiled yet is tried again at the
+			// next deadline
 			println("compiling")
-			s.compile()
-			s.currentStep = 1
+			if s.compile() {
+				s.currentStep = 1
+			}
 		} else {
 			println("stepping")
 			s.currentStep += 1
 		}
+		s.stepDeadline = s.stepDeadline.Add(s.stepDuration)
 		s.stepLock.Unlock()
+
+		// compile() stops us ticking once we have left the quorum
+		if s.currentStep == 1 {
+			s.tickingLock.Lock()
+			ticking := s.ticking
+			s.tickingLock.Unlock()
+			if !ticking {
+				return
+			}
+		}
 	}
 }
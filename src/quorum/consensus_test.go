@@ -3,6 +3,11 @@ package quorum
 import (
 	"common"
 	"common/crypto"
+	"common/encoding"
+	"encoding/hex"
+	"math/big"
+	"network"
+	"strings"
 	"testing"
 	"time"
 )
@@ -38,6 +43,16 @@ func TestHeartbeatEncoding(t *testing.T) {
 		t.Error("able to decode a nil byte slice")
 	}
 
+	// a heartbeat from a newer protocol version is rejected
+	_, body, err := common.OpenEnvelope(mhb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = uhb.GobDecode(common.VersionedEnvelope(common.ProtocolVersion+1, body))
+	if err == nil {
+		t.Error("able to decode a heartbeat from a newer version")
+	}
+
 	// fuzz over random potential values of heartbeat
 }
 
@@ -63,7 +78,7 @@ func TestSignedHeartbeatEncoding(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	hb, err := s.newHeartbeat()
+	hb, err := s.newHeartbeat(0)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -119,15 +134,11 @@ func TestHandleSignedHeartbeat(t *testing.T) {
 
 	// create SignedHeartbeat
 	var sh SignedHeartbeat
-	sh.heartbeat, err = s.newHeartbeat()
+	sh.heartbeat, err = s.newHeartbeat(0)
 	if err != nil {
 		t.Fatal(err)
 	}
-	esh, err := sh.heartbeat.GobEncode()
-	if err != nil {
-		t.Fatal(err)
-	}
-	sh.heartbeatHash, err = crypto.CalculateTruncatedHash(esh)
+	sh.heartbeatHash, err = sh.heartbeat.hash()
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -171,15 +182,11 @@ func TestHandleSignedHeartbeat(t *testing.T) {
 	}
 
 	// create a different heartbeat, this will be used to test the fail conditions
-	sh.heartbeat, err = s.newHeartbeat()
-	if err != nil {
-		t.Fatal(err)
-	}
-	ehb, err := sh.heartbeat.GobEncode()
+	sh.heartbeat, err = s.newHeartbeat(0)
 	if err != nil {
 		t.Fatal(err)
 	}
-	sh.heartbeatHash, err = crypto.CalculateTruncatedHash(ehb)
+	sh.heartbeatHash, err = sh.heartbeat.hash()
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -244,7 +251,7 @@ func TestHandleSignedHeartbeat(t *testing.T) {
 
 	// send a heartbeat right at the edge of a new block
 	s.stepLock.Lock()
-	s.currentStep = common.QuorumSize
+	s.currentStep = s.quorumSize
 	s.stepLock.Unlock()
 
 	// submit heartbeat in separate thread
@@ -260,7 +267,7 @@ func TestHandleSignedHeartbeat(t *testing.T) {
 	s.currentStep = 1
 	s.stepLock.Unlock()
 	time.Sleep(time.Second)
-	time.Sleep(common.StepDuration)
+	time.Sleep(s.StepDuration())
 }
 
 func TestTossParticipant(t *testing.T) {
@@ -282,7 +289,7 @@ func TestProcessHeartbeat(t *testing.T) {
 	s1.AddNewParticipant(*s0.self, nil)
 
 	// check that a valid heartbeat passes
-	hb0, err := s0.newHeartbeat()
+	hb0, err := s0.newHeartbeat(0)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -299,7 +306,7 @@ func TestCompile(t *testing.T) {
 
 // Ensures that Tick() updates CurrentStep
 func TestRegularTick(t *testing.T) {
-	// test takes common.StepDuration seconds; skip for short testing
+	// test takes a step; skip for short testing
 	if testing.Short() {
 		t.Skip()
 	}
@@ -314,7 +321,7 @@ func TestRegularTick(t *testing.T) {
 	s.currentStep = 1
 	s.stepLock.Unlock()
 	go s.tick()
-	time.Sleep(common.StepDuration)
+	time.Sleep(s.StepDuration())
 	time.Sleep(time.Second)
 	s.stepLock.Lock()
 	if s.currentStep != 2 {
@@ -325,7 +332,7 @@ func TestRegularTick(t *testing.T) {
 
 // ensures Tick() calles compile() and then resets the counter to step 1
 func TestCompilationTick(t *testing.T) {
-	// test takes common.StepDuration seconds; skip for short testing
+	// test takes a step; skip for short testing
 	if testing.Short() {
 		t.Skip()
 	}
@@ -335,11 +342,11 @@ func TestCompilationTick(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	s.currentStep = common.QuorumSize
+	s.currentStep = s.quorumSize
 	go s.tick()
 
 	// verify that tick is wrapping around properly
-	time.Sleep(common.StepDuration)
+	time.Sleep(s.StepDuration())
 	time.Sleep(time.Second)
 	s.stepLock.Lock()
 	if s.currentStep != 1 {
@@ -347,3 +354,200 @@ func TestCompilationTick(t *testing.T) {
 	}
 	s.stepLock.Unlock()
 }
+
+// golden values shared by the encoding tests
+func goldenHeartbeat() *heartbeat {
+	hb := new(heartbeat)
+	for i := range hb.entropy {
+		hb.entropy[i] = byte(i)
+	}
+	// commit to the same entropy again, so that golden heartbeats in
+	// consecutive blocks reveal what they committed to
+	hb.commitment, _ = commitTo(hb.entropy)
+	hb.latency = 0x01020304
+	hb.timestamp = 0x0102030405060708
+	return hb
+}
+
+const goldenHeartbeatHex = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f" + "3d94eea49c580aef816935762be049559d6d1440dede12e6a125f1841fff8e6f" + "01020304" + "0102030405060708" + "00000000" + "00000000" + "00" + "00000000"
+
+// The canonical encoding and hash of a heartbeat never change, so every node
+// computes the same hash for it.
+func TestGoldenHeartbeat(t *testing.T) {
+	hb := goldenHeartbeat()
+	encoded, err := encoding.Marshal(hb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(encoded) != goldenHeartbeatHex {
+		t.Fatalf("heartbeat encoding changed: %x", encoded)
+	}
+	hash, err := hb.hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(hash[:]) != "8e97f24372f2144ca26f44d3839902a3eb3490a9b3f9797a367b42370423de65" {
+		t.Errorf("heartbeat hash changed: %x", hash)
+	}
+
+	// joins are encoded in full
+	hb.joins = []*Participant{{index: 255}}
+	hb.joins[0].publicKey, _, err = crypto.CreateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := new(heartbeat)
+	gobHeartbeat, err := hb.GobEncode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = decoded.GobDecode(gobHeartbeat)
+	if err != nil || len(decoded.joins) != 1 || !decoded.joins[0].publicKey.Compare(hb.joins[0].publicKey) {
+		t.Error("joins changed in encoding:", err)
+	}
+}
+
+func TestGoldenSignedHeartbeat(t *testing.T) {
+	sh := &SignedHeartbeat{
+		heartbeat:   goldenHeartbeat(),
+		signatories: []byte{2},
+		signatures:  []crypto.Signature{{R: big.NewInt(1), S: big.NewInt(2)}},
+	}
+	for i := range sh.heartbeatHash {
+		sh.heartbeatHash[i] = 0xff
+	}
+	encoded, err := encoding.Marshal(sh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	golden := goldenHeartbeatHex + strings.Repeat("ff", 32) + "0000000102" + "00000001" +
+		strings.Repeat("00", 65) + "01" + strings.Repeat("00", 65) + "02"
+	if hex.EncodeToString(encoded) != golden {
+		t.Fatalf("signed heartbeat encoding changed: %x", encoded)
+	}
+
+	decoded := new(SignedHeartbeat)
+	err = encoding.Unmarshal(encoded, decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.heartbeat.entropy != sh.heartbeat.entropy || decoded.heartbeat.latency != sh.heartbeat.latency ||
+		decoded.heartbeat.timestamp != sh.heartbeat.timestamp || decoded.heartbeatHash != sh.heartbeatHash ||
+		len(decoded.signatories) != 1 || decoded.signatories[0] != 2 ||
+		len(decoded.signatures) != 1 || decoded.signatures[0].S.Int64() != 2 {
+		t.Error("signed heartbeat changed in encoding")
+	}
+}
+
+// An EnvelopeProbe records the version of each message sent to it.
+type EnvelopeProbe struct {
+	versions chan uint16
+}
+
+// A RawEnvelope keeps a message as it was received.
+type RawEnvelope []byte
+
+func (r *RawEnvelope) GobDecode(b []byte) error {
+	*r = append(RawEnvelope(nil), b...)
+	return nil
+}
+
+func (ep *EnvelopeProbe) Record(raw RawEnvelope, arb *struct{}) error {
+	version, _, err := common.OpenEnvelope(raw)
+	if err != nil {
+		return err
+	}
+	ep.versions <- version
+	return nil
+}
+
+// A participant that has upgraded and one that has not exchange heartbeats
+// in both directions, each message encoded at the older version.
+func TestMixedVersionHeartbeats(t *testing.T) {
+	oldRouter, err := network.NewRPCServerWithConfig(network.ServerConfig{Port: 9950, ProtocolVersion: common.MinProtocolVersion})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer oldRouter.Close()
+	newRouter, err := network.NewRPCServer(9951)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer newRouter.Close()
+
+	// both hold the two places of the quorum
+	var states []*State
+	for _, router := range []*network.RPCServer{oldRouter, newRouter} {
+		_, secKey, err := crypto.CreateKeyPair()
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := CreateStateWithConfig(router, secKey, sizedConfig(2))
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.self.index = byte(len(states))
+		states = append(states, s)
+	}
+	for _, s := range states {
+		for i, p := range states {
+			copied := *p.self
+			s.participants[i] = &copied
+			s.heartbeats[i] = make(map[crypto.TruncatedHash]*heartbeat)
+		}
+		s.participants[s.self.index] = s.self
+	}
+
+	for i, s := range states {
+		other := states[1-i]
+		hb, err := s.newHeartbeat(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sh, err := s.signHeartbeat(hb)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.messageRouter.SendMessage(&common.Message{
+			Dest: other.self.address,
+			Proc: "State.HandleSignedHeartbeat",
+			Args: *sh,
+		})
+		if err != nil {
+			t.Fatal("participant", i, "could not send its heartbeat:", err)
+		}
+		other.heartbeatsLock.Lock()
+		_, received := other.heartbeats[i][sh.heartbeatHash]
+		other.heartbeatsLock.Unlock()
+		if !received {
+			t.Error("heartbeat of participant", i, "was not accepted")
+		}
+	}
+
+	// the heartbeats were sent at the older version, and a message between
+	// upgraded participants at the newer one
+	probe := &EnvelopeProbe{versions: make(chan uint16, 1)}
+	oldProbe := oldRouter.Address()
+	oldProbe.ID = oldRouter.RegisterHandler(probe)
+	newProbe := newRouter.Address()
+	newProbe.ID = newRouter.RegisterHandler(probe)
+	hb, _ := states[1].newHeartbeat(0)
+	sh, _ := states[1].signHeartbeat(hb)
+	for _, c := range []struct {
+		from    *network.RPCServer
+		to      common.Address
+		version uint16
+	}{
+		{newRouter, oldProbe, common.MinProtocolVersion},
+		{oldRouter, newProbe, common.MinProtocolVersion},
+		{newRouter, newProbe, common.ProtocolVersion},
+	} {
+		err = c.from.SendMessage(&common.Message{Dest: c.to, Proc: "EnvelopeProbe.Record", Args: sh})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version := <-probe.versions; version != c.version {
+			t.Error("message to", c.to, "was encoded at version", version, "expected", c.version)
+		}
+	}
+}
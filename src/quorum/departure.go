@@ -0,0 +1,450 @@
+package quorum
+
+import (
+	"common"
+	"common/crypto"
+	"common/encoding"
+	"common/log"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// A participant leaves the quorum gracefully by putting a LeaveQuorum in its
+// heartbeat. Once the announcement is compiled, the participant is
+// departing: it keeps taking part for HandOffBlocks more blocks, during which
+// a new participant may join as its successor and be handed its segments. At
+// the end of the hand-off the participant is removed without being fined, its
+// down payment is refunded after the cooldown, and its successor, if it has
+// one, takes its place.
+//
+// A join recorded while the quorum has no free place makes the joiner the
+// successor of a departing participant. The compile of the join appoints it,
+// so that every participant agrees on the successor, and takes its down
+// payment; see admitJoins. The participants then tell the successor whose
+// place it takes, and it asks its predecessor for the segments it must
+// store, in a HandOffRequest signed with its key. Until it takes its place,
+// the successor only accepts those segments; the HandOff set on it fetches
+// them from the predecessor.
+type LeaveQuorum struct {
+	Index     byte // of the departing participant
+	Signature crypto.Signature
+}
+
+var lqerrWrongIndex = errors.New("LeaveQuorum is for another participant")
+var lqerrInvalidSignature = errors.New("LeaveQuorum has an invalid signature")
+var lqerrDeparting = errors.New("LeaveQuorum is from a participant that is already departing")
+var hoerrNotSuccessor = errors.New("Participant is not our successor")
+var hoerrInvalidSignature = errors.New("HandOffRequest has an invalid signature")
+var hoerrParticipating = errors.New("Cannot succeed a participant while participating")
+
+// A HandOffRequest asks a departing participant for the segments it hands
+// off. It is signed by the successor, as anybody can claim the public
+// details of a Participant.
+type HandOffRequest struct {
+	Index     byte // of the departing participant
+	Signature crypto.Signature
+}
+
+// A HandOffList names the segments a departing participant hands off to its
+// successor: Segments[i] is its segment of Sectors[i].
+type HandOffList struct {
+	Sectors  []crypto.Hash
+	Segments []crypto.Hash
+}
+
+// A HandOff is told, on a successor, where its predecessor is and which
+// segments to fetch from it.
+type HandOff func(predecessor common.Address, list HandOffList)
+
+// SetHandOff sets the function called when we learn which segments to fetch
+// from our predecessor.
+func (s *State) SetHandOff(handOff HandOff) {
+	s.walletsLock.Lock()
+	s.handOff = handOff
+	s.walletsLock.Unlock()
+}
+
+// NewLeaveQuorum creates an announcement, signed with secKey, that the
+// participant at index is leaving.
+func NewLeaveQuorum(secKey crypto.SecretKey, index byte) (lq *LeaveQuorum, err error) {
+	lq = &LeaveQuorum{Index: index}
+	e := new(encoding.Encoder)
+	lq.encodeBody(e)
+	signedMessage, err := secKey.Sign(e.Bytes())
+	if err != nil {
+		return
+	}
+	lq.Signature = signedMessage.Signature
+	return
+}
+
+// verify checks that the announcement was signed by pubKey.
+func (lq *LeaveQuorum) verify(pubKey *crypto.PublicKey) error {
+	e := new(encoding.Encoder)
+	lq.encodeBody(e)
+	if pubKey == nil || !pubKey.Verify(&crypto.SignedMessage{Signature: lq.Signature, Message: e.Bytes()}) {
+		return lqerrInvalidSignature
+	}
+	return nil
+}
+
+// EncodeTo writes the canonical encoding of the announcement:
+//
+//	index     byte
+//	signature crypto.Signature
+func (lq *LeaveQuorum) EncodeTo(e *encoding.Encoder) {
+	lq.encodeBody(e)
+	lq.Signature.EncodeTo(e)
+}
+
+func (lq *LeaveQuorum) encodeBody(e *encoding.Encoder) {
+	e.WriteUint8(lq.Index)
+}
+
+// DecodeFrom reads an announcement written by EncodeTo.
+func (lq *LeaveQuorum) DecodeFrom(d *encoding.Decoder) {
+	lq.Index = d.ReadUint8()
+	lq.Signature.DecodeFrom(d)
+}
+
+// LeaveSia announces in our next heartbeat that we are leaving the quorum.
+// We keep taking part until the hand-off is over, then stop, and our down
+// payment is refunded after the cooldown.
+func (s *State) LeaveSia() (err error) {
+	s.tickingLock.Lock()
+	defer s.tickingLock.Unlock()
+	if !s.ticking {
+		return fmt.Errorf("Cannot leave a quorum we have not joined")
+	}
+	s.leaving = true
+	return
+}
+
+// leaveAnnouncement returns the LeaveQuorum for our next heartbeat, or nil if
+// we are not leaving or the quorum already knows.
+func (s *State) leaveAnnouncement() (lq *LeaveQuorum, err error) {
+	s.tickingLock.Lock()
+	leaving := s.leaving
+	s.tickingLock.Unlock()
+	if !leaving {
+		return
+	}
+
+	s.participantsLock.RLock()
+	index := s.self.index
+	_, departing := s.departures[index]
+	s.participantsLock.RUnlock()
+	if departing {
+		return
+	}
+	return NewLeaveQuorum(s.secretKey, index)
+}
+
+// acceptDeparture starts the hand-off of a participant that announced it is
+// leaving. acceptDeparture only runs during compile().
+func (s *State) acceptDeparture(pi byte, lq *LeaveQuorum) (err error) {
+	if lq.Index != pi {
+		return lqerrWrongIndex
+	}
+	if _, departing := s.departures[pi]; departing {
+		return lqerrDeparting
+	}
+	err = lq.verify(s.participants[pi].publicKey)
+	if err != nil {
+		return
+	}
+	s.departures[pi] = s.handOffBlocks
+	return
+}
+
+// removeDeparted counts down the hand-off of every departing participant,
+// and removes and returns those whose hand-off is over, in order of index.
+// removeDeparted only runs during compile().
+func (s *State) removeDeparted() (departed []byte) {
+	for i := range s.participants {
+		pi := byte(i)
+		remaining, departing := s.departures[pi]
+		if !departing {
+			continue
+		}
+		if remaining > 0 {
+			s.departures[pi] = remaining - 1
+			continue
+		}
+
+		s.refundDeposit(pi)
+		s.tossParticipant(pi)
+		departed = append(departed, pi)
+	}
+	return
+}
+
+// appoint tells a successor that the quorum has appointed it, and whose
+// place it takes. The caller must hold participantsLock.
+func (s *State) appoint(successor *Participant) {
+	if !s.participating() {
+		return
+	}
+	predecessor := s.participants[successor.index]
+	s.messageRouter.SendAsyncMessage(&common.Message{
+		Dest: successor.address,
+		Proc: "State.HandleSuccession",
+		Args: *predecessor,
+		Resp: nil,
+	})
+}
+
+// HandleSuccession is told by each participant that the quorum has made us
+// the successor of predecessor. We act on the first.
+func (s *State) HandleSuccession(predecessor Participant, arb *struct{}) error {
+	return s.succeed(predecessor)
+}
+
+// succeed makes us the successor of a departing participant. We take its
+// index, and ask it for its segments.
+func (s *State) succeed(predecessor Participant) (err error) {
+	if int(predecessor.index) >= s.quorumSize {
+		return fmt.Errorf("Corrupt Input")
+	}
+	s.tickingLock.Lock()
+	ticking := s.ticking
+	s.tickingLock.Unlock()
+	s.participantsLock.Lock()
+	if ticking || s.self.index != 255 {
+		s.participantsLock.Unlock()
+		return hoerrParticipating
+	}
+	s.self.index = predecessor.index
+	s.participantsLock.Unlock()
+	go s.requestHandOff(predecessor)
+	return
+}
+
+// requestHandOff asks our predecessor for the segments we must store, which
+// it may do until its hand-off is over, then passes them to the HandOff.
+func (s *State) requestHandOff(predecessor Participant) {
+	timeout := time.Duration(s.handOffBlocks) * time.Duration(s.quorumSize) * s.StepDuration()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	request, err := NewHandOffRequest(s.secretKey, predecessor.index)
+	if err != nil {
+		log.Warning("cannot sign hand-off request: ", err)
+		return
+	}
+	var list HandOffList
+	err = common.SendWithRetry(ctx, s.messageRouter, &common.Message{
+		Dest: predecessor.address,
+		Proc: "State.HandleHandOffRequest",
+		Args: *request,
+		Resp: &list,
+	}, common.DefaultRetry)
+	if err != nil {
+		log.Warning("hand-off from predecessor failed: ", err)
+		return
+	}
+	if len(list.Sectors) != len(list.Segments) {
+		log.Warning("predecessor sent a corrupt hand-off list")
+		return
+	}
+
+	s.walletsLock.Lock()
+	for i := range list.Sectors {
+		s.handedOff[list.Sectors[i]] = list.Segments[i]
+	}
+	handOff := s.handOff
+	s.walletsLock.Unlock()
+	if handOff != nil {
+		handOff(predecessor.address, list)
+	}
+}
+
+// HandleHandOffRequest gives our successor the list of our segments.
+func (s *State) HandleHandOffRequest(request HandOffRequest, list *HandOffList) (err error) {
+	s.participantsLock.RLock()
+	index := s.self.index
+	successor := s.successors[index]
+	s.participantsLock.RUnlock()
+	if request.Index != index || successor == nil {
+		return hoerrNotSuccessor
+	}
+	err = request.verify(successor.publicKey)
+	if err != nil {
+		return
+	}
+
+	*list = HandOffList{}
+	s.walletsLock.RLock()
+	defer s.walletsLock.RUnlock()
+	for hash, sector := range s.sectors {
+		if int(index) < len(sector.segments) && sector.segments[index] != (crypto.Hash{}) {
+			list.Sectors = append(list.Sectors, hash)
+			list.Segments = append(list.Segments, sector.segments[index])
+		}
+	}
+	return
+}
+
+// NewHandOffRequest creates a request, signed with secKey, for the segments
+// of the departing participant at index.
+func NewHandOffRequest(secKey crypto.SecretKey, index byte) (r *HandOffRequest, err error) {
+	r = &HandOffRequest{Index: index}
+	e := new(encoding.Encoder)
+	r.encodeBody(e)
+	signedMessage, err := secKey.Sign(e.Bytes())
+	if err != nil {
+		return
+	}
+	r.Signature = signedMessage.Signature
+	return
+}
+
+// verify checks that the request was signed by pubKey.
+func (r *HandOffRequest) verify(pubKey *crypto.PublicKey) error {
+	e := new(encoding.Encoder)
+	r.encodeBody(e)
+	if pubKey == nil || !pubKey.Verify(&crypto.SignedMessage{Signature: r.Signature, Message: e.Bytes()}) {
+		return hoerrInvalidSignature
+	}
+	return nil
+}
+
+// EncodeTo writes the canonical encoding of the request:
+//
+//	index     byte
+//	signature crypto.Signature
+func (r *HandOffRequest) EncodeTo(e *encoding.Encoder) {
+	e.WriteUint8(r.Index)
+	r.Signature.EncodeTo(e)
+}
+
+// encodeBody writes what the signature covers, which is tagged so that it
+// cannot pass for a LeaveQuorum.
+func (r *HandOffRequest) encodeBody(e *encoding.Encoder) {
+	e.WriteString("hand-off")
+	e.WriteUint8(r.Index)
+}
+
+// DecodeFrom reads a request written by EncodeTo.
+func (r *HandOffRequest) DecodeFrom(d *encoding.Decoder) {
+	r.Index = d.ReadUint8()
+	r.Signature.DecodeFrom(d)
+}
+
+func (r *HandOffRequest) GobEncode() ([]byte, error) {
+	return r.EncodeVersion(common.ProtocolVersion)
+}
+
+func (r *HandOffRequest) EncodeVersion(version uint16) (gobRequest []byte, err error) {
+	if r == nil {
+		err = fmt.Errorf("Cannot encode nil value r")
+		return
+	}
+	var encoded []byte
+	switch version {
+	case 14, 15:
+		encoded, err = encoding.Marshal(r)
+	default:
+		err = fmt.Errorf("Cannot encode a HandOffRequest at version %v", version)
+	}
+	if err != nil {
+		return
+	}
+	gobRequest = common.VersionedEnvelope(version, encoded)
+	return
+}
+
+func (r *HandOffRequest) GobDecode(gobRequest []byte) (err error) {
+	if r == nil {
+		err = fmt.Errorf("Cannot decode into nil HandOffRequest")
+		return
+	}
+
+	version, body, err := common.OpenEnvelope(gobRequest)
+	if err != nil {
+		return
+	}
+	switch version {
+	case 14, 15:
+		err = encoding.Unmarshal(body, r)
+	default:
+		err = fmt.Errorf("Cannot decode a HandOffRequest of version %v", version)
+	}
+	return
+}
+
+// EncodeTo writes the canonical encoding of the list:
+//
+//	sectors  [][HashSize]byte
+//	segments [][HashSize]byte
+func (l *HandOffList) EncodeTo(e *encoding.Encoder) {
+	e.WriteLength(len(l.Sectors))
+	for i := range l.Sectors {
+		e.WriteFixed(l.Sectors[i][:])
+	}
+	e.WriteLength(len(l.Segments))
+	for i := range l.Segments {
+		e.WriteFixed(l.Segments[i][:])
+	}
+}
+
+// DecodeFrom reads a list written by EncodeTo.
+func (l *HandOffList) DecodeFrom(d *encoding.Decoder) {
+	n := d.ReadLength()
+	l.Sectors = nil
+	for i := 0; i < n && d.Err() == nil; i++ {
+		var hash crypto.Hash
+		d.ReadFixed(hash[:])
+		l.Sectors = append(l.Sectors, hash)
+	}
+	n = d.ReadLength()
+	l.Segments = nil
+	for i := 0; i < n && d.Err() == nil; i++ {
+		var hash crypto.Hash
+		d.ReadFixed(hash[:])
+		l.Segments = append(l.Segments, hash)
+	}
+}
+
+func (l *HandOffList) GobEncode() ([]byte, error) {
+	return l.EncodeVersion(common.ProtocolVersion)
+}
+
+func (l *HandOffList) EncodeVersion(version uint16) (gobList []byte, err error) {
+	if l == nil {
+		err = fmt.Errorf("Cannot encode nil value l")
+		return
+	}
+	var encoded []byte
+	switch version {
+	case 14, 15:
+		encoded, err = encoding.Marshal(l)
+	default:
+		err = fmt.Errorf("Cannot encode a HandOffList at version %v", version)
+	}
+	if err != nil {
+		return
+	}
+	gobList = common.VersionedEnvelope(version, encoded)
+	return
+}
+
+func (l *HandOffList) GobDecode(gobList []byte) (err error) {
+	if l == nil {
+		err = fmt.Errorf("Cannot decode into nil HandOffList")
+		return
+	}
+
+	version, body, err := common.OpenEnvelope(gobList)
+	if err != nil {
+		return
+	}
+	switch version {
+	case 14, 15:
+		err = encoding.Unmarshal(body, l)
+	default:
+		err = fmt.Errorf("Cannot decode a HandOffList of version %v", version)
+	}
+	return
+}
@@ -0,0 +1,306 @@
+package quorum
+
+import (
+	"common"
+	"common/crypto"
+	"common/encoding"
+	"testing"
+)
+
+// sentMessage returns the last message sent over z to proc, or nil.
+func sentMessage(z *common.ZeroNetwork, proc string) (m *common.Message) {
+	for i := 0; z.RecentMessage(i) != nil; i++ {
+		if z.RecentMessage(i).Proc == proc {
+			m = z.RecentMessage(i)
+		}
+	}
+	return
+}
+
+// sentMessages returns every message sent over z, in order.
+func sentMessages(z *common.ZeroNetwork) (messages []*common.Message) {
+	for i := 0; z.RecentMessage(i) != nil; i++ {
+		messages = append(messages, z.RecentMessage(i))
+	}
+	return
+}
+
+func TestAcceptDeparture(t *testing.T) {
+	s, err := CreateState(common.NewZeroNetwork())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fillQuorum(s)
+	pubKey, secKey, err := crypto.CreateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.participants[1].publicKey = pubKey
+
+	lq, err := NewLeaveQuorum(secKey, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.acceptDeparture(2, lq) != lqerrWrongIndex {
+		t.Error("accepted another participant's announcement")
+	}
+	forged, err := NewLeaveQuorum(s.secretKey, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.acceptDeparture(1, forged) != lqerrInvalidSignature {
+		t.Error("accepted an announcement signed by another key")
+	}
+	if err = s.acceptDeparture(1, lq); err != nil {
+		t.Fatal(err)
+	}
+	if s.departures[1] != s.handOffBlocks {
+		t.Error("hand-off did not start")
+	}
+	if s.acceptDeparture(1, lq) != lqerrDeparting {
+		t.Error("hand-off was restarted")
+	}
+
+	// announcements travel in heartbeats
+	hb := goldenHeartbeat()
+	hb.leave = lq
+	encoded, err := encoding.Marshal(hb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := new(heartbeat)
+	err = encoding.Unmarshal(encoded, decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.leave == nil || decoded.leave.Index != 1 || decoded.leave.verify(pubKey) != nil {
+		t.Error("announcement changed in encoding")
+	}
+}
+
+// We announce our departure until it is compiled, and stop taking part once
+// the hand-off is over.
+func TestLeaveSia(t *testing.T) {
+	_, secKey, err := crypto.CreateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := CreateStateWithConfig(common.NewZeroNetwork(), secKey, depositConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fillQuorum(s)
+	s.self.publicKey = secKey.Public()
+	if s.LeaveSia() == nil {
+		t.Error("left a quorum that was never joined")
+	}
+
+	s.ticking = true
+	if err = s.LeaveSia(); err != nil {
+		t.Fatal(err)
+	}
+	hb, err := s.newHeartbeat(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hb.leave == nil {
+		t.Fatal("heartbeat does not announce our departure")
+	}
+
+	compileBlock(s, map[byte]*LeaveQuorum{0: hb.leave}, nil, nil)
+	if !s.ticking || s.participants[0] == nil {
+		t.Fatal("left before the hand-off was over")
+	}
+	hb, err = s.newHeartbeat(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hb.leave != nil {
+		t.Error("departure was announced again")
+	}
+
+	compileBlock(s, nil, nil, nil)
+	if s.ticking || s.leaving {
+		t.Error("still taking part after leaving")
+	}
+	if s.participants[0] != nil || s.self.index != 255 {
+		t.Error("departure was not compiled")
+	}
+}
+
+// A participant that joins a full quorum succeeds a departing participant,
+// is handed its segments, and takes its place.
+func TestSuccession(t *testing.T) {
+	z := common.NewZeroNetwork()
+	s, err := CreateState(z)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fillQuorum(s)
+	s.ticking = true
+	sector := crypto.Hash{1}
+	s.sectors[sector] = &sectorRecord{balance: 100, segments: []crypto.Hash{{5}, {6}}}
+
+	successorPub, successorKey, err := crypto.CreateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	successor := Participant{
+		address:   common.Address{ID: 1, Host: "localhost", Port: 8000},
+		publicKey: successorPub,
+	}
+
+	// nobody is departing, so the joiner waits for a place, and is appointed
+	// once a participant departs
+	err = s.HandleJoinSia(successor, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compileJoins(s)
+	if len(s.waiting) != 1 || !successor.compare(s.waiting[0]) || len(s.successors) != 0 {
+		t.Fatal("joiner of a full quorum is not waiting for a place")
+	}
+	s.departures[0] = 1
+	compileBlock(s, nil, nil, nil)
+	if len(s.waiting) != 0 {
+		t.Error("successor is still waiting")
+	}
+	if !successor.compare(s.successors[0]) || s.participants[0] != s.self {
+		t.Fatal("successor was not appointed")
+	}
+	if b := s.LastBlock(); len(b.Appointed) != 1 || b.Appointed[0] != 0 {
+		t.Error("appointment was not recorded:", b.Appointed)
+	}
+	m := sentMessage(z, "State.HandleSuccession")
+	if m == nil || m.Dest != successor.address {
+		t.Fatal("successor was not told whose place it takes")
+	}
+	if predecessor := m.Args.(Participant); predecessor.index != 0 || predecessor.address != s.self.address {
+		t.Error("successor was told the wrong predecessor:", predecessor)
+	}
+
+	// only the successor is handed our segments
+	var list HandOffList
+	_, otherKey, err := crypto.CreateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged, err := NewHandOffRequest(otherKey, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.HandleHandOffRequest(*forged, &list) != hoerrInvalidSignature {
+		t.Error("segments were handed off to a request the successor did not sign")
+	}
+	request, err := NewHandOffRequest(successorKey, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.HandleHandOffRequest(*request, &list) != hoerrNotSuccessor {
+		t.Error("segments were handed off for another participant")
+	}
+	request, err = NewHandOffRequest(successorKey, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gobRequest, err := request.GobEncode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded HandOffRequest
+	err = decoded.GobDecode(gobRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.HandleHandOffRequest(decoded, &list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Sectors) != 1 || list.Sectors[0] != sector || list.Segments[0] != (crypto.Hash{5}) {
+		t.Error("hand-off list is wrong:", list)
+	}
+
+	// the successor takes our place once the hand-off is over
+	compileBlock(s, nil, nil, nil)
+	if !successor.compare(s.participants[0]) || s.heartbeats[0] == nil {
+		t.Error("successor did not take our place")
+	}
+	if s.ticking {
+		t.Error("still taking part after leaving")
+	}
+	m = sentMessage(z, "State.HandleSnapshot")
+	if m == nil || m.Dest != successor.address {
+		t.Fatal("successor was not sent the state it joins in")
+	}
+	snapshot := m.Args.(Snapshot)
+	if !successor.compare(snapshot.participants[0]) || snapshot.sectors[sector] == nil {
+		t.Error("successor was sent the wrong state:", snapshot.participants)
+	}
+
+	// the successor is not counted as inactive in its first block, though
+	// it only starts sending heartbeats once told
+	for i := 1; i < s.quorumSize; i++ {
+		s.heartbeats[i] = map[crypto.TruncatedHash]*heartbeat{{byte(i)}: goldenHeartbeat()}
+	}
+	s.compile()
+	if !successor.compare(s.participants[0]) {
+		t.Error("successor was tossed before it could send a heartbeat")
+	}
+	if b := s.LastBlock(); len(b.Tossed) != 0 || len(b.Evicted) != 0 {
+		t.Error("successor's first block removed participants:", b)
+	}
+}
+
+// A successor accepts the segments handed off by its predecessor.
+func TestHandOff(t *testing.T) {
+	s, err := CreateState(common.NewZeroNetwork())
+	if err != nil {
+		t.Fatal(err)
+	}
+	handedOff := make(chan HandOffList)
+	s.SetHandOff(func(predecessor common.Address, list HandOffList) {
+		handedOff <- list
+	})
+
+	predecessor := Participant{index: 2, address: common.Address{ID: 1, Host: "localhost", Port: 8000}}
+	err = s.succeed(predecessor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-handedOff
+	if s.self.index != 2 {
+		t.Error("successor did not take the index of its predecessor")
+	}
+
+	// once we hold an index, nobody can move us to another
+	predecessor.index = 3
+	if s.succeed(predecessor) != hoerrParticipating {
+		t.Error("succeeded a second participant")
+	}
+	if s.self.index != 2 {
+		t.Error("index changed by a second succession")
+	}
+
+	sector := crypto.Hash{1}
+	if s.ExpectsSegment(sector, crypto.Hash{5}) {
+		t.Error("expected a segment that was not handed off")
+	}
+	s.handedOff[sector] = crypto.Hash{5}
+	if !s.ExpectsSegment(sector, crypto.Hash{5}) {
+		t.Error("handed off segment was not expected")
+	}
+
+	list := HandOffList{Sectors: []crypto.Hash{sector}, Segments: []crypto.Hash{{5}}}
+	gobList, err := list.GobEncode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded HandOffList
+	err = decoded.GobDecode(gobList)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.Sectors) != 1 || decoded.Sectors[0] != sector || decoded.Segments[0] != (crypto.Hash{5}) {
+		t.Error("hand-off list changed in encoding")
+	}
+}
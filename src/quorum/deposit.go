@@ -0,0 +1,117 @@
+package quorum
+
+import (
+	"errors"
+)
+
+// Every participant locks a down payment of DownPayment siacoins from its
+// wallet when it joins the quorum. A participant that is tossed for cause,
+// for sending no heartbeat or more than one, forfeits its down payment. The
+// forfeited siacoins are destroyed rather than paid to anybody, so that no
+// participant profits from forcing another out. A participant that leaves
+// gracefully is refunded DepositCooldown blocks after it leaves; see
+// departure.go. A wallet can back only one participant at a time.
+//
+// The down payment is taken in compile(), after the transactions of the
+// block, so that every participant takes it from the same balances.
+type deposit struct {
+	wallet  WalletID
+	amount  uint64
+	release uint64 // height at which a departed participant is refunded
+}
+
+var dperrInsufficientFunds = errors.New("Participant cannot afford the down payment")
+var dperrWalletInUse = errors.New("Participant's wallet already backs another participant")
+
+// lockDeposit takes the down payment from the wallet of a joining
+// participant, or of a successor when it is appointed. lockDeposit only runs
+// during compile().
+func (s *State) lockDeposit(p *Participant) (err error) {
+	if s.downPayment == 0 {
+		return
+	}
+	id, err := NewWalletID(p.publicKey)
+	if err != nil {
+		return
+	}
+
+	s.walletsLock.Lock()
+	defer s.walletsLock.Unlock()
+	if s.deposits[id] != nil {
+		return dperrWalletInUse
+	}
+	w := s.wallets[id]
+	if w == nil || w.balance < s.downPayment {
+		return dperrInsufficientFunds
+	}
+	w.balance -= s.downPayment
+	s.deposits[id] = &deposit{
+		wallet: id,
+		amount: s.downPayment,
+	}
+	return
+}
+
+// forfeitDeposit destroys the down payment of a participant that is tossed
+// for cause. forfeitDeposit only runs during compile().
+func (s *State) forfeitDeposit(pi byte) {
+	id, err := NewWalletID(s.participants[pi].publicKey)
+	if err != nil {
+		return
+	}
+	s.walletsLock.Lock()
+	delete(s.deposits, id)
+	s.walletsLock.Unlock()
+}
+
+// refundDeposit schedules the down payment of a departing participant to be
+// returned after the cooldown. refundDeposit only runs during compile().
+func (s *State) refundDeposit(pi byte) {
+	id, err := NewWalletID(s.participants[pi].publicKey)
+	if err != nil {
+		return
+	}
+	s.walletsLock.Lock()
+	defer s.walletsLock.Unlock()
+	d := s.deposits[id]
+	if d == nil {
+		return
+	}
+	delete(s.deposits, id)
+	d.release = s.height + s.depositCooldown
+	s.refunds = append(s.refunds, d)
+}
+
+// releaseRefunds returns every down payment whose cooldown has passed.
+// Refunds are scheduled in order of release, as the cooldown never changes.
+// releaseRefunds only runs during compile().
+func (s *State) releaseRefunds() {
+	s.walletsLock.Lock()
+	defer s.walletsLock.Unlock()
+	for len(s.refunds) > 0 && s.refunds[0].release <= s.height {
+		d := s.refunds[0]
+		s.refunds = s.refunds[1:]
+		w := s.wallets[d.wallet]
+		if w == nil {
+			w = new(Wallet)
+			s.wallets[d.wallet] = w
+		}
+		if w.balance+d.amount < w.balance {
+			w.balance = ^uint64(0)
+		} else {
+			w.balance += d.amount
+		}
+	}
+}
+
+// Deposit returns the down payment locked from a wallet, and whether it has
+// one at all.
+func (s *State) Deposit(id WalletID) (amount uint64, locked bool) {
+	s.walletsLock.RLock()
+	defer s.walletsLock.RUnlock()
+	d := s.deposits[id]
+	if d == nil {
+		return
+	}
+	return d.amount, true
+}
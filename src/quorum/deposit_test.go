@@ -0,0 +1,256 @@
+package quorum
+
+import (
+	"common"
+	"common/crypto"
+	"testing"
+)
+
+// depositConfig requires a down payment of 10, refunded 2 blocks after a
+// departure, which takes a single block.
+func depositConfig() Config {
+	config := DefaultConfig()
+	config.DownPayment = 10
+	config.DepositCooldown = 2
+	config.HandOffBlocks = 1
+	return config
+}
+
+// compileBlock gives every participant a single heartbeat, carrying its
+// announcement in leaves if it has one, except that the participants in
+// missing send none and those in doubled send two, then compiles.
+func compileBlock(s *State, leaves map[byte]*LeaveQuorum, missing []byte, doubled []byte) {
+	for i, p := range s.participants {
+		if p == nil {
+			continue
+		}
+		hb := goldenHeartbeat()
+		hb.leave = leaves[byte(i)]
+		s.heartbeats[i] = map[crypto.TruncatedHash]*heartbeat{{byte(i)}: hb}
+		for _, m := range missing {
+			if m == byte(i) {
+				s.heartbeats[i] = make(map[crypto.TruncatedHash]*heartbeat)
+			}
+		}
+		for _, d := range doubled {
+			if d == byte(i) {
+				s.heartbeats[i][crypto.TruncatedHash{0xff}] = goldenHeartbeat()
+			}
+		}
+	}
+	s.compile()
+}
+
+// A participant whose join is recorded locks its down payment when the join
+// is compiled, and is not admitted if it cannot afford it.
+func TestLockDeposit(t *testing.T) {
+	richPub, _, err := crypto.CreateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rich, err := NewWalletID(richPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	poorPub, _, err := crypto.CreateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	poor, err := NewWalletID(poorPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := depositConfig()
+	config.Genesis = map[WalletID]uint64{rich: 25, poor: 9}
+	_, secKey, err := crypto.CreateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := CreateStateWithConfig(common.NewZeroNetwork(), secKey, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fillQuorum(s)
+	s.self.publicKey = secKey.Public()
+	s.participants[1], s.participants[2], s.participants[3] = nil, nil, nil
+
+	// a join recorded twice admits its participant once
+	for _, pubKey := range []*crypto.PublicKey{richPub, poorPub, richPub} {
+		err = s.HandleJoinSia(Participant{publicKey: pubKey}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if balance, _ := s.Balance(rich); balance != 25 {
+		t.Error("down payment was taken before the compile:", balance)
+	}
+	compileJoins(s)
+
+	if balance, _ := s.Balance(rich); balance != 15 {
+		t.Error("down payment was not taken from the wallet:", balance)
+	}
+	if amount, locked := s.Deposit(rich); !locked || amount != 10 {
+		t.Error("down payment was not locked:", amount, locked)
+	}
+	if s.participants[1] == nil || !s.participants[1].publicKey.Compare(richPub) {
+		t.Error("participant that can afford the down payment was not admitted")
+	}
+	if s.participants[2] != nil || s.participants[3] != nil {
+		t.Error("admitted a participant twice, or one that cannot afford the down payment")
+	}
+	if balance, _ := s.Balance(poor); balance != 9 {
+		t.Error("participant that cannot afford the down payment was charged:", balance)
+	}
+	if b := s.LastBlock(); len(b.Joined) != 1 || b.Joined[0] != 1 {
+		t.Error("wrong admissions recorded:", b.Joined)
+	}
+}
+
+// A new participant takes the wallets and down payments of the quorum from
+// the snapshot it is sent, including its own down payment, which it was not
+// there to see taken. It charges none of the members, and agrees with them
+// on the next block.
+func TestJoinOrdering(t *testing.T) {
+	memberPub, memberKey, err := crypto.CreateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	member, err := NewWalletID(memberPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	joinerPub, joinerKey, err := crypto.CreateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	joinerID, err := NewWalletID(joinerPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := depositConfig()
+	config.Genesis = map[WalletID]uint64{member: 10, joinerID: 25}
+	z := common.NewZeroNetwork()
+	m, err := CreateStateWithConfig(z, memberKey, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	joiner, err := CreateStateWithConfig(z, joinerKey, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the member forms the quorum, then the joiner joins through it
+	err = m.HandleJoinSia(*m.self, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.HandleJoinSia(*joiner.self, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compileJoins(m)
+
+	m1 := sentMessage(z, "State.HandleSnapshot")
+	if m1 == nil || m1.Dest != joiner.self.address {
+		t.Fatal("joiner was not sent a snapshot")
+	}
+	err = joiner.HandleSnapshot(m1.Args.(Snapshot), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !joiner.participating() || joiner.participants[m.self.index] == nil {
+		t.Fatal("joiner did not take its place alongside the member")
+	}
+	if balance, _ := joiner.Balance(joinerID); balance != 15 {
+		t.Error("joiner does not know its down payment was taken:", balance)
+	}
+	if amount, locked := joiner.Deposit(joinerID); !locked || amount != 10 {
+		t.Error("joiner does not know its down payment is locked:", amount)
+	}
+
+	compileJoins(joiner)
+	compileJoins(m)
+	for i := range m.participants {
+		if (m.participants[i] == nil) != (joiner.participants[i] == nil) {
+			t.Fatal("joiner and member disagree on the participants at", i)
+		}
+	}
+	if b := joiner.LastBlock(); b.removed() != 0 {
+		t.Error("joiner removed a member that was there before it:", b)
+	}
+	for _, id := range []WalletID{member, joinerID} {
+		joinerBalance, _ := joiner.Balance(id)
+		memberBalance, _ := m.Balance(id)
+		if joinerBalance != memberBalance {
+			t.Error("joiner and member disagree on the balance of", id, joinerBalance, memberBalance)
+		}
+	}
+	if balance, _ := joiner.Balance(member); balance != 10 {
+		t.Error("joiner charged the member a down payment:", balance)
+	}
+}
+
+// A participant that sends two heartbeats loses its down payment, and one
+// that leaves gracefully gets it back after the cooldown.
+func TestForfeitAndRefund(t *testing.T) {
+	_, secKey, err := crypto.CreateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := CreateStateWithConfig(common.NewZeroNetwork(), secKey, depositConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := keyQuorum(t, s)
+	leaverPub, leaverKey, err := crypto.CreateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.participants[2].publicKey = leaverPub
+	hosts[2], err = NewWalletID(leaverPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range hosts {
+		s.deposits[id] = &deposit{wallet: id, amount: 10}
+	}
+	leave, err := NewLeaveQuorum(leaverKey, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the departing participant stays for the block of its hand-off
+	compileBlock(s, map[byte]*LeaveQuorum{2: leave}, nil, []byte{1})
+	if s.participants[1] != nil {
+		t.Fatal("participant that sent two heartbeats was not tossed")
+	}
+	if _, locked := s.Deposit(hosts[1]); locked {
+		t.Error("tossed participant kept its down payment")
+	}
+	if s.participants[2] == nil {
+		t.Fatal("departing participant was removed before its hand-off")
+	}
+	compileBlock(s, nil, nil, nil)
+	if s.participants[2] != nil {
+		t.Fatal("departing participant was not removed after its hand-off")
+	}
+	if _, locked := s.Deposit(hosts[2]); locked {
+		t.Error("departed participant kept its down payment")
+	}
+	if amount, locked := s.Deposit(hosts[3]); !locked || amount != 10 {
+		t.Error("honest participant lost its down payment")
+	}
+
+	// hosts are also paid for sectors, but there are none
+	compileBlock(s, nil, nil, nil)
+	if b2, _ := s.Balance(hosts[2]); b2 != 0 {
+		t.Error("refund was paid before the cooldown:", b2)
+	}
+	compileBlock(s, nil, nil, nil)
+	if b2, _ := s.Balance(hosts[2]); b2 != 10 {
+		t.Error("refund was not paid after the cooldown:", b2)
+	}
+	if b1, _ := s.Balance(hosts[1]); b1 != 0 {
+		t.Error("forfeited down payment was paid to", b1)
+	}
+}
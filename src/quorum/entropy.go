@@ -0,0 +1,165 @@
+package quorum
+
+import (
+	"bufio"
+	"common"
+	"common/crypto"
+	"common/encoding"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// The entropy of each block comes from the heartbeats of the participants,
+// so a participant that sends its heartbeat last can try several and keep
+// the one that gives the outcome it wants. An ExternalEntropySource supplies
+// a seed that no participant controls; compile() hashes the internal seed
+// together with the external seed for the block, so that steering the
+// outcome also requires knowing the external seed in advance.
+//
+// Every participant must use the same source, and the source must give every
+// participant the same seed for a height. A participant that cannot get the
+// seed for a block cannot compile it, and stalls until the seed is available
+// rather than fork from the quorum with different entropy.
+type ExternalEntropySource interface {
+	// Seed returns the external seed for the block at height.
+	Seed(height uint64) ([]byte, error)
+}
+
+// SetExternalEntropySource sets the source mixed into the entropy of each
+// block; nil mixes in nothing.
+func (s *State) SetExternalEntropySource(source ExternalEntropySource) {
+	s.stepLock.Lock()
+	s.externalEntropy = source
+	s.stepLock.Unlock()
+}
+
+// externalSeed returns the external seed for the block at height, which is
+// nil if there is no source.
+func (s *State) externalSeed(height uint64) (seed []byte, err error) {
+	if s.externalEntropy == nil {
+		return
+	}
+	seed, err = s.externalEntropy.Seed(height)
+	if err != nil {
+		err = fmt.Errorf("No external entropy for block %v: %v", height, err)
+	}
+	return
+}
+
+// mixEntropy returns the internal seed hashed together with the external
+// seed, or the internal seed alone if there is no external seed.
+func mixEntropy(internal common.Entropy, seed []byte) (entropy common.Entropy, err error) {
+	if seed == nil {
+		return internal, nil
+	}
+	th, err := crypto.CalculateTruncatedHash(append(internal[:], seed...))
+	entropy = common.Entropy(th)
+	return
+}
+
+// A FileEntropySource reads seeds from a file holding one hex encoded seed
+// per line: the seed for height h is on line h, counting from 1. Blank lines
+// and lines starting with # are not counted, and a line only counts once it
+// ends in a newline. Seeds may be appended while the quorum runs, as long as
+// each is there before its block is compiled; the lines already read are
+// kept, and only the rest of the file is read for a later height.
+type FileEntropySource struct {
+	filename string
+
+	lock   sync.Mutex
+	seeds  []string // the seed lines read so far
+	offset int64    // the end of the last line read
+}
+
+// NewFileEntropySource returns a source reading from filename, which must
+// already exist.
+func NewFileEntropySource(filename string) (f *FileEntropySource, err error) {
+	_, err = os.Stat(filename)
+	if err != nil {
+		return
+	}
+	f = &FileEntropySource{filename: filename}
+	return
+}
+
+// readSeeds reads the lines appended since the last read. f.lock must be
+// held by the caller.
+func (f *FileEntropySource) readSeeds() (err error) {
+	file, err := os.Open(f.filename)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	_, err = file.Seek(f.offset, io.SeekStart)
+	if err != nil {
+		return
+	}
+
+	reader := bufio.NewReader(file)
+	for {
+		var line string
+		line, err = reader.ReadString('\n')
+		if err == io.EOF {
+			// an unfinished line is read again once it is complete
+			return nil
+		} else if err != nil {
+			return
+		}
+		f.offset += int64(len(line))
+		text := strings.TrimSpace(line)
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		f.seeds = append(f.seeds, text)
+	}
+}
+
+// Seed returns the seed for height from the file.
+func (f *FileEntropySource) Seed(height uint64) (seed []byte, err error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if height > uint64(len(f.seeds)) {
+		err = f.readSeeds()
+		if err != nil {
+			return
+		}
+	}
+	if height == 0 || height > uint64(len(f.seeds)) {
+		err = fmt.Errorf("No seed for height %v in %v", height, f.filename)
+		return
+	}
+	seed, err = hex.DecodeString(f.seeds[height-1])
+	if err != nil {
+		err = fmt.Errorf("Bad seed for height %v: %v", height, err)
+	}
+	return
+}
+
+// A LocalBeacon derives the seed for each height from a secret shared by the
+// participants, as the hash of the secret and the height. It needs no
+// network, and serves for testing, or for writing a seed file in advance.
+type LocalBeacon struct {
+	secret []byte
+}
+
+// NewLocalBeacon returns a beacon deriving its seeds from secret.
+func NewLocalBeacon(secret []byte) *LocalBeacon {
+	return &LocalBeacon{secret: append([]byte(nil), secret...)}
+}
+
+// Seed returns the seed for height.
+func (b *LocalBeacon) Seed(height uint64) (seed []byte, err error) {
+	e := new(encoding.Encoder)
+	e.WriteFixed(b.secret)
+	e.WriteUint64(height)
+	th, err := crypto.CalculateTruncatedHash(e.Bytes())
+	if err != nil {
+		return
+	}
+	seed = th[:]
+	return
+}
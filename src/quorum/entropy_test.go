@@ -0,0 +1,168 @@
+package quorum
+
+import (
+	"bytes"
+	"common"
+	"common/crypto"
+	"common/encoding"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// orderingWith compiles a block of identical heartbeats with source mixed in,
+// and returns the participant ordering of the next block.
+func orderingWith(t *testing.T, source ExternalEntropySource) []byte {
+	_, secKey, err := crypto.CreateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := CreateStateWithConfig(common.NewZeroNetwork(), secKey, sizedConfig(32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fillQuorum(s)
+	s.SetExternalEntropySource(source)
+	compileBlock(s, nil, nil, nil)
+	return s.participantOrdering()
+}
+
+// The external seed changes the shuffling, and participants with the same
+// seed still agree.
+func TestMixEntropy(t *testing.T) {
+	internal := orderingWith(t, nil)
+	if !bytes.Equal(internal, orderingWith(t, nil)) {
+		t.Fatal("participants with the same heartbeats disagree on the ordering")
+	}
+
+	beacon := orderingWith(t, NewLocalBeacon([]byte("a")))
+	if bytes.Equal(internal, beacon) {
+		t.Error("external seed did not change the ordering")
+	}
+	if !bytes.Equal(beacon, orderingWith(t, NewLocalBeacon([]byte("a")))) {
+		t.Error("participants with the same external seed disagree on the ordering")
+	}
+	if bytes.Equal(beacon, orderingWith(t, NewLocalBeacon([]byte("b")))) {
+		t.Error("different external seeds gave the same ordering")
+	}
+
+	// a block whose seed is missing is not compiled until the seed arrives
+	dir, err := ioutil.TempDir("", "entropy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "seeds")
+	err = ioutil.WriteFile(filename, nil, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	empty, err := NewFileEntropySource(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := CreateState(common.NewZeroNetwork())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetExternalEntropySource(empty)
+	entropy := s.currentEntropy
+	if s.compile() {
+		t.Fatal("compiled a block without its external seed")
+	}
+	if s.height != 0 || s.currentEntropy != entropy {
+		t.Error("a block that was not compiled changed the state")
+	}
+	appendSeeds(t, filename, "01\n")
+	if !s.compile() || s.height != 1 {
+		t.Error("did not compile once the seed arrived")
+	}
+}
+
+// appendSeeds appends lines to the seed file.
+func appendSeeds(t *testing.T, filename string, lines string) {
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	_, err = file.WriteString(lines)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileEntropySource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "entropy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "seeds")
+	if _, err = NewFileEntropySource(filename); err == nil {
+		t.Error("accepted a missing seed file")
+	}
+
+	err = ioutil.WriteFile(filename, []byte("# seeds\n0102\n\nff\nnot hex\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := NewFileEntropySource(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seed, err := f.Seed(1)
+	if err != nil || !bytes.Equal(seed, []byte{1, 2}) {
+		t.Error("wrong seed for height 1:", seed, err)
+	}
+	seed, err = f.Seed(2)
+	if err != nil || !bytes.Equal(seed, []byte{0xff}) {
+		t.Error("wrong seed for height 2:", seed, err)
+	}
+	if _, err = f.Seed(3); err == nil {
+		t.Error("accepted a seed that is not hex")
+	}
+	if _, err = f.Seed(4); err == nil {
+		t.Error("returned a seed past the end of the file")
+	}
+
+	// seeds appended later are read, but a line is not read until it ends
+	appendSeeds(t, filename, "03")
+	if _, err = f.Seed(4); err == nil {
+		t.Error("read a seed that is still being written")
+	}
+	appendSeeds(t, filename, "04\n")
+	seed, err = f.Seed(4)
+	if err != nil || !bytes.Equal(seed, []byte{3, 4}) {
+		t.Error("appended seed was not read:", seed, err)
+	}
+	if _, err = f.Seed(0); err == nil {
+		t.Error("returned a seed for height 0")
+	}
+}
+
+func TestLocalBeacon(t *testing.T) {
+	b := NewLocalBeacon([]byte("secret"))
+	s1, err := b.Seed(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, _ := NewLocalBeacon([]byte("secret")).Seed(1)
+	if !bytes.Equal(s1, again) {
+		t.Error("beacon is not deterministic")
+	}
+	s2, _ := b.Seed(2)
+	if bytes.Equal(s1, s2) {
+		t.Error("beacon gave the same seed for two heights")
+	}
+
+	// the height is encoded as everywhere else in the protocol
+	e := new(encoding.Encoder)
+	e.WriteFixed([]byte("secret"))
+	e.WriteUint64(1)
+	expected, _ := crypto.CalculateTruncatedHash(e.Bytes())
+	if !bytes.Equal(s1, expected[:]) {
+		t.Error("beacon does not use the canonical encoding of the height")
+	}
+}
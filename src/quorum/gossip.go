@@ -0,0 +1,111 @@
+package quorum
+
+import (
+	"common/crypto"
+)
+
+// DefaultFanout is the fanout given to new States. A fanout of 0 sends every
+// message directly to every participant, which is cheapest for small quorums.
+var DefaultFanout = 0
+
+// Messages are gossiped over a ring of the participants, ordered by index.
+// Each participant sends to the participants 1, 2, 4, ... places after itself
+// on the ring, then to the nearest participants it has not yet picked, until
+// it has picked fanout of them. Every participant that receives a message
+// for the first time passes it on the same way, so with a fanout of at least
+// log2(n) a message reaches all n participants within ceil(log2(n)) hops,
+// and over several disjoint paths.
+//
+// A SignedHeartbeat is signed by every participant that passes it on, so the
+// number of hops it has taken is the number of its signatures. The step
+// checks in HandleSignedHeartbeat therefore hold under gossip exactly as
+// they do when sending to every participant, provided each hop takes less
+// than a step.
+
+// SetFanout sets how many participants each message is sent to. 0 sends to
+// every participant.
+func (s *State) SetFanout(fanout int) {
+	s.gossipLock.Lock()
+	s.fanout = fanout
+	s.gossipLock.Unlock()
+}
+
+// gossipTargets returns the participants a message is sent to. We are always
+// a target ourselves, so that our own messages, such as our heartbeat, are
+// handled like everyone else's. The caller must hold participantsLock.
+func (s *State) gossipTargets() (targets []*Participant) {
+	// build the ring, finding our own position on it
+	var ring []*Participant
+	position := -1
+	for _, p := range s.participants {
+		if p == nil {
+			continue
+		}
+		if p == s.self {
+			position = len(ring)
+		}
+		ring = append(ring, p)
+	}
+
+	s.gossipLock.Lock()
+	fanout := s.fanout
+	s.gossipLock.Unlock()
+
+	// send to everyone if the fanout covers the quorum, or if we are not on
+	// the ring yet
+	if position == -1 || fanout <= 0 || fanout >= len(ring)-1 {
+		return ring
+	}
+
+	targets = append(targets, s.self)
+	picked := make(map[int]bool)
+	pick := func(offset int) {
+		if len(targets) <= fanout && !picked[offset] {
+			picked[offset] = true
+			targets = append(targets, ring[(position+offset)%len(ring)])
+		}
+	}
+	for offset := 1; offset < len(ring); offset *= 2 {
+		pick(offset)
+	}
+	for offset := 1; offset < len(ring); offset++ {
+		pick(offset)
+	}
+	return
+}
+
+// gossiping returns true if messages are sent to only some participants, in
+// which case every participant must relay what it receives.
+func (s *State) gossiping() bool {
+	s.gossipLock.Lock()
+	defer s.gossipLock.Unlock()
+	return s.fanout > 0 && s.fanout < s.quorumSize-1
+}
+
+// seenKey returns the key a SignedHeartbeat is deduplicated by: the hash of
+// its heartbeat and its signatories. The signatures are left out, as they
+// differ every time the same signatories sign.
+func (sh *SignedHeartbeat) seenKey() (crypto.TruncatedHash, error) {
+	return crypto.CalculateTruncatedHash(append(sh.heartbeatHash[:], sh.signatories...))
+}
+
+// markSeen records the key of a message, returning false if it has been seen
+// before in this block. Only messages that have been validated are marked, so
+// that junk does not grow the record.
+func (s *State) markSeen(key crypto.TruncatedHash) bool {
+	s.gossipLock.Lock()
+	defer s.gossipLock.Unlock()
+	if s.seen[key] {
+		return false
+	}
+	s.seen[key] = true
+	return true
+}
+
+// forgetSeen clears the record of seen messages. It is called once per block,
+// so that the record does not grow without bound.
+func (s *State) forgetSeen() {
+	s.gossipLock.Lock()
+	s.seen = make(map[crypto.TruncatedHash]bool)
+	s.gossipLock.Unlock()
+}
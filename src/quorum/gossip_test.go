@@ -0,0 +1,148 @@
+package quorum
+
+import (
+	"common"
+	"common/crypto"
+	"math/big"
+	"testing"
+)
+
+// fillQuorum gives s a full quorum of participants, with s at index 0.
+func fillQuorum(s *State) {
+	for i := range s.participants {
+		s.participants[i] = &Participant{
+			index:   byte(i),
+			address: common.Address{ID: common.Identifier(i), Host: "localhost", Port: 9000 + i},
+		}
+	}
+	s.self = s.participants[0]
+}
+
+func TestGossipTargets(t *testing.T) {
+	s, err := CreateState(common.NewZeroNetwork())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// before joining, messages go to every participant
+	s.participants[1] = &Participant{index: 1}
+	s.SetFanout(1)
+	if targets := s.gossipTargets(); len(targets) != 1 || targets[0] != s.participants[1] {
+		t.Error("state that has not joined did not send to every participant:", targets)
+	}
+
+	fillQuorum(s)
+	s.SetFanout(0)
+	if targets := s.gossipTargets(); len(targets) != s.quorumSize {
+		t.Error("fanout 0 did not send to every participant:", len(targets))
+	}
+	for fanout := 1; fanout < s.quorumSize; fanout++ {
+		s.SetFanout(fanout)
+		targets := s.gossipTargets()
+		if len(targets) != fanout+1 || targets[0] != s.self {
+			t.Errorf("fanout %v picked %v targets", fanout, len(targets))
+		}
+	}
+}
+
+// With a fanout of log2(n), a message relayed by every participant that
+// receives it reaches the whole quorum within ceil(log2(n)) hops.
+func TestGossipCoverage(t *testing.T) {
+	_, secKey, err := crypto.CreateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range []int{2, 5, 16, 128} {
+		s, err := CreateStateWithConfig(common.NewZeroNetwork(), secKey, sizedConfig(size))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fillQuorum(s)
+		hops := 0
+		for 1<<uint(hops) < s.quorumSize {
+			hops++
+		}
+		s.SetFanout(hops)
+
+		for origin := range s.participants {
+			reached := map[byte]bool{byte(origin): true}
+			frontier := []byte{byte(origin)}
+			for hop := 0; hop < hops; hop++ {
+				var next []byte
+				for _, i := range frontier {
+					s.self = s.participants[i]
+					for _, p := range s.gossipTargets() {
+						if !reached[p.index] {
+							reached[p.index] = true
+							next = append(next, p.index)
+						}
+					}
+				}
+				frontier = next
+			}
+			if len(reached) != s.quorumSize {
+				t.Errorf("message from %v reached %v of %v participants in %v hops", origin, len(reached), size, hops)
+			}
+		}
+	}
+}
+
+// Each message is handled once per block, however many paths it arrives by.
+func TestMarkSeen(t *testing.T) {
+	s, err := CreateState(common.NewZeroNetwork())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sh := &SignedHeartbeat{
+		heartbeatHash: crypto.TruncatedHash{1},
+		signatories:   []byte{0, 2},
+		signatures:    []crypto.Signature{{R: big.NewInt(1), S: big.NewInt(2)}, {R: big.NewInt(3), S: big.NewInt(4)}},
+	}
+	key, err := sh.seenKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.markSeen(key) {
+		t.Fatal("new message was marked as seen")
+	}
+
+	// signing again gives different signatures, but the same message
+	resigned := *sh
+	resigned.signatures = []crypto.Signature{{R: big.NewInt(5), S: big.NewInt(6)}, {R: big.NewInt(7), S: big.NewInt(8)}}
+	if key, _ = resigned.seenKey(); s.markSeen(key) {
+		t.Error("repeated message was not marked as seen")
+	}
+	other := *sh
+	other.signatories = []byte{0, 3}
+	if key, _ = other.seenKey(); !s.markSeen(key) {
+		t.Error("different message was marked as seen")
+	}
+
+	s.forgetSeen()
+	if key, _ = sh.seenKey(); !s.markSeen(key) {
+		t.Error("message from the previous block was still marked as seen")
+	}
+}
+
+// broadcast sends to the gossip targets only.
+func TestGossipBroadcast(t *testing.T) {
+	z := common.NewZeroNetwork()
+	s, err := CreateState(z)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fillQuorum(s)
+	s.SetFanout(1)
+	s.broadcast(&common.Message{Proc: "State.HandleSignedHeartbeat"})
+
+	sent := 0
+	for z.RecentMessage(sent) != nil {
+		sent++
+	}
+	if sent != 2 {
+		t.Fatal("broadcast with fanout 1 sent", sent, "messages")
+	}
+	if z.RecentMessage(0).Dest != s.self.address || z.RecentMessage(1).Dest != s.participants[1].address {
+		t.Error("broadcast went to the wrong participants")
+	}
+}
@@ -0,0 +1,95 @@
+package quorum
+
+// For each participant removed for sending no heartbeat, compile() removes
+// evictionsPerInactive more participants, picked at random with the shared
+// entropy, and all of their places are given to the participants waiting to
+// join, in the same compile; see admitJoins. A dishonest majority could
+// otherwise force out an honest participant by ignoring its heartbeats, at no
+// cost to itself; under this rule every such removal is as likely to cost the
+// dishonest participants a place as it is the honest ones. Evicted participants have done nothing wrong, so they are
+// refunded as if they had left.
+const evictionsPerInactive = 2
+
+// turbulenceWindow is the number of recent blocks over which Turbulence
+// counts removals.
+const turbulenceWindow = 32
+
+// A Block records the changes compile() made to the participants of the
+// quorum.
+type Block struct {
+	Height   uint64
+	Tossed   []byte // removed for sending no heartbeat, more than one, or a bad reveal
+	Evicted  []byte // removed at random for the participants that sent none
+	Departed []byte // removed at the end of their hand-off
+
+	// Joins recorded in heartbeats are admitted to free places, or
+	// appointed successors of departing participants; see admitJoins
+	Joined    []byte
+	Appointed []byte
+}
+
+// removed returns the number of participants removed in the block.
+func (b *Block) removed() int {
+	return len(b.Tossed) + len(b.Evicted) + len(b.Departed)
+}
+
+// evictRandom removes n participants picked at random, never picking the
+// same participant twice. The candidates are the participants that held
+// their place when the block began, members, and are not departing: a
+// successor that took its place in this block has had no chance to take
+// part, and a departing participant is leaving anyway, so evicting either
+// would cost the dishonest participants nothing. We are a candidate like any
+// other, as every participant must pick from the same candidates.
+// evictRandom only runs during compile().
+func (s *State) evictRandom(n int, members []*Participant) (evicted []byte) {
+	var candidates []byte
+	for i, p := range s.participants {
+		_, departing := s.departures[byte(i)]
+		if p != nil && p == members[i] && !departing {
+			candidates = append(candidates, byte(i))
+		}
+	}
+
+	for len(evicted) < n && len(candidates) > 0 {
+		j, err := s.randInt(0, len(candidates))
+		if err != nil {
+			return
+		}
+		pi := candidates[j]
+		candidates = append(candidates[:j], candidates[j+1:]...)
+		s.refundDeposit(pi)
+		s.tossParticipant(pi)
+		evicted = append(evicted, pi)
+	}
+	return
+}
+
+// recordBlock adds a block to the recent blocks, forgetting those older than
+// the turbulence window. recordBlock only runs during compile().
+func (s *State) recordBlock(b Block) {
+	s.recentBlocks = append(s.recentBlocks, b)
+	if len(s.recentBlocks) > turbulenceWindow {
+		s.recentBlocks = s.recentBlocks[len(s.recentBlocks)-turbulenceWindow:]
+	}
+}
+
+// LastBlock returns the changes made by the most recently compiled block.
+func (s *State) LastBlock() (b Block) {
+	s.participantsLock.RLock()
+	defer s.participantsLock.RUnlock()
+	if len(s.recentBlocks) == 0 {
+		return
+	}
+	return s.recentBlocks[len(s.recentBlocks)-1]
+}
+
+// Turbulence returns the number of participants removed from the quorum, for
+// any reason, over the recent blocks.
+func (s *State) Turbulence() (removed int) {
+	s.participantsLock.RLock()
+	defer s.participantsLock.RUnlock()
+	for i := range s.recentBlocks {
+		removed += s.recentBlocks[i].removed()
+	}
+	return
+}
@@ -0,0 +1,135 @@
+package quorum
+
+import (
+	"common"
+	"common/crypto"
+	"testing"
+)
+
+// Each participant that sends no heartbeat takes two more with it, picked
+// the same way by every participant.
+func TestEvictForInactivity(t *testing.T) {
+	var states []*State
+	for i := 0; i < 2; i++ {
+		_, secKey, err := crypto.CreateKeyPair()
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := CreateStateWithConfig(common.NewZeroNetwork(), secKey, sizedConfig(10))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fillQuorum(s)
+		states = append(states, s)
+	}
+	for _, s := range states {
+		compileBlock(s, nil, []byte{3}, nil)
+	}
+
+	b := states[0].LastBlock()
+	if len(b.Tossed) != 1 || b.Tossed[0] != 3 {
+		t.Error("inactive participant was not tossed:", b.Tossed)
+	}
+	if len(b.Evicted) != evictionsPerInactive {
+		t.Fatal("expected 2 evictions, got", b.Evicted)
+	}
+	if b.Evicted[0] == b.Evicted[1] || b.Evicted[0] == 3 || b.Evicted[1] == 3 {
+		t.Error("evicted a participant twice:", b.Evicted)
+	}
+	for _, pi := range b.Evicted {
+		if states[0].participants[pi] != nil {
+			t.Error("evicted participant is still in the quorum")
+		}
+	}
+	other := states[1].LastBlock()
+	if len(other.Evicted) != 2 || other.Evicted[0] != b.Evicted[0] || other.Evicted[1] != b.Evicted[1] {
+		t.Error("states evicted different participants:", b.Evicted, other.Evicted)
+	}
+	if states[0].Turbulence() != 3 {
+		t.Error("expected turbulence of 3, got", states[0].Turbulence())
+	}
+}
+
+// Evictions pass over participants that took their place in this block and
+// those departing, and every removed place is refilled from the participants
+// waiting to join.
+func TestEvictionCandidates(t *testing.T) {
+	_, secKey, err := crypto.CreateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := CreateStateWithConfig(common.NewZeroNetwork(), secKey, sizedConfig(6))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fillQuorum(s)
+	members := append([]*Participant(nil), s.participants...)
+	s.participants[1] = &Participant{index: 1}
+	s.departures[2] = 1
+	evicted := s.evictRandom(s.quorumSize, members)
+	if len(evicted) != s.quorumSize-2 {
+		t.Fatal("wrong participants evicted:", evicted)
+	}
+	for _, pi := range evicted {
+		if pi == 1 || pi == 2 {
+			t.Error("evicted a participant that is not a candidate:", pi)
+		}
+	}
+	if s.participants[1] == nil || s.participants[2] == nil {
+		t.Error("a participant that is not a candidate was removed")
+	}
+
+	// an inactive participant and the two evicted with it are replaced
+	s, err = CreateStateWithConfig(common.NewZeroNetwork(), secKey, sizedConfig(6))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fillQuorum(s)
+	for i := 0; i < 4; i++ {
+		pubKey, _, err := crypto.CreateKeyPair()
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.waiting = append(s.waiting, &Participant{index: 255, publicKey: pubKey})
+	}
+	compileBlock(s, nil, []byte{3}, nil)
+	b := s.LastBlock()
+	if b.removed() != 3 || len(b.Joined) != 3 {
+		t.Fatal("removed places were not refilled:", b)
+	}
+	for i, p := range s.participants {
+		if p == nil {
+			t.Error("place", i, "was left empty")
+		}
+	}
+	if len(s.waiting) != 1 {
+		t.Error("expected one participant still waiting, got", len(s.waiting))
+	}
+}
+
+// Only inactivity triggers evictions, and turbulence counts removals over
+// the recent blocks only.
+func TestTurbulence(t *testing.T) {
+	s, err := CreateState(common.NewZeroNetwork())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fillQuorum(s)
+	compileBlock(s, nil, nil, []byte{1})
+	if b := s.LastBlock(); len(b.Tossed) != 1 || len(b.Evicted) != 0 || b.Height != 1 {
+		t.Error("sending two heartbeats triggered evictions:", b)
+	}
+	if s.Turbulence() != 1 {
+		t.Error("expected turbulence of 1, got", s.Turbulence())
+	}
+
+	for i := 0; i < turbulenceWindow; i++ {
+		compileBlock(s, nil, nil, nil)
+	}
+	if s.Turbulence() != 0 {
+		t.Error("turbulence counted a block outside the window")
+	}
+	if len(s.recentBlocks) != turbulenceWindow {
+		t.Error("recent blocks were not forgotten:", len(s.recentBlocks))
+	}
+}
@@ -0,0 +1,75 @@
+package quorum
+
+import (
+	"common"
+	"common/crypto"
+	"errors"
+)
+
+// Each heartbeat reveals the entropy its participant committed to in its
+// previous heartbeat, and commits to the entropy it will reveal in the next.
+// A participant therefore chooses its entropy a block before it learns the
+// entropy of anyone else, and cannot grind its value to bias the block. A
+// participant whose reveal does not match its commitment loses its down
+// payment and is removed, as is one that reveals nothing by sending no
+// heartbeat; withholding a reveal to bias the block costs a place.
+//
+// A heartbeat with an empty commitment contributes no entropy to the next
+// block. The first heartbeat of a new participant has nothing to reveal, so
+// its entropy is not used either.
+
+var rverrBadReveal = errors.New("Revealed entropy does not match the commitment")
+
+// commitTo returns the commitment to entropy.
+func commitTo(entropy common.Entropy) (crypto.TruncatedHash, error) {
+	return crypto.CalculateTruncatedHash(entropy[:])
+}
+
+// nextReveal returns the entropy committed to in our last heartbeat, and a
+// commitment to fresh entropy for our next one. nextReveal only runs when
+// the heartbeat is created, during compile().
+func (s *State) nextReveal() (reveal common.Entropy, commitment crypto.TruncatedHash, err error) {
+	entropy, err := crypto.RandomByteSlice(common.EntropyVolume)
+	if err != nil {
+		return
+	}
+	var next common.Entropy
+	copy(next[:], entropy)
+	commitment, err = commitTo(next)
+	if err != nil {
+		return
+	}
+	reveal = s.committedEntropy
+	s.committedEntropy = next
+	return
+}
+
+// acceptReveal checks the entropy revealed in a heartbeat against the
+// participant's commitment, adds it to the upcoming entropy if it was
+// committed to, and records the commitment for the next block. acceptReveal
+// only runs during compile().
+func (s *State) acceptReveal(pi byte, hb *heartbeat) (err error) {
+	commitment, committed := s.commitments[pi]
+	if committed {
+		var revealed crypto.TruncatedHash
+		revealed, err = commitTo(hb.entropy)
+		if err != nil {
+			return
+		}
+		if revealed != commitment {
+			return rverrBadReveal
+		}
+		var th crypto.TruncatedHash
+		th, err = crypto.CalculateTruncatedHash(append(s.upcomingEntropy[:], hb.entropy[:]...))
+		if err != nil {
+			return
+		}
+		s.upcomingEntropy = common.Entropy(th)
+	}
+
+	delete(s.commitments, pi)
+	if hb.commitment != (crypto.TruncatedHash{}) {
+		s.commitments[pi] = hb.commitment
+	}
+	return
+}
@@ -0,0 +1,103 @@
+package quorum
+
+import (
+	"common"
+	"common/crypto"
+	"testing"
+)
+
+// Each heartbeat reveals the entropy committed to in the one before.
+func TestNextReveal(t *testing.T) {
+	s, err := CreateState(common.NewZeroNetwork())
+	if err != nil {
+		t.Fatal(err)
+	}
+	hb0, err := s.newHeartbeat(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hb0.entropy != (common.Entropy{}) {
+		t.Error("first heartbeat revealed entropy it never committed to")
+	}
+	hb1, err := s.newHeartbeat(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revealed, err := commitTo(hb1.entropy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revealed != hb0.commitment {
+		t.Error("heartbeat did not reveal the entropy it committed to")
+	}
+	if hb1.commitment == hb0.commitment {
+		t.Error("committed to the same entropy twice")
+	}
+}
+
+// A participant that reveals entropy other than what it committed to loses
+// its down payment and its place, and its entropy is not used.
+func TestAcceptReveal(t *testing.T) {
+	_, secKey, err := crypto.CreateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := CreateStateWithConfig(common.NewZeroNetwork(), secKey, depositConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := keyQuorum(t, s)
+	for _, id := range hosts {
+		s.deposits[id] = &deposit{wallet: id, amount: 10}
+	}
+
+	// nothing was committed to in the first block, so nothing is revealed
+	compileBlock(s, nil, nil, nil)
+	if s.upcomingEntropy != (common.Entropy{}) {
+		t.Error("used entropy that was never committed to")
+	}
+	if len(s.commitments) != s.quorumSize {
+		t.Fatal("commitments were not recorded:", len(s.commitments))
+	}
+
+	bad := goldenHeartbeat()
+	bad.entropy[0]++
+	if s.acceptReveal(1, bad) != rverrBadReveal {
+		t.Fatal("accepted a reveal that does not match the commitment")
+	}
+	s.heartbeats[1] = map[crypto.TruncatedHash]*heartbeat{{1}: bad}
+	for _, i := range []int{0, 2, 3} {
+		s.heartbeats[i] = map[crypto.TruncatedHash]*heartbeat{{byte(i)}: goldenHeartbeat()}
+	}
+	s.compile()
+	if s.participants[1] != nil {
+		t.Fatal("participant with a bad reveal was not tossed")
+	}
+	if _, locked := s.Deposit(hosts[1]); locked {
+		t.Error("participant with a bad reveal kept its down payment")
+	}
+	if b := s.LastBlock(); len(b.Tossed) != 1 || b.Tossed[0] != 1 || len(b.Evicted) != 0 {
+		t.Error("bad reveal was not recorded as a toss:", b)
+	}
+	if _, committed := s.commitments[1]; committed {
+		t.Error("commitment of a tossed participant was kept")
+	}
+	if s.upcomingEntropy == (common.Entropy{}) {
+		t.Error("revealed entropy was not used")
+	}
+
+	// an empty commitment contributes nothing to the next block
+	empty := goldenHeartbeat()
+	empty.commitment = crypto.TruncatedHash{}
+	err = s.acceptReveal(2, empty)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, committed := s.commitments[2]; committed {
+		t.Error("empty commitment was recorded")
+	}
+	empty.entropy[0]++
+	if s.acceptReveal(2, empty) != nil {
+		t.Error("checked a reveal that was never committed to")
+	}
+}
@@ -0,0 +1,134 @@
+package quorum
+
+import (
+	"common/crypto"
+)
+
+// Each sector stored on the quorum has a balance of siacoins. Every block,
+// each participant hosting the sector is paid SectorPayout from it. When the
+// balance reaches zero, or can no longer pay every host in full, the hosts
+// split what is left as evenly as they can, and the sector is deleted.
+// Anybody can add to the balance of a sector with a TopUpTransaction, and a
+// top up of a sector the quorum does not know creates it, making its sender
+// the owner of the sector. Only the owner may set its contents.
+//
+// The contents of a sector are set by a SectorUpdate; see update.go.
+type sectorRecord struct {
+	balance    uint64
+	segments   []crypto.Hash       // hash of the segment held by each participant, if known
+	created    bool                // the segments and authorized keys have been set
+	authorized []*crypto.PublicKey // keys that may update the sector; none if immutable
+	revision   uint64              // the number of updates since creation
+	owner      WalletID            // paid for the sector first
+}
+
+// A SectorDeleter is told about segments the quorum no longer stores: those
+// of every sector whose balance runs out, and those replaced by updates, so
+// that the host can remove them from disk.
+type SectorDeleter func(sector crypto.Hash, segments []crypto.Hash)
+
+// SetSectorDeleter sets the function called when segments are dropped.
+func (s *State) SetSectorDeleter(deleter SectorDeleter) {
+	s.walletsLock.Lock()
+	s.sectorDeleter = deleter
+	s.walletsLock.Unlock()
+}
+
+// hostWallets returns the wallet of every participant, in order of index.
+// Every participant hosts a segment of every sector. The caller must hold
+// participantsLock.
+func (s *State) hostWallets() (hosts []WalletID) {
+	for _, p := range s.participants {
+		if p == nil {
+			continue
+		}
+		id, err := NewWalletID(p.publicKey)
+		if err != nil {
+			continue
+		}
+		hosts = append(hosts, id)
+	}
+	return
+}
+
+// dropSegments records segments the quorum no longer stores. The caller
+// must hold walletsLock.
+func (s *State) dropSegments(sector crypto.Hash, segments []crypto.Hash) {
+	for _, segment := range segments {
+		if segment != (crypto.Hash{}) {
+			s.droppedSegments[sector] = append(s.droppedSegments[sector], segment)
+		}
+	}
+}
+
+// paySectors pays the hosts from the balance of every sector, and removes
+// the sectors that have run out. paySectors only runs during compile(), and
+// the caller must hold participantsLock.
+func (s *State) paySectors() {
+	hosts := s.hostWallets()
+	if len(hosts) == 0 {
+		return
+	}
+
+	s.walletsLock.Lock()
+	defer s.walletsLock.Unlock()
+	for hash, sector := range s.sectors {
+		payout := s.sectorPayout
+		if sector.balance/uint64(len(hosts)) < payout {
+			payout = sector.balance / uint64(len(hosts))
+		}
+		sector.balance -= payout * uint64(len(hosts))
+		if payout < s.sectorPayout || sector.balance == 0 {
+			// what is left cannot be divided among the hosts
+			sector.balance = 0
+			s.dropSegments(hash, sector.segments)
+			delete(s.sectors, hash)
+		}
+
+		if payout == 0 {
+			continue
+		}
+		for _, id := range hosts {
+			host := s.wallets[id]
+			if host == nil {
+				host = new(Wallet)
+				s.wallets[id] = host
+			}
+			// saturate rather than overflow, so that the order in which
+			// sectors are paid does not matter
+			if host.balance+payout < host.balance {
+				host.balance = ^uint64(0)
+			} else {
+				host.balance += payout
+			}
+		}
+	}
+}
+
+// releaseSegments tells the SectorDeleter about the segments dropped since
+// it was last called.
+func (s *State) releaseSegments() {
+	s.walletsLock.Lock()
+	deleter := s.sectorDeleter
+	dropped := s.droppedSegments
+	s.droppedSegments = make(map[crypto.Hash][]crypto.Hash)
+	s.walletsLock.Unlock()
+	if deleter == nil {
+		return
+	}
+	for sector, segments := range dropped {
+		deleter(sector, segments)
+	}
+}
+
+// SectorBalance returns the balance of a sector, and whether the quorum
+// stores the sector at all.
+func (s *State) SectorBalance(hash crypto.Hash) (balance uint64, exists bool) {
+	s.walletsLock.RLock()
+	defer s.walletsLock.RUnlock()
+	sector := s.sectors[hash]
+	if sector == nil {
+		return
+	}
+	return sector.balance, true
+}
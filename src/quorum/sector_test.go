@@ -0,0 +1,131 @@
+package quorum
+
+import (
+	"common"
+	"common/crypto"
+	"testing"
+)
+
+// keyQuorum gives s a full quorum of participants that have public keys, and
+// returns the wallet of each.
+func keyQuorum(t *testing.T, s *State) (hosts []WalletID) {
+	fillQuorum(s)
+	for _, p := range s.participants {
+		pubKey, _, err := crypto.CreateKeyPair()
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.publicKey = pubKey
+		id, err := NewWalletID(pubKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hosts = append(hosts, id)
+	}
+	return
+}
+
+// Anybody can top up a sector, creating it if it is new.
+func TestTopUp(t *testing.T) {
+	s, err := CreateState(common.NewZeroNetwork())
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, aKey := newTestWallet(t, s, 100)
+	sector := crypto.Hash{1}
+
+	tx, err := NewTopUp(aKey, sector, 30, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.applyTransaction(tx); err != nil {
+		t.Fatal(err)
+	}
+	tx, err = NewTopUp(aKey, sector, 20, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.applyTransaction(tx); err != nil {
+		t.Fatal(err)
+	}
+	if balance, exists := s.SectorBalance(sector); !exists || balance != 50 {
+		t.Error("sector balance is wrong:", balance, exists)
+	}
+	if balance, nonce := s.Balance(a); balance != 50 || nonce != 2 {
+		t.Error("wallet is wrong after top ups:", balance, nonce)
+	}
+
+	// the first to pay for a sector owns it, whoever pays for it later
+	b, bKey := newTestWallet(t, s, 100)
+	tx, err = NewTopUp(bKey, sector, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.applyTransaction(tx); err != nil {
+		t.Fatal(err)
+	}
+	if owner := s.sectors[sector].owner; owner != a || owner == b {
+		t.Error("sector is not owned by the wallet that paid for it first")
+	}
+
+	// top ups are signed like any other transaction
+	tx.Sector = crypto.Hash{2}
+	if s.applyTransaction(tx) != txerrInvalidSignature {
+		t.Error("altered top up was accepted")
+	}
+}
+
+func TestPaySectors(t *testing.T) {
+	s, err := CreateState(common.NewZeroNetwork())
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := keyQuorum(t, s)
+	var deletedSectors []crypto.Hash
+	s.SetSectorDeleter(func(sector crypto.Hash, segments []crypto.Hash) {
+		if sector != (crypto.Hash{1}) && (len(segments) != 1 || segments[0] != crypto.Hash{9}) {
+			t.Error("deleter was not given the segments:", segments)
+		}
+		deletedSectors = append(deletedSectors, sector)
+	})
+
+	// each host is paid SectorPayout per sector; a sector that pays out its
+	// last coin is deleted, and a sector that cannot pay every host is
+	// deleted without paying
+	s.sectors[crypto.Hash{1}] = &sectorRecord{balance: 10}
+	s.sectors[crypto.Hash{2}] = &sectorRecord{balance: 4, segments: []crypto.Hash{{9}}}
+	s.sectors[crypto.Hash{3}] = &sectorRecord{balance: 3, segments: []crypto.Hash{{9}}}
+	s.paySectors()
+	s.releaseSegments()
+
+	if balance, exists := s.SectorBalance(crypto.Hash{1}); !exists || balance != 6 {
+		t.Error("sector was not debited:", balance, exists)
+	}
+	for _, host := range hosts {
+		if balance, _ := s.Balance(host); balance != 2 {
+			t.Error("host was paid", balance)
+		}
+	}
+	if len(deletedSectors) != 2 {
+		t.Fatal("expected 2 sectors to be deleted, got", len(deletedSectors))
+	}
+	for _, sector := range []crypto.Hash{{2}, {3}} {
+		if _, exists := s.SectorBalance(sector); exists {
+			t.Error("sector that ran out was not deleted")
+		}
+	}
+
+	// the hosts cannot split 6 coins in full twice
+	s.paySectors()
+	s.releaseSegments()
+	s.paySectors()
+	s.releaseSegments()
+	if _, exists := s.SectorBalance(crypto.Hash{1}); exists {
+		t.Error("sector that ran out was not deleted")
+	}
+	for _, host := range hosts {
+		if balance, _ := s.Balance(host); balance != 3 {
+			t.Error("host was paid", balance)
+		}
+	}
+}
@@ -0,0 +1,547 @@
+package quorum
+
+import (
+	"bytes"
+	"common"
+	"common/crypto"
+	"common/encoding"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// A participant that takes its place in the quorum, whether admitted to a
+// free place or installed as a successor, has compiled none of the blocks
+// before it, so it cannot rebuild the wallets, sectors and down payments
+// they changed from the Genesis alone. At the end of the compile that gives
+// it its place, every participant sends it a Snapshot of the agreed state,
+// and it adopts the first that gives it a place, as it used to take the
+// first introduction. The local state of the sender, such as its pending
+// transactions and the segments handed off to it, is not part of a
+// Snapshot.
+type Snapshot struct {
+	height          uint64
+	currentEntropy  common.Entropy
+	upcomingEntropy common.Entropy
+	stepDuration    time.Duration
+
+	participants []*Participant // quorumSize long, nil for each free place
+	newcomers    []byte         // took their place in this compile, and send no heartbeat in their first block
+	departures   map[byte]uint64
+	successors   map[byte]*Participant
+	waiting      []*Participant
+	commitments  map[byte]crypto.TruncatedHash
+
+	wallets  map[WalletID]*Wallet
+	sectors  map[crypto.Hash]*sectorRecord
+	deposits map[WalletID]*deposit
+	refunds  []*deposit
+}
+
+var snerrQuorumSize = errors.New("Snapshot is of a quorum of another size")
+var snerrNoPlace = errors.New("Snapshot does not give us a place")
+
+// takeSnapshot copies the agreed state. The caller must hold
+// participantsLock and heartbeatsLock, and takeSnapshot only runs at the end
+// of compile(), when the stepLock is held.
+func (s *State) takeSnapshot() (snapshot *Snapshot) {
+	snapshot = &Snapshot{
+		height:          s.height,
+		currentEntropy:  s.currentEntropy,
+		upcomingEntropy: s.upcomingEntropy,
+		stepDuration:    s.stepDuration,
+		departures:      make(map[byte]uint64),
+		successors:      make(map[byte]*Participant),
+		commitments:     make(map[byte]crypto.TruncatedHash),
+		wallets:         make(map[WalletID]*Wallet),
+		sectors:         make(map[crypto.Hash]*sectorRecord),
+		deposits:        make(map[WalletID]*deposit),
+	}
+	for i, p := range s.participants {
+		if p == nil {
+			snapshot.participants = append(snapshot.participants, nil)
+			continue
+		}
+		participant := *p
+		snapshot.participants = append(snapshot.participants, &participant)
+		if _, fresh := s.heartbeats[i][emptyHash]; fresh {
+			snapshot.newcomers = append(snapshot.newcomers, byte(i))
+		}
+	}
+	for pi, remaining := range s.departures {
+		snapshot.departures[pi] = remaining
+	}
+	for pi, p := range s.successors {
+		successor := *p
+		snapshot.successors[pi] = &successor
+	}
+	for _, p := range s.waiting {
+		joiner := *p
+		snapshot.waiting = append(snapshot.waiting, &joiner)
+	}
+	for pi, commitment := range s.commitments {
+		snapshot.commitments[pi] = commitment
+	}
+
+	s.walletsLock.RLock()
+	defer s.walletsLock.RUnlock()
+	for id, w := range s.wallets {
+		wallet := *w
+		snapshot.wallets[id] = &wallet
+	}
+	for hash, r := range s.sectors {
+		record := *r
+		record.segments = append([]crypto.Hash(nil), r.segments...)
+		record.authorized = append([]*crypto.PublicKey(nil), r.authorized...)
+		snapshot.sectors[hash] = &record
+	}
+	for id, d := range s.deposits {
+		locked := *d
+		snapshot.deposits[id] = &locked
+	}
+	for _, d := range s.refunds {
+		refund := *d
+		snapshot.refunds = append(snapshot.refunds, &refund)
+	}
+	return
+}
+
+// sendSnapshots sends each participant that took its place in this compile
+// the agreed state it joins in. sendSnapshots only runs at the end of
+// compile().
+func (s *State) sendSnapshots() {
+	s.participantsLock.Lock()
+	s.heartbeatsLock.Lock()
+	admitted := s.admitted
+	s.admitted = nil
+	var snapshot *Snapshot
+	if len(admitted) != 0 {
+		snapshot = s.takeSnapshot()
+	}
+	s.heartbeatsLock.Unlock()
+	s.participantsLock.Unlock()
+
+	for _, p := range admitted {
+		s.messageRouter.SendAsyncMessage(&common.Message{
+			Dest: p.address,
+			Proc: "State.HandleSnapshot",
+			Args: *snapshot,
+			Resp: nil,
+		})
+	}
+}
+
+// HandleSnapshot adopts the agreed state of a quorum that has given us a
+// place, and starts ticking. Once we are ticking, later snapshots are
+// ignored.
+func (s *State) HandleSnapshot(snapshot Snapshot, arb *struct{}) (err error) {
+	if len(snapshot.participants) != s.quorumSize {
+		return snerrQuorumSize
+	}
+	index := -1
+	for i, p := range snapshot.participants {
+		if p != nil && p.publicKey.Compare(s.self.publicKey) {
+			index = i
+		}
+	}
+	if index == -1 {
+		return snerrNoPlace
+	}
+
+	s.stepLock.Lock()
+	defer s.stepLock.Unlock()
+	s.tickingLock.Lock()
+	ticking := s.ticking
+	s.tickingLock.Unlock()
+	if ticking {
+		return
+	}
+	if snapshot.stepDuration < s.minStep || snapshot.stepDuration > s.maxStep {
+		return fmt.Errorf("Cannot join a quorum with a step of %v, outside %v to %v", snapshot.stepDuration, s.minStep, s.maxStep)
+	}
+	s.stepDuration = snapshot.stepDuration
+	s.height = snapshot.height
+	s.currentEntropy = snapshot.currentEntropy
+	s.upcomingEntropy = snapshot.upcomingEntropy
+	s.random = common.NewRandomStream(s.currentEntropy)
+
+	// the newcomers, ourselves included, get the default heartbeat for
+	// their first block, as in admitJoins
+	s.participantsLock.Lock()
+	s.heartbeatsLock.Lock()
+	copy(s.participants, snapshot.participants)
+	s.self.index = byte(index)
+	s.participants[index] = s.self
+	for i := range s.heartbeats {
+		s.heartbeats[i] = nil
+		if s.participants[i] != nil {
+			s.heartbeats[i] = make(map[crypto.TruncatedHash]*heartbeat)
+		}
+	}
+	for _, pi := range snapshot.newcomers {
+		if int(pi) < s.quorumSize && s.heartbeats[pi] != nil {
+			s.heartbeats[pi][emptyHash] = new(heartbeat)
+		}
+	}
+	s.departures = snapshot.departures
+	s.successors = snapshot.successors
+	s.waiting = snapshot.waiting
+	s.commitments = snapshot.commitments
+
+	s.walletsLock.Lock()
+	s.wallets = snapshot.wallets
+	s.sectors = snapshot.sectors
+	s.deposits = snapshot.deposits
+	s.refunds = snapshot.refunds
+	s.walletsLock.Unlock()
+	s.heartbeatsLock.Unlock()
+	s.participantsLock.Unlock()
+
+	s.tickingLock.Lock()
+	s.ticking = true
+	s.tickingLock.Unlock()
+	go s.tick()
+	return
+}
+
+// EncodeTo writes the canonical encoding of the snapshot. Each map is
+// written as a list in increasing order of its keys:
+//
+//	height          uint64
+//	currentEntropy  [EntropyVolume]byte
+//	upcomingEntropy [EntropyVolume]byte
+//	stepDuration    uint32, in ms
+//	participants    []optional Participant, each preceded by a bool
+//	newcomers       []byte
+//	departures      []struct{ index byte; remaining uint64 }
+//	successors      []Participant, keyed by their index
+//	waiting         []Participant
+//	commitments     []struct{ index byte; commitment [TruncatedHashSize]byte }
+//	wallets         []struct{ id [TruncatedHashSize]byte; balance, nonce uint64 }
+//	sectors         []struct{ hash [HashSize]byte; sector }
+//	deposits        []deposit, keyed by their wallet
+//	refunds         []deposit
+//
+// where a sector is
+//
+//	balance    uint64
+//	segments   [][HashSize]byte
+//	created    bool
+//	authorized []crypto.PublicKey
+//	revision   uint64
+//	owner      [TruncatedHashSize]byte
+//
+// and a deposit is
+//
+//	wallet  [TruncatedHashSize]byte
+//	amount  uint64
+//	release uint64
+func (snapshot *Snapshot) EncodeTo(e *encoding.Encoder) {
+	e.WriteUint64(snapshot.height)
+	e.WriteFixed(snapshot.currentEntropy[:])
+	e.WriteFixed(snapshot.upcomingEntropy[:])
+	e.WriteUint32(uint32(snapshot.stepDuration / time.Millisecond))
+
+	e.WriteLength(len(snapshot.participants))
+	for _, p := range snapshot.participants {
+		e.WriteBool(p != nil)
+		if p != nil {
+			p.EncodeTo(e)
+		}
+	}
+	e.WriteBytes(snapshot.newcomers)
+	var indices []byte
+	for pi := range snapshot.departures {
+		indices = append(indices, pi)
+	}
+	sortIndices(indices)
+	e.WriteLength(len(indices))
+	for _, pi := range indices {
+		e.WriteUint8(pi)
+		e.WriteUint64(snapshot.departures[pi])
+	}
+	var successors []byte
+	for pi := range snapshot.successors {
+		successors = append(successors, pi)
+	}
+	sortIndices(successors)
+	e.WriteLength(len(successors))
+	for _, pi := range successors {
+		snapshot.successors[pi].EncodeTo(e)
+	}
+	e.WriteLength(len(snapshot.waiting))
+	for _, p := range snapshot.waiting {
+		p.EncodeTo(e)
+	}
+	var committed []byte
+	for pi := range snapshot.commitments {
+		committed = append(committed, pi)
+	}
+	sortIndices(committed)
+	e.WriteLength(len(committed))
+	for _, pi := range committed {
+		commitment := snapshot.commitments[pi]
+		e.WriteUint8(pi)
+		e.WriteFixed(commitment[:])
+	}
+
+	var ids []WalletID
+	for id := range snapshot.wallets {
+		ids = append(ids, id)
+	}
+	sortWalletIDs(ids)
+	e.WriteLength(len(ids))
+	for _, id := range ids {
+		e.WriteFixed(id[:])
+		e.WriteUint64(snapshot.wallets[id].balance)
+		e.WriteUint64(snapshot.wallets[id].nonce)
+	}
+	var hashes []crypto.Hash
+	for hash := range snapshot.sectors {
+		hashes = append(hashes, hash)
+	}
+	sort.Slice(hashes, func(i, j int) bool { return bytes.Compare(hashes[i][:], hashes[j][:]) < 0 })
+	e.WriteLength(len(hashes))
+	for _, hash := range hashes {
+		e.WriteFixed(hash[:])
+		encodeSector(e, snapshot.sectors[hash])
+	}
+	ids = nil
+	for id := range snapshot.deposits {
+		ids = append(ids, id)
+	}
+	sortWalletIDs(ids)
+	e.WriteLength(len(ids))
+	for _, id := range ids {
+		encodeDeposit(e, snapshot.deposits[id])
+	}
+	e.WriteLength(len(snapshot.refunds))
+	for _, d := range snapshot.refunds {
+		encodeDeposit(e, d)
+	}
+}
+
+// DecodeFrom reads a snapshot written by EncodeTo, rejecting maps whose keys
+// are not in increasing order, as they are not canonical.
+func (snapshot *Snapshot) DecodeFrom(d *encoding.Decoder) {
+	snapshot.height = d.ReadUint64()
+	d.ReadFixed(snapshot.currentEntropy[:])
+	d.ReadFixed(snapshot.upcomingEntropy[:])
+	snapshot.stepDuration = time.Duration(d.ReadUint32()) * time.Millisecond
+
+	n := d.ReadLength()
+	if n > common.MaxQuorumSize {
+		d.Fail(fmt.Errorf("snapshot has %v participants, more than the maximum of %v", n, common.MaxQuorumSize))
+		return
+	}
+	snapshot.participants = nil
+	for i := 0; i < n && d.Err() == nil; i++ {
+		var p *Participant
+		if d.ReadBool() {
+			p = new(Participant)
+			p.DecodeFrom(d)
+		}
+		snapshot.participants = append(snapshot.participants, p)
+	}
+	snapshot.newcomers = d.ReadBytes()
+	n = d.ReadLength()
+	snapshot.departures = make(map[byte]uint64)
+	previous := -1
+	for i := 0; i < n && d.Err() == nil; i++ {
+		pi := d.ReadUint8()
+		if int(pi) <= previous {
+			d.Fail(errUnsortedSnapshot)
+			return
+		}
+		previous = int(pi)
+		snapshot.departures[pi] = d.ReadUint64()
+	}
+	n = d.ReadLength()
+	snapshot.successors = make(map[byte]*Participant)
+	previous = -1
+	for i := 0; i < n && d.Err() == nil; i++ {
+		p := new(Participant)
+		p.DecodeFrom(d)
+		if int(p.index) <= previous {
+			d.Fail(errUnsortedSnapshot)
+			return
+		}
+		previous = int(p.index)
+		snapshot.successors[p.index] = p
+	}
+	n = d.ReadLength()
+	snapshot.waiting = nil
+	for i := 0; i < n && d.Err() == nil; i++ {
+		p := new(Participant)
+		p.DecodeFrom(d)
+		snapshot.waiting = append(snapshot.waiting, p)
+	}
+	n = d.ReadLength()
+	snapshot.commitments = make(map[byte]crypto.TruncatedHash)
+	previous = -1
+	for i := 0; i < n && d.Err() == nil; i++ {
+		pi := d.ReadUint8()
+		if int(pi) <= previous {
+			d.Fail(errUnsortedSnapshot)
+			return
+		}
+		previous = int(pi)
+		var commitment crypto.TruncatedHash
+		d.ReadFixed(commitment[:])
+		snapshot.commitments[pi] = commitment
+	}
+
+	n = d.ReadLength()
+	snapshot.wallets = make(map[WalletID]*Wallet)
+	var previousID []byte
+	for i := 0; i < n && d.Err() == nil; i++ {
+		var id WalletID
+		d.ReadFixed(id[:])
+		if previousID != nil && bytes.Compare(id[:], previousID) <= 0 {
+			d.Fail(errUnsortedSnapshot)
+			return
+		}
+		previousID = id[:]
+		w := new(Wallet)
+		w.balance = d.ReadUint64()
+		w.nonce = d.ReadUint64()
+		snapshot.wallets[id] = w
+	}
+	n = d.ReadLength()
+	snapshot.sectors = make(map[crypto.Hash]*sectorRecord)
+	var previousHash []byte
+	for i := 0; i < n && d.Err() == nil; i++ {
+		var hash crypto.Hash
+		d.ReadFixed(hash[:])
+		if previousHash != nil && bytes.Compare(hash[:], previousHash) <= 0 {
+			d.Fail(errUnsortedSnapshot)
+			return
+		}
+		previousHash = hash[:]
+		snapshot.sectors[hash] = decodeSector(d)
+	}
+	n = d.ReadLength()
+	snapshot.deposits = make(map[WalletID]*deposit)
+	previousID = nil
+	for i := 0; i < n && d.Err() == nil; i++ {
+		locked := decodeDeposit(d)
+		if previousID != nil && bytes.Compare(locked.wallet[:], previousID) <= 0 {
+			d.Fail(errUnsortedSnapshot)
+			return
+		}
+		previousID = locked.wallet[:]
+		snapshot.deposits[locked.wallet] = locked
+	}
+	n = d.ReadLength()
+	snapshot.refunds = nil
+	for i := 0; i < n && d.Err() == nil; i++ {
+		snapshot.refunds = append(snapshot.refunds, decodeDeposit(d))
+	}
+}
+
+var errUnsortedSnapshot = errors.New("snapshot lists keys out of order")
+
+func sortIndices(indices []byte) {
+	sort.Slice(indices, func(i, j int) bool { return indices[i] < indices[j] })
+}
+
+func sortWalletIDs(ids []WalletID) {
+	sort.Slice(ids, func(i, j int) bool { return bytes.Compare(ids[i][:], ids[j][:]) < 0 })
+}
+
+func encodeSector(e *encoding.Encoder, r *sectorRecord) {
+	e.WriteUint64(r.balance)
+	e.WriteLength(len(r.segments))
+	for i := range r.segments {
+		e.WriteFixed(r.segments[i][:])
+	}
+	e.WriteBool(r.created)
+	e.WriteLength(len(r.authorized))
+	for _, pk := range r.authorized {
+		pk.EncodeTo(e)
+	}
+	e.WriteUint64(r.revision)
+	e.WriteFixed(r.owner[:])
+}
+
+func decodeSector(d *encoding.Decoder) (r *sectorRecord) {
+	r = new(sectorRecord)
+	r.balance = d.ReadUint64()
+	n := d.ReadLength()
+	if n > common.MaxQuorumSize {
+		d.Fail(fmt.Errorf("sector has %v segments, more than the maximum of %v", n, common.MaxQuorumSize))
+		return
+	}
+	for i := 0; i < n && d.Err() == nil; i++ {
+		var segment crypto.Hash
+		d.ReadFixed(segment[:])
+		r.segments = append(r.segments, segment)
+	}
+	r.created = d.ReadBool()
+	n = d.ReadLength()
+	for i := 0; i < n && d.Err() == nil; i++ {
+		pk := new(crypto.PublicKey)
+		pk.DecodeFrom(d)
+		r.authorized = append(r.authorized, pk)
+	}
+	r.revision = d.ReadUint64()
+	d.ReadFixed(r.owner[:])
+	return
+}
+
+func encodeDeposit(e *encoding.Encoder, locked *deposit) {
+	e.WriteFixed(locked.wallet[:])
+	e.WriteUint64(locked.amount)
+	e.WriteUint64(locked.release)
+}
+
+func decodeDeposit(d *encoding.Decoder) (locked *deposit) {
+	locked = new(deposit)
+	d.ReadFixed(locked.wallet[:])
+	locked.amount = d.ReadUint64()
+	locked.release = d.ReadUint64()
+	return
+}
+
+func (snapshot *Snapshot) GobEncode() ([]byte, error) {
+	return snapshot.EncodeVersion(common.ProtocolVersion)
+}
+
+func (snapshot *Snapshot) EncodeVersion(version uint16) (gobSnapshot []byte, err error) {
+	if snapshot == nil {
+		err = fmt.Errorf("Cannot encode nil value snapshot")
+		return
+	}
+	var encoded []byte
+	switch version {
+	case 15:
+		encoded, err = encoding.Marshal(snapshot)
+	default:
+		err = fmt.Errorf("Cannot encode a Snapshot at version %v", version)
+	}
+	if err != nil {
+		return
+	}
+	gobSnapshot = common.VersionedEnvelope(version, encoded)
+	return
+}
+
+func (snapshot *Snapshot) GobDecode(gobSnapshot []byte) (err error) {
+	if snapshot == nil {
+		err = fmt.Errorf("Cannot decode into nil Snapshot")
+		return
+	}
+
+	version, body, err := common.OpenEnvelope(gobSnapshot)
+	if err != nil {
+		return
+	}
+	switch version {
+	case 15:
+		err = encoding.Unmarshal(body, snapshot)
+	default:
+		err = fmt.Errorf("Cannot decode a Snapshot of version %v", version)
+	}
+	return
+}
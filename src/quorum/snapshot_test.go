@@ -0,0 +1,173 @@
+package quorum
+
+import (
+	"common"
+	"common/crypto"
+	"common/encoding"
+	"testing"
+)
+
+// keyedParticipant returns a participant at index with a fresh key.
+func keyedParticipant(t *testing.T, index byte) *Participant {
+	pubKey, _, err := crypto.CreateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Participant{index: index, address: common.Address{ID: common.Identifier(index)}, publicKey: pubKey}
+}
+
+// A snapshot carries every part of the agreed state through its encoding.
+func TestSnapshotEncoding(t *testing.T) {
+	s, err := CreateStateWithConfig(common.NewZeroNetwork(), crypto.SecretKey{}, sizedConfig(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.participants[0] = keyedParticipant(t, 0)
+	s.participants[2] = keyedParticipant(t, 2)
+	s.heartbeats[2] = map[crypto.TruncatedHash]*heartbeat{emptyHash: new(heartbeat)}
+	s.height = 7
+	s.upcomingEntropy[0] = 1
+	s.departures[0] = 3
+	s.successors[0] = keyedParticipant(t, 0)
+	s.waiting = []*Participant{keyedParticipant(t, 255)}
+	s.commitments[2] = crypto.TruncatedHash{9}
+	s.wallets[WalletID{1}] = &Wallet{balance: 5, nonce: 2}
+	s.wallets[WalletID{2}] = &Wallet{balance: 6}
+	s.sectors[crypto.Hash{1}] = &sectorRecord{
+		balance:    40,
+		segments:   []crypto.Hash{{5}, {6}, {}, {}},
+		created:    true,
+		authorized: []*crypto.PublicKey{s.participants[0].publicKey},
+		revision:   1,
+		owner:      WalletID{4},
+	}
+	s.sectors[crypto.Hash{2}] = &sectorRecord{balance: 3}
+	s.deposits[WalletID{1}] = &deposit{wallet: WalletID{1}, amount: 10}
+	s.refunds = []*deposit{{wallet: WalletID{3}, amount: 10, release: 9}}
+
+	snapshot := s.takeSnapshot()
+	gobSnapshot, err := snapshot.GobEncode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Snapshot
+	err = decoded.GobDecode(gobSnapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.height != 7 || decoded.upcomingEntropy != s.upcomingEntropy || decoded.stepDuration != s.stepDuration {
+		t.Error("snapshot changed the height or entropy in encoding")
+	}
+	if len(decoded.participants) != 4 || decoded.participants[1] != nil || !decoded.participants[2].compare(s.participants[2]) {
+		t.Error("snapshot changed the participants in encoding:", decoded.participants)
+	}
+	if len(decoded.newcomers) != 1 || decoded.newcomers[0] != 2 {
+		t.Error("snapshot changed the newcomers in encoding:", decoded.newcomers)
+	}
+	if decoded.departures[0] != 3 || !decoded.successors[0].compare(s.successors[0]) || !decoded.waiting[0].compare(s.waiting[0]) {
+		t.Error("snapshot changed the departures or joins in encoding")
+	}
+	if decoded.commitments[2] != (crypto.TruncatedHash{9}) {
+		t.Error("snapshot changed the commitments in encoding")
+	}
+	if w := decoded.wallets[WalletID{1}]; w == nil || *w != (Wallet{balance: 5, nonce: 2}) || len(decoded.wallets) != 2 {
+		t.Error("snapshot changed the wallets in encoding")
+	}
+	r := decoded.sectors[crypto.Hash{1}]
+	if r == nil || r.balance != 40 || r.segments[1] != (crypto.Hash{6}) || !r.created || r.revision != 1 || r.owner != (WalletID{4}) || !r.authorized[0].Compare(s.participants[0].publicKey) {
+		t.Error("snapshot changed the sectors in encoding")
+	}
+	if r = decoded.sectors[crypto.Hash{2}]; r == nil || r.created || r.balance != 3 {
+		t.Error("snapshot changed a sector that was paid for but not created")
+	}
+	if d := decoded.deposits[WalletID{1}]; d == nil || d.amount != 10 || len(decoded.refunds) != 1 || *decoded.refunds[0] != *s.refunds[0] {
+		t.Error("snapshot changed the down payments in encoding")
+	}
+
+	// the snapshot is a copy, which later compiles do not change
+	s.wallets[WalletID{1}].balance = 0
+	s.sectors[crypto.Hash{1}].segments[0] = crypto.Hash{}
+	if snapshot.wallets[WalletID{1}].balance != 5 || snapshot.sectors[crypto.Hash{1}].segments[0] != (crypto.Hash{5}) {
+		t.Error("snapshot shares state with the State it was taken from")
+	}
+
+	// maps must be listed in order, and the previous version has no snapshot
+	e := new(encoding.Encoder)
+	e.WriteUint64(0)
+	e.WriteFixed(make([]byte, 2*common.EntropyVolume))
+	e.WriteUint32(1000)
+	e.WriteLength(0)
+	e.WriteBytes(nil)
+	e.WriteLength(2)
+	e.WriteUint8(2)
+	e.WriteUint64(1)
+	e.WriteUint8(1)
+	e.WriteUint64(1)
+	if encoding.Unmarshal(e.Bytes(), new(Snapshot)) != errUnsortedSnapshot {
+		t.Error("decoded departures listed out of order")
+	}
+	if _, err = snapshot.EncodeVersion(common.MinProtocolVersion); err == nil {
+		t.Error("encoded a snapshot at a version without them")
+	}
+}
+
+// A joiner adopts the first snapshot that gives it a place, and ignores
+// those that follow.
+func TestHandleSnapshot(t *testing.T) {
+	s, err := CreateStateWithConfig(common.NewZeroNetwork(), crypto.SecretKey{}, sizedConfig(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.participants[0] = keyedParticipant(t, 0)
+	joiner, err := CreateStateWithConfig(common.NewZeroNetwork(), crypto.SecretKey{}, sizedConfig(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, joiner.secretKey, err = crypto.CreateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	joiner.self.publicKey = joiner.secretKey.Public()
+
+	snapshot := s.takeSnapshot()
+	if joiner.HandleSnapshot(*snapshot, nil) != snerrNoPlace {
+		t.Error("adopted a snapshot that gives us no place")
+	}
+	other, err := CreateStateWithConfig(common.NewZeroNetwork(), crypto.SecretKey{}, sizedConfig(5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if joiner.HandleSnapshot(*other.takeSnapshot(), nil) != snerrQuorumSize {
+		t.Error("adopted a snapshot of a quorum of another size")
+	}
+
+	joined := *joiner.self
+	joined.index = 3
+	s.participants[3] = &joined
+	s.heartbeats[3] = map[crypto.TruncatedHash]*heartbeat{emptyHash: new(heartbeat)}
+	s.wallets[WalletID{1}] = &Wallet{balance: 5}
+	s.height = 4
+	err = joiner.HandleSnapshot(*s.takeSnapshot(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	joiner.stepLock.Lock()
+	if joiner.self.index != 3 || joiner.participants[3] != joiner.self || !joiner.participants[0].compare(s.participants[0]) {
+		t.Error("joiner did not take its place from the snapshot")
+	}
+	if len(joiner.heartbeats[3]) != 1 || len(joiner.heartbeats[0]) != 0 {
+		t.Error("only the newcomers should have a default heartbeat")
+	}
+	if joiner.height != 4 || joiner.wallets[WalletID{1}].balance != 5 {
+		t.Error("joiner did not take the state of the snapshot")
+	}
+	joiner.stepLock.Unlock()
+
+	s.height = 5
+	err = joiner.HandleSnapshot(*s.takeSnapshot(), nil)
+	joiner.stepLock.Lock()
+	if err != nil || joiner.height != 4 {
+		t.Error("a second snapshot was adopted:", err)
+	}
+	joiner.stepLock.Unlock()
+}
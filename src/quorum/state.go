@@ -1,13 +1,13 @@
 package quorum
 
 import (
-	"bytes"
 	"common"
 	"common/crypto"
+	"common/encoding"
 	"crypto/ecdsa"
-	"encoding/gob"
 	"fmt"
 	"sync"
+	"time"
 )
 
 // Message Types
@@ -41,25 +41,94 @@ type Participant struct {
 type State struct {
 	// Network Variables
 	messageRouter    common.MessageRouter
-	participants     [common.QuorumSize]*Participant // list of participants
-	participantsLock sync.RWMutex                    // write-locks for compile only
-	self             *Participant                    // ourselves
-	secretKey        crypto.SecretKey                // our secret key
+	quorumSize       int
+	participants     []*Participant   // list of participants, quorumSize long
+	participantsLock sync.RWMutex     // write-locks for compile only
+	self             *Participant     // ourselves
+	secretKey        crypto.SecretKey // our secret key
+
+	// Departures, guarded by participantsLock; see departure.go
+	departures    map[byte]uint64       // blocks left in the hand-off of each departing participant
+	successors    map[byte]*Participant // joining in the place of departing participants
+	handOffBlocks uint64
+
+	// Joins, guarded by participantsLock; see bootstrap.go
+	pendingJoins []*Participant // announced to us, for our next heartbeat
+	waiting      []*Participant // recorded joins that found no place, oldest first
+	admitted     []*Participant // took their place in this compile; see snapshot.go
+
+	// Entropy Commitments, guarded by participantsLock; see reveal.go
+	commitments map[byte]crypto.TruncatedHash // to the entropy each participant reveals next
+
+	// Block History, guarded by participantsLock; see integrity.go
+	recentBlocks []Block // the last turbulenceWindow blocks
 
 	// Heartbeat Variables
 	// storedFileStage2
 
 	// Compile Variables
-	currentEntropy  common.Entropy // Used to generate random numbers during compilation
-	upcomingEntropy common.Entropy // Used to compute entropy for next block
+	currentEntropy   common.Entropy        // Seeds the random numbers of the block
+	random           *common.RandomStream  // Random numbers drawn during compilation
+	upcomingEntropy  common.Entropy        // Used to compute entropy for next block
+	height           uint64                // number of blocks compiled
+	committedEntropy common.Entropy        // ours, revealed in our next heartbeat
+	externalEntropy  ExternalEntropySource // guarded by stepLock; see entropy.go
+
+	// Wallet Variables
+	// walletsLock guards the wallets and the sectors they pay for
+	wallets             map[WalletID]*Wallet
+	pendingTransactions []*Transaction  // received from clients, for our next heartbeat
+	pendingUpdates      []*SectorUpdate // received from clients, for our next heartbeat
+	sectors             map[crypto.Hash]*sectorRecord
+	sectorPayout        uint64                        // paid to each host per sector per block
+	droppedSegments     map[crypto.Hash][]crypto.Hash // for the sectorDeleter, after compile
+	sectorDeleter       SectorDeleter
+	handOff             HandOff
+	handedOff           map[crypto.Hash]crypto.Hash // our segment of each sector, from our predecessor
+	walletsLock         sync.RWMutex
+
+	// Down payments, guarded by walletsLock; see deposit.go
+	deposits        map[WalletID]*deposit // locked by each participant
+	refunds         []*deposit            // of departed participants, in order of release
+	downPayment     uint64
+	depositCooldown uint64 // blocks
 
 	// Consensus Algorithm Status
-	currentStep    int
-	stepLock       sync.RWMutex // prevents a benign race condition
+	// stepLock guards the step and its duration, which compile() changes
+	currentStep  int
+	stepDuration time.Duration
+	minStep      time.Duration
+	maxStep      time.Duration
+	stepDeadline time.Time     // quorum time at which the current step ends
+	compiled     chan struct{} // closed when the current block is compiled
+	stepLock     sync.RWMutex
+
+	// Latency Measurement
+	blockStart      time.Time // when the current block's first step began
+	measuredLatency uint32    // ms; longest arrival of a heartbeat sent at blockStart
+	latencyLock     sync.Mutex
+
+	// Clock Synchronization
+	clockOffset  time.Duration  // quorum clock minus local clock
+	clockSamples map[byte]int64 // ms; clock samples from each participant this block
+	clockLock    sync.Mutex
+
 	ticking        bool
+	leaving        bool // announce our departure until it is compiled
 	tickingLock    sync.Mutex
-	heartbeats     [common.QuorumSize]map[crypto.TruncatedHash]*heartbeat
+	heartbeats     []map[crypto.TruncatedHash]*heartbeat // one map per participant
 	heartbeatsLock sync.Mutex
+
+	// Gossip Variables
+	fanout     int                           // participants each message is sent to; 0 for all
+	seen       map[crypto.TruncatedHash]bool // hashes of messages received this block
+	gossipLock sync.Mutex
+}
+
+// participating returns true if we hold a place in the quorum. The caller
+// must hold participantsLock.
+func (s *State) participating() bool {
+	return int(s.self.index) < s.quorumSize && s.participants[s.self.index] == s.self
 }
 
 // Returns true if the values of the participants are equivalent
@@ -83,7 +152,11 @@ func (p0 *Participant) compare(p1 *Participant) bool {
 	return true
 }
 
-func (p *Participant) GobEncode() (gobParticipant []byte, err error) {
+func (p *Participant) GobEncode() ([]byte, error) {
+	return p.EncodeVersion(common.ProtocolVersion)
+}
+
+func (p *Participant) EncodeVersion(version uint16) (gobParticipant []byte, err error) {
 	// Error checking for nil values
 	if p == nil {
 		err = fmt.Errorf("Cannot encode nil value p")
@@ -104,21 +177,17 @@ func (p *Participant) GobEncode() (gobParticipant []byte, err error) {
 	}
 
 	// Encoding the participant
-	w := new(bytes.Buffer)
-	encoder := gob.NewEncoder(w)
-	err = encoder.Encode(p.index)
-	if err != nil {
-		return
-	}
-	err = encoder.Encode(p.address)
-	if err != nil {
-		return
+	var encoded []byte
+	switch version {
+	case 14, 15:
+		encoded, err = encoding.Marshal(p)
+	default:
+		err = fmt.Errorf("Cannot encode a Participant at version %v", version)
 	}
-	err = encoder.Encode(p.publicKey)
 	if err != nil {
 		return
 	}
-	gobParticipant = w.Bytes()
+	gobParticipant = common.VersionedEnvelope(version, encoded)
 	return
 }
 
@@ -128,36 +197,147 @@ func (p *Participant) GobDecode(gobParticipant []byte) (err error) {
 		return
 	}
 
-	r := bytes.NewBuffer(gobParticipant)
-	decoder := gob.NewDecoder(r)
-	err = decoder.Decode(&p.index)
+	version, body, err := common.OpenEnvelope(gobParticipant)
 	if err != nil {
 		return
 	}
-	err = decoder.Decode(&p.address)
-	if err != nil {
-		return
+	switch version {
+	case 14, 15:
+		err = encoding.Unmarshal(body, p)
+	default:
+		err = fmt.Errorf("Cannot decode a Participant of version %v", version)
+	}
+	return
+}
+
+// EncodeTo writes the canonical encoding of the Participant:
+//
+//	index     byte
+//	address   common.Address
+//	publicKey crypto.PublicKey
+func (p *Participant) EncodeTo(e *encoding.Encoder) {
+	e.WriteUint8(p.index)
+	p.address.EncodeTo(e)
+	p.publicKey.EncodeTo(e)
+}
+
+// DecodeFrom reads a Participant written by EncodeTo.
+func (p *Participant) DecodeFrom(d *encoding.Decoder) {
+	p.index = d.ReadUint8()
+	p.address.DecodeFrom(d)
+	p.publicKey = new(crypto.PublicKey)
+	p.publicKey.DecodeFrom(d)
+}
+
+// DefaultSectorPayout is the SectorPayout of the default Config.
+const DefaultSectorPayout = 1
+
+// DefaultDepositCooldown is the DepositCooldown of the default Config.
+const DefaultDepositCooldown = 16
+
+// DefaultHandOffBlocks is the HandOffBlocks of the default Config.
+const DefaultHandOffBlocks = 4
+
+// Config holds the parameters that every participant in a quorum must agree
+// on. It is validated when a State is created.
+type Config struct {
+	QuorumSize int
+
+	// StepDuration is the length of a step in the first block. It is then
+	// adjusted each block to the measured latency, between MinStepDuration
+	// and MaxStepDuration. Setting all three equal fixes the duration.
+	// Participants that join later take the current duration from the
+	// bootstrap instead of StepDuration.
+	StepDuration    time.Duration
+	MinStepDuration time.Duration
+	MaxStepDuration time.Duration
+
+	// SectorPayout is the number of siacoins paid to each host from the
+	// balance of each sector, every block.
+	SectorPayout uint64
+
+	// Genesis is the balance of each wallet when the quorum starts, and the
+	// only source of siacoins. It is empty by default.
+	Genesis map[WalletID]uint64
+
+	// DownPayment is the number of siacoins a participant locks from its
+	// wallet to join, and forfeits if it is tossed. A quorum without a
+	// genesis has no siacoins, so none is required by default. A
+	// participant that leaves gracefully is refunded DepositCooldown blocks
+	// after it leaves.
+	DownPayment     uint64
+	DepositCooldown uint64
+
+	// HandOffBlocks is the number of blocks a departing participant stays
+	// in the quorum after announcing it is leaving, so that its segments can
+	// be handed off to a successor.
+	HandOffBlocks uint64
+}
+
+// DefaultConfig returns the configuration used by CreateState.
+func DefaultConfig() Config {
+	return Config{
+		QuorumSize:      common.DefaultQuorumSize,
+		StepDuration:    common.DefaultStepDuration,
+		MinStepDuration: common.DefaultStepDuration,
+		MaxStepDuration: 10 * common.DefaultStepDuration,
+		SectorPayout:    DefaultSectorPayout,
+		DepositCooldown: DefaultDepositCooldown,
+		HandOffBlocks:   DefaultHandOffBlocks,
 	}
-	err = decoder.Decode(&p.publicKey)
+}
+
+// validate returns an error if any parameter is unusable.
+func (c Config) validate() error {
+	err := common.ValidateQuorumSize(c.QuorumSize)
 	if err != nil {
-		return
+		return err
 	}
-	return
+	if c.MinStepDuration < time.Millisecond {
+		return fmt.Errorf("minimum step duration %v is shorter than a millisecond", c.MinStepDuration)
+	}
+	if c.StepDuration < c.MinStepDuration || c.StepDuration > c.MaxStepDuration {
+		return fmt.Errorf("step duration %v is not between %v and %v", c.StepDuration, c.MinStepDuration, c.MaxStepDuration)
+	}
+	if c.SectorPayout == 0 {
+		return fmt.Errorf("sector payout must be at least 1")
+	}
+	if c.HandOffBlocks == 0 {
+		return fmt.Errorf("hand-off must last at least 1 block")
+	}
+	return nil
 }
 
 // Create and initialize a state object. Set everything to default.
 func CreateState(messageRouter common.MessageRouter) (s *State, err error) {
+	// create a signature keypair for this state
+	_, secKey, err := crypto.CreateKeyPair()
+	if err != nil {
+		return
+	}
+
+	return CreateStateWithKey(messageRouter, secKey)
+}
+
+// CreateStateWithKey creates a state that uses an existing secret key, so
+// that a restarted host keeps its identity as a Participant.
+func CreateStateWithKey(messageRouter common.MessageRouter, secKey crypto.SecretKey) (s *State, err error) {
+	return CreateStateWithConfig(messageRouter, secKey, DefaultConfig())
+}
+
+// CreateStateWithConfig creates a state that uses an existing secret key and
+// the quorum parameters in config.
+func CreateStateWithConfig(messageRouter common.MessageRouter, secKey crypto.SecretKey, config Config) (s *State, err error) {
 	// check that we have a non-nil messageSender
 	if messageRouter == nil {
 		err = fmt.Errorf("Cannot initialize with a nil messageRouter")
 		return
 	}
-
-	// create a signature keypair for this state
-	pubKey, secKey, err := crypto.CreateKeyPair()
+	err = config.validate()
 	if err != nil {
 		return
 	}
+	pubKey := secKey.Public()
 
 	// initialize State with default values and keypair
 	s = &State{
@@ -167,8 +347,37 @@ func CreateState(messageRouter common.MessageRouter) (s *State, err error) {
 			address:   messageRouter.Address(),
 			publicKey: pubKey,
 		},
-		secretKey:   secKey,
-		currentStep: 1,
+		secretKey:    secKey,
+		quorumSize:   config.QuorumSize,
+		participants: make([]*Participant, config.QuorumSize),
+		heartbeats:   make([]map[crypto.TruncatedHash]*heartbeat, config.QuorumSize),
+		random:       common.NewRandomStream(common.Entropy{}),
+		currentStep:  1,
+		stepDuration: config.StepDuration,
+		minStep:      config.MinStepDuration,
+		maxStep:      config.MaxStepDuration,
+		blockStart:   time.Now(),
+		compiled:     make(chan struct{}),
+		clockSamples: make(map[byte]int64),
+		wallets:      make(map[WalletID]*Wallet),
+		sectors:      make(map[crypto.Hash]*sectorRecord),
+		sectorPayout: config.SectorPayout,
+
+		droppedSegments: make(map[crypto.Hash][]crypto.Hash),
+		handedOff:       make(map[crypto.Hash]crypto.Hash),
+		deposits:        make(map[WalletID]*deposit),
+		downPayment:     config.DownPayment,
+		depositCooldown: config.DepositCooldown,
+		departures:      make(map[byte]uint64),
+		successors:      make(map[byte]*Participant),
+		commitments:     make(map[byte]crypto.TruncatedHash),
+		handOffBlocks:   config.HandOffBlocks,
+		fanout:          DefaultFanout,
+		seen:            make(map[crypto.TruncatedHash]bool),
+	}
+
+	for id, balance := range config.Genesis {
+		s.wallets[id] = &Wallet{balance: balance}
 	}
 
 	// register State and store our assigned ID
@@ -178,39 +387,50 @@ func CreateState(messageRouter common.MessageRouter) (s *State, err error) {
 	return
 }
 
-// Takes a Message and broadcasts it to every Participant in the quorum
+// Address returns the address at which other participants reach this State.
+func (s *State) Address() common.Address {
+	s.participantsLock.Lock()
+	defer s.participantsLock.Unlock()
+	s.refreshAddress()
+	return s.self.address
+}
+
+// refreshAddress takes the host and port the messageRouter advertises, which
+// change if it learns its external address. Once we have joined, the quorum
+// knows us by the address we joined with, so it is kept. The caller must hold
+// participantsLock.
+func (s *State) refreshAddress() {
+	if s.self.index != 255 {
+		return
+	}
+	a := s.messageRouter.Address()
+	s.self.address.Host = a.Host
+	s.self.address.Port = a.Port
+}
+
+// Takes a Message and broadcasts it to the quorum, by sending it to the
+// gossip targets, who pass it on
 func (s *State) broadcast(m *common.Message) {
 	s.participantsLock.RLock()
-	for i := range s.participants {
-		if s.participants[i] != nil {
-			nm := *m
-			nm.Dest = s.participants[i].address
-			s.messageRouter.SendAsyncMessage(&nm)
-		}
-	}
+	targets := s.gossipTargets()
 	s.participantsLock.RUnlock()
+	for _, p := range targets {
+		nm := *m
+		nm.Dest = p.address
+		s.messageRouter.SendAsyncMessage(&nm)
+	}
 }
 
 // Use the entropy stored in the state to generate a random integer [low, high)
 // randInt only runs during compile(), when the mutexes are already locked
 func (s *State) randInt(low int, high int) (randInt int, err error) {
 	// verify there's a gap between the numbers
-	if low == high {
-		err = fmt.Errorf("low and high cannot be the same number")
+	if low >= high {
+		err = fmt.Errorf("low must be less than high")
 		return
 	}
 
-	// Convert CurrentEntropy into an int
-	rollingInt := 0
-	for i := 0; i < 4; i++ {
-		rollingInt = rollingInt << 8
-		rollingInt += int(s.currentEntropy[i])
-	}
-
-	randInt = (rollingInt % (high - low)) + low
-
-	// Convert random number seed to next value
-	truncatedHash, err := crypto.CalculateTruncatedHash(s.currentEntropy[:])
-	s.currentEntropy = common.Entropy(truncatedHash)
+	randInt, err = s.random.Intn(high - low)
+	randInt += low
 	return
 }
@@ -3,6 +3,9 @@ package quorum
 import (
 	"common"
 	"common/crypto"
+	"common/encoding"
+	"crypto/elliptic"
+	"encoding/hex"
 	"testing"
 )
 
@@ -122,6 +125,36 @@ func TestParticipantEncoding(t *testing.T) {
 	}
 }
 
+// A participant is its index, its address, and its key as an uncompressed
+// point; the key here is the P-521 generator.
+func TestGoldenParticipant(t *testing.T) {
+	c := elliptic.P521()
+	p := &Participant{
+		index:     3,
+		address:   common.Address{ID: 1, Host: "localhost", Port: 9988},
+		publicKey: &crypto.PublicKey{Curve: c, X: c.Params().Gx, Y: c.Params().Gy},
+	}
+	encoded, err := encoding.Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	golden := "03" + "01" + "00000009" + hex.EncodeToString([]byte("localhost")) + "2704" + "04" +
+		"00c6858e06b70404e9cd9e3ecb662395b4429c648139053fb521f828af606b4d3dbaa14b5e77efe75928fe1dc127a2ffa8de3348b3c1856a429bf97e7e31c2e5bd66" +
+		"011839296a789a3bc0045c8a5fb42c7d1bd998f54449579b446817afbd17273e662c97ee72995ef42640c550b9013fad0761353c7086a272c24088be94769fd16650"
+	if hex.EncodeToString(encoded) != golden {
+		t.Fatalf("participant encoding changed: %x", encoded)
+	}
+
+	decoded := new(Participant)
+	err = encoding.Unmarshal(encoded, decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.compare(p) || decoded.index != 3 {
+		t.Error("participant changed in encoding")
+	}
+}
+
 // Create a state, check the defaults
 func TestCreateState(t *testing.T) {
 	// make sure CreateState does not cause errors
@@ -139,8 +172,92 @@ func TestCreateState(t *testing.T) {
 	}
 }
 
+// A state created from an existing key uses it as its identity
+func TestCreateStateWithKey(t *testing.T) {
+	pubKey, secKey, err := crypto.CreateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := CreateStateWithKey(common.NewZeroNetwork(), secKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.self.publicKey.Compare(pubKey) {
+		t.Error("state did not take its public key from the secret key")
+	}
+
+	_, err = CreateStateWithKey(nil, secKey)
+	if err == nil {
+		t.Error("created a state with a nil messageRouter")
+	}
+}
+
+// sizedConfig returns the default config with the given quorum size.
+func sizedConfig(size int) Config {
+	config := DefaultConfig()
+	config.QuorumSize = size
+	return config
+}
+
+// The quorum size is taken from the config, and unusable sizes are rejected.
+func TestCreateStateWithConfig(t *testing.T) {
+	_, secKey, err := crypto.CreateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := CreateStateWithConfig(common.NewZeroNetwork(), secKey, sizedConfig(128))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.quorumSize != 128 || len(s.participants) != 128 || len(s.heartbeats) != 128 {
+		t.Error("state was not sized from the config")
+	}
+
+	for _, size := range []int{0, 1, 256} {
+		_, err = CreateStateWithConfig(common.NewZeroNetwork(), secKey, sizedConfig(size))
+		if err == nil {
+			t.Error("created a state with quorum size", size)
+		}
+	}
+}
+
+// learningNetwork is a ZeroNetwork whose advertised address can change, as
+// an RPCServer's does when it learns its external address.
+type learningNetwork struct {
+	*common.ZeroNetwork
+	address common.Address
+}
+
+func (l *learningNetwork) Address() common.Address {
+	return l.address
+}
+
+// The address a State announces follows the one the messageRouter learns,
+// until the State joins.
 func TestSetAddress(t *testing.T) {
-	// Later
+	l := &learningNetwork{common.NewZeroNetwork(), common.Address{Host: "10.0.0.1", Port: 9988}}
+	s, err := CreateState(l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.address.Host = "203.0.113.7"
+	if a := s.Address(); a.Host != "203.0.113.7" || a.Port != 9988 {
+		t.Fatal("learned address was not used:", a)
+	}
+	err = s.JoinSia()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if joined := l.RecentMessage(0).Args.(*Participant); joined.address.Host != "203.0.113.7" {
+		t.Error("joined with a stale address:", joined.address)
+	}
+
+	// once we have joined, the quorum knows us by the address we joined with
+	s.self.index = 0
+	l.address.Host = "198.51.100.1"
+	if a := s.Address(); a.Host != "203.0.113.7" {
+		t.Error("address changed after joining:", a)
+	}
 }
 
 func TestUpdateParticipant(t *testing.T) {
@@ -159,20 +276,22 @@ func TestRandInt(t *testing.T) {
 	}
 
 	// check that it works in the vanilla case
-	previousEntropy := s.currentEntropy
-	randInt, err := s.randInt(0, 5)
+	randInt, err := s.randInt(2, 7)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if randInt < 0 || randInt >= 5 {
+	if randInt < 2 || randInt >= 7 {
 		t.Fatal("randInt returned but is not between the bounds")
 	}
 
-	// check that s.CurrentEntropy flipped to next value
-	if previousEntropy == s.currentEntropy {
-		t.Error(previousEntropy)
-		t.Error(s.currentEntropy)
-		t.Fatal("When calling randInt, s.CurrentEntropy was not changed")
+	// check that randInt draws from the stream seeded with s.CurrentEntropy
+	stream := common.NewRandomStream(s.currentEntropy)
+	if expected, _ := stream.Intn(5); randInt != expected+2 {
+		t.Error("randInt did not draw from the entropy of the block:", randInt, expected+2)
+	}
+	randInt, _ = s.randInt(0, 1000)
+	if expected, _ := stream.Intn(1000); randInt != expected {
+		t.Error("randInt did not advance the stream:", randInt, expected)
 	}
 
 	// check the zero value
@@ -187,7 +306,7 @@ func TestRandInt(t *testing.T) {
 	}
 
 	low := 0
-	high := common.QuorumSize
+	high := s.quorumSize
 	for i := 0; i < 100000; i++ {
 		randInt, err = s.randInt(low, high)
 		if err != nil {
@@ -0,0 +1,92 @@
+package quorum
+
+import (
+	"sort"
+	"time"
+)
+
+// The step duration is agreed by the quorum. It starts at the configured
+// StepDuration, and is adjusted at each compile by a rule that depends only
+// on the heartbeats of the block, so participants that start from the same
+// duration arrive at the same duration. A participant that joins later
+// cannot replay the adjustments, so the bootstrap tells it the current
+// duration in its JoinReply.
+//
+// Each participant measures how long the heartbeats sent at the start of a
+// block took to reach it, and reports the longest in its next heartbeat. At
+// compile, the median report is taken, so a minority of participants cannot
+// move the duration on their own. The target duration is latencyMargin
+// times the median, within the configured bounds, and the duration moves
+// 1/adjustmentRate of the way to the target each block. All arithmetic is
+// done in whole milliseconds.
+const (
+	latencyMargin  = 4
+	adjustmentRate = 4
+)
+
+// medianLatency returns the median of the reported latencies, in
+// milliseconds. reports must not be empty.
+func medianLatency(reports []uint32) int64 {
+	sorted := append([]uint32{}, reports...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return int64(sorted[len(sorted)/2])
+}
+
+// adjustStepDuration applies the adjustment rule to the reported latencies,
+// returning the step duration for the next block.
+func adjustStepDuration(current time.Duration, reports []uint32, min time.Duration, max time.Duration) time.Duration {
+	if len(reports) == 0 {
+		return current
+	}
+	median := medianLatency(reports)
+
+	currentMs := int64(current / time.Millisecond)
+	minMs := int64(min / time.Millisecond)
+	maxMs := int64(max / time.Millisecond)
+	target := median * latencyMargin
+	if target < minMs {
+		target = minMs
+	}
+	if target > maxMs {
+		target = maxMs
+	}
+
+	next := currentMs + (target-currentMs)/adjustmentRate
+	if next == currentMs {
+		// close enough that the fraction rounds to nothing
+		next = target
+	}
+	return time.Duration(next) * time.Millisecond
+}
+
+// recordLatency notes that a heartbeat sent at the start of the block
+// arrived now.
+func (s *State) recordLatency() {
+	s.latencyLock.Lock()
+	defer s.latencyLock.Unlock()
+	elapsed := time.Since(s.blockStart) / time.Millisecond
+	if elapsed > time.Duration(^uint32(0)) {
+		elapsed = time.Duration(^uint32(0))
+	}
+	if uint32(elapsed) > s.measuredLatency {
+		s.measuredLatency = uint32(elapsed)
+	}
+}
+
+// startBlock resets the latency measurement for a new block, returning the
+// latency measured over the previous one.
+func (s *State) startBlock() (latency uint32) {
+	s.latencyLock.Lock()
+	defer s.latencyLock.Unlock()
+	latency = s.measuredLatency
+	s.measuredLatency = 0
+	s.blockStart = time.Now()
+	return
+}
+
+// StepDuration returns the current length of a step.
+func (s *State) StepDuration() time.Duration {
+	s.stepLock.RLock()
+	defer s.stepLock.RUnlock()
+	return s.stepDuration
+}
@@ -0,0 +1,93 @@
+package quorum
+
+import (
+	"common"
+	"common/crypto"
+	"testing"
+	"time"
+)
+
+func TestAdjustStepDuration(t *testing.T) {
+	ms := time.Millisecond
+	min, max := 10*ms, 1000*ms
+
+	// no reports leaves the duration alone
+	if d := adjustStepDuration(100*ms, nil, min, max); d != 100*ms {
+		t.Error("duration changed without reports:", d)
+	}
+
+	// the duration moves a quarter of the way to 4x the median
+	if d := adjustStepDuration(100*ms, []uint32{50, 50, 50}, min, max); d != 125*ms {
+		t.Error("duration did not move toward the target:", d)
+	}
+
+	// a minority of extreme reports cannot move the median
+	if d := adjustStepDuration(100*ms, []uint32{25, 25, 25, 1 << 30, 0}, min, max); d != 100*ms {
+		t.Error("extreme reports moved the duration:", d)
+	}
+
+	// the target is clamped to the bounds
+	if d := adjustStepDuration(max, []uint32{1 << 30}, min, max); d != max {
+		t.Error("duration exceeded the maximum:", d)
+	}
+	if d := adjustStepDuration(min, []uint32{0}, min, max); d != min {
+		t.Error("duration fell below the minimum:", d)
+	}
+
+	// repeated adjustment converges on the target exactly
+	d := max
+	for i := 0; i < 100; i++ {
+		d = adjustStepDuration(d, []uint32{5}, min, max)
+	}
+	if d != 20*ms {
+		t.Error("duration did not converge on the target:", d)
+	}
+
+	// the order of the reports does not matter
+	a := adjustStepDuration(100*ms, []uint32{3, 90, 40, 7}, min, max)
+	b := adjustStepDuration(100*ms, []uint32{90, 7, 3, 40}, min, max)
+	if a != b {
+		t.Error("order of reports changed the result:", a, b)
+	}
+}
+
+// On a fast network a quorum can run with much shorter steps than the
+// default.
+func TestShortSteps(t *testing.T) {
+	_, secKey, err := crypto.CreateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := DefaultConfig()
+	config.StepDuration = 20 * time.Millisecond
+	config.MinStepDuration = 10 * time.Millisecond
+	config.MaxStepDuration = 50 * time.Millisecond
+	s, err := CreateStateWithConfig(common.NewZeroNetwork(), secKey, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.stepLock.RLock()
+	compiled := s.compiled
+	s.stepLock.RUnlock()
+	go s.tick()
+
+	// a whole block takes at most quorumSize * MaxStepDuration
+	select {
+	case <-compiled:
+	case <-time.After(time.Duration(s.quorumSize+1) * config.MaxStepDuration):
+		t.Fatal("block was not compiled within its steps")
+	}
+	if d := s.StepDuration(); d < config.MinStepDuration || d > config.MaxStepDuration {
+		t.Error("step duration left its bounds:", d)
+	}
+
+	// bad timing configurations are rejected
+	config.MinStepDuration = 0
+	if _, err = CreateStateWithConfig(common.NewZeroNetwork(), secKey, config); err == nil {
+		t.Error("accepted a zero minimum step")
+	}
+	config.MinStepDuration = 30 * time.Millisecond
+	if _, err = CreateStateWithConfig(common.NewZeroNetwork(), secKey, config); err == nil {
+		t.Error("accepted a step shorter than the minimum")
+	}
+}
@@ -0,0 +1,311 @@
+package quorum
+
+import (
+	"common"
+	"common/crypto"
+	"common/encoding"
+	"errors"
+	"fmt"
+)
+
+// maxHeartbeatUpdates is the most sector updates a participant may put in a
+// single heartbeat. Updates beyond it wait for the next block.
+const maxHeartbeatUpdates = 256
+
+// A SectorUpdate sets the contents of a sector: the hash of the segment each
+// participant must store. Revision 0 creates the sector, and names the keys
+// that may update it from then on. Only the owner of the sector, who paid
+// for it first, may create it; see sector.go. A sector created with no
+// authorized keys is immutable, and can never be updated. Every later update
+// replaces one or more segments, must be signed by an authorized key, and
+// must carry the next revision of the sector, so that no update can be
+// applied twice.
+type SectorUpdate struct {
+	Sector     crypto.Hash
+	Signer     *crypto.PublicKey
+	Revision   uint64
+	Indices    []byte              // the participants whose segments change
+	Hashes     []crypto.Hash       // the new hash of each of their segments
+	Authorized []*crypto.PublicKey // revision 0 only
+	Signature  crypto.Signature
+}
+
+var suerrNilSigner = errors.New("SectorUpdate has no signer")
+var suerrMismatchedSegments = errors.New("SectorUpdate has a different number of indices and hashes")
+var suerrAuthorizedUpdate = errors.New("SectorUpdate changes the authorized keys after creation")
+var suerrInvalidSignature = errors.New("SectorUpdate has an invalid signature")
+var suerrBounds = errors.New("SectorUpdate replaces a segment outside the quorum")
+var suerrDuplicateIndex = errors.New("SectorUpdate replaces the same segment twice")
+var suerrSectorExists = errors.New("SectorUpdate creates a sector that already exists")
+var suerrUnpaidSector = errors.New("SectorUpdate creates a sector that nobody has paid for")
+var suerrNotOwner = errors.New("SectorUpdate that creates a sector is not signed by its owner")
+var suerrUnknownSector = errors.New("SectorUpdate changes a sector that does not exist")
+var suerrImmutable = errors.New("SectorUpdate changes an immutable sector")
+var suerrWrongRevision = errors.New("SectorUpdate revision does not follow the sector's; it is a replay or out of order")
+var suerrUnauthorized = errors.New("SectorUpdate is not signed by an authorized key")
+
+// NewSectorUpdate creates an update signed with secKey that sets the
+// segments at indices to hashes. For revision 0, authorized are the keys
+// that may update the sector later; pass none to make it immutable.
+func NewSectorUpdate(secKey crypto.SecretKey, sector crypto.Hash, revision uint64, indices []byte, hashes []crypto.Hash, authorized []*crypto.PublicKey) (u *SectorUpdate, err error) {
+	u = &SectorUpdate{
+		Sector:     sector,
+		Signer:     secKey.Public(),
+		Revision:   revision,
+		Indices:    indices,
+		Hashes:     hashes,
+		Authorized: authorized,
+	}
+	e := new(encoding.Encoder)
+	u.encodeBody(e)
+	if err = e.Err(); err != nil {
+		return
+	}
+	signedMessage, err := secKey.Sign(e.Bytes())
+	if err != nil {
+		return
+	}
+	u.Signature = signedMessage.Signature
+	return
+}
+
+// verify checks the parts of an update that do not depend on the State.
+func (u *SectorUpdate) verify() error {
+	if u.Signer == nil {
+		return suerrNilSigner
+	}
+	if len(u.Indices) != len(u.Hashes) {
+		return suerrMismatchedSegments
+	}
+	if u.Revision != 0 && len(u.Authorized) != 0 {
+		return suerrAuthorizedUpdate
+	}
+	e := new(encoding.Encoder)
+	u.encodeBody(e)
+	if e.Err() != nil {
+		return e.Err()
+	}
+	if !u.Signer.Verify(&crypto.SignedMessage{Signature: u.Signature, Message: e.Bytes()}) {
+		return suerrInvalidSignature
+	}
+	return nil
+}
+
+// EncodeTo writes the canonical encoding of the update:
+//
+//	sector     [HashSize]byte
+//	signer     crypto.PublicKey
+//	revision   uint64
+//	indices    []byte
+//	hashes     [][HashSize]byte
+//	authorized []crypto.PublicKey
+//	signature  crypto.Signature
+func (u *SectorUpdate) EncodeTo(e *encoding.Encoder) {
+	u.encodeBody(e)
+	u.Signature.EncodeTo(e)
+}
+
+func (u *SectorUpdate) encodeBody(e *encoding.Encoder) {
+	e.WriteFixed(u.Sector[:])
+	u.Signer.EncodeTo(e)
+	e.WriteUint64(u.Revision)
+	e.WriteBytes(u.Indices)
+	e.WriteLength(len(u.Hashes))
+	for i := range u.Hashes {
+		e.WriteFixed(u.Hashes[i][:])
+	}
+	e.WriteLength(len(u.Authorized))
+	for _, pk := range u.Authorized {
+		pk.EncodeTo(e)
+	}
+}
+
+// DecodeFrom reads an update written by EncodeTo.
+func (u *SectorUpdate) DecodeFrom(d *encoding.Decoder) {
+	d.ReadFixed(u.Sector[:])
+	u.Signer = new(crypto.PublicKey)
+	u.Signer.DecodeFrom(d)
+	u.Revision = d.ReadUint64()
+	u.Indices = d.ReadBytes()
+	n := d.ReadLength()
+	u.Hashes = nil
+	for i := 0; i < n && d.Err() == nil; i++ {
+		var hash crypto.Hash
+		d.ReadFixed(hash[:])
+		u.Hashes = append(u.Hashes, hash)
+	}
+	n = d.ReadLength()
+	u.Authorized = nil
+	for i := 0; i < n && d.Err() == nil; i++ {
+		pk := new(crypto.PublicKey)
+		pk.DecodeFrom(d)
+		u.Authorized = append(u.Authorized, pk)
+	}
+	u.Signature.DecodeFrom(d)
+}
+
+func (u *SectorUpdate) GobEncode() ([]byte, error) {
+	return u.EncodeVersion(common.ProtocolVersion)
+}
+
+func (u *SectorUpdate) EncodeVersion(version uint16) (gobUpdate []byte, err error) {
+	if u == nil {
+		err = fmt.Errorf("Cannot encode nil value u")
+		return
+	}
+	var encoded []byte
+	switch version {
+	case 14, 15:
+		encoded, err = encoding.Marshal(u)
+	default:
+		err = fmt.Errorf("Cannot encode a SectorUpdate at version %v", version)
+	}
+	if err != nil {
+		return
+	}
+	gobUpdate = common.VersionedEnvelope(version, encoded)
+	return
+}
+
+func (u *SectorUpdate) GobDecode(gobUpdate []byte) (err error) {
+	if u == nil {
+		err = fmt.Errorf("Cannot decode into nil SectorUpdate")
+		return
+	}
+
+	version, body, err := common.OpenEnvelope(gobUpdate)
+	if err != nil {
+		return
+	}
+	switch version {
+	case 14, 15:
+		err = encoding.Unmarshal(body, u)
+	default:
+		err = fmt.Errorf("Cannot decode a SectorUpdate of version %v", version)
+	}
+	return
+}
+
+// applySectorUpdate creates or changes a sector. The segments an update
+// replaces are dropped, so that their hosts delete them. An update that is
+// invalid or not authorized is rejected and changes nothing.
+// applySectorUpdate only runs during compile().
+func (s *State) applySectorUpdate(u *SectorUpdate) (err error) {
+	err = u.verify()
+	if err != nil {
+		return
+	}
+	replaced := make(map[byte]bool)
+	for _, i := range u.Indices {
+		if int(i) >= s.quorumSize {
+			return suerrBounds
+		}
+		if replaced[i] {
+			return suerrDuplicateIndex
+		}
+		replaced[i] = true
+	}
+
+	s.walletsLock.Lock()
+	defer s.walletsLock.Unlock()
+	sector := s.sectors[u.Sector]
+	if u.Revision == 0 {
+		if sector == nil {
+			return suerrUnpaidSector
+		}
+		if sector.created {
+			return suerrSectorExists
+		}
+		var signer WalletID
+		signer, err = NewWalletID(u.Signer)
+		if err != nil {
+			return
+		}
+		if signer != sector.owner {
+			return suerrNotOwner
+		}
+		sector.created = true
+		sector.segments = make([]crypto.Hash, s.quorumSize)
+		sector.authorized = append([]*crypto.PublicKey{}, u.Authorized...)
+	} else {
+		if sector == nil || !sector.created {
+			return suerrUnknownSector
+		}
+		if len(sector.authorized) == 0 {
+			return suerrImmutable
+		}
+		if u.Revision != sector.revision+1 {
+			return suerrWrongRevision
+		}
+		authorized := false
+		for _, pk := range sector.authorized {
+			if pk.Compare(u.Signer) {
+				authorized = true
+				break
+			}
+		}
+		if !authorized {
+			return suerrUnauthorized
+		}
+		sector.revision = u.Revision
+	}
+
+	var dropped []crypto.Hash
+	for j, i := range u.Indices {
+		if sector.segments[i] != u.Hashes[j] {
+			dropped = append(dropped, sector.segments[i])
+		}
+		sector.segments[i] = u.Hashes[j]
+	}
+	s.dropSegments(u.Sector, dropped)
+	return
+}
+
+// HandleSectorUpdate takes an update from a client and queues it to be put
+// in our next heartbeat. Whether the update is authorized is checked when it
+// is compiled.
+func (s *State) HandleSectorUpdate(u SectorUpdate, arb *struct{}) (err error) {
+	err = u.verify()
+	if err != nil {
+		return
+	}
+	s.walletsLock.Lock()
+	s.pendingUpdates = append(s.pendingUpdates, &u)
+	s.walletsLock.Unlock()
+	return
+}
+
+// takePendingUpdates removes and returns as many queued updates as fit in a
+// heartbeat.
+func (s *State) takePendingUpdates() (updates []*SectorUpdate) {
+	s.walletsLock.Lock()
+	defer s.walletsLock.Unlock()
+	n := len(s.pendingUpdates)
+	if n > maxHeartbeatUpdates {
+		n = maxHeartbeatUpdates
+	}
+	updates = s.pendingUpdates[:n]
+	s.pendingUpdates = s.pendingUpdates[n:]
+	return
+}
+
+// ExpectsSegment returns true if the quorum has agreed that we store the
+// segment with the given hash for a sector, or our predecessor has handed it
+// off to us. Hosts check it before accepting an uploaded segment, so that
+// only segments set by an authorized update are stored.
+func (s *State) ExpectsSegment(sector crypto.Hash, segment crypto.Hash) bool {
+	s.participantsLock.RLock()
+	index := int(s.self.index)
+	s.participantsLock.RUnlock()
+
+	s.walletsLock.RLock()
+	defer s.walletsLock.RUnlock()
+	if handedOff, exists := s.handedOff[sector]; exists && handedOff == segment {
+		return true
+	}
+	record := s.sectors[sector]
+	if record == nil || index >= len(record.segments) {
+		return false
+	}
+	return segment != (crypto.Hash{}) && record.segments[index] == segment
+}
@@ -0,0 +1,229 @@
+package quorum
+
+import (
+	"common"
+	"common/crypto"
+	"testing"
+)
+
+// createTestSector creates a sector whose segment i has hash {i + 1}, and
+// which can be updated by the returned key, which owns the sector.
+func createTestSector(t *testing.T, s *State, sector crypto.Hash) (owner crypto.SecretKey) {
+	ownerPub, owner, err := crypto.CreateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ownerID, err := NewWalletID(ownerPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.sectors[sector] == nil {
+		s.sectors[sector] = new(sectorRecord)
+	}
+	s.sectors[sector].owner = ownerID
+	var indices []byte
+	var hashes []crypto.Hash
+	for i := 0; i < s.quorumSize; i++ {
+		indices = append(indices, byte(i))
+		hashes = append(hashes, crypto.Hash{byte(i + 1)})
+	}
+	u, err := NewSectorUpdate(owner, sector, 0, indices, hashes, []*crypto.PublicKey{ownerPub})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.applySectorUpdate(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestCreateSector(t *testing.T) {
+	s, err := CreateState(common.NewZeroNetwork())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fillQuorum(s)
+	sector := crypto.Hash{1}
+
+	// a sector can be paid for before it is created
+	s.sectors[sector] = &sectorRecord{balance: 7}
+	createTestSector(t, s, sector)
+	if balance, _ := s.SectorBalance(sector); balance != 7 {
+		t.Error("creating the sector lost its balance:", balance)
+	}
+
+	if !s.ExpectsSegment(sector, crypto.Hash{1}) {
+		t.Error("host does not expect its segment of the sector")
+	}
+	if s.ExpectsSegment(sector, crypto.Hash{2}) || s.ExpectsSegment(crypto.Hash{2}, crypto.Hash{1}) {
+		t.Error("host expects a segment it was not given")
+	}
+
+	// nobody can create the sector again
+	_, secKey, err := crypto.CreateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := NewSectorUpdate(secKey, sector, 0, []byte{0}, []crypto.Hash{{9}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.applySectorUpdate(u) != suerrSectorExists {
+		t.Error("existing sector was created again")
+	}
+
+	// only the wallet that paid for a sector first can create it
+	_, payerKey := newTestWallet(t, s, 10)
+	paid := crypto.Hash{2}
+	u, err = NewSectorUpdate(secKey, paid, 0, []byte{0}, []crypto.Hash{{9}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.applySectorUpdate(u) != suerrUnpaidSector {
+		t.Error("created a sector nobody has paid for")
+	}
+	topUp, err := NewTopUp(payerKey, paid, 5, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.applyTransaction(topUp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.applySectorUpdate(u) != suerrNotOwner {
+		t.Error("created a sector another wallet paid for")
+	}
+	u, err = NewSectorUpdate(payerKey, paid, 0, []byte{0}, []crypto.Hash{{9}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.applySectorUpdate(u); err != nil {
+		t.Error("owner could not create the sector it paid for:", err)
+	}
+}
+
+func TestUpdateSector(t *testing.T) {
+	s, err := CreateState(common.NewZeroNetwork())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fillQuorum(s)
+	sector := crypto.Hash{1}
+	owner := createTestSector(t, s, sector)
+
+	u, err := NewSectorUpdate(owner, sector, 1, []byte{0, 2}, []crypto.Hash{{10}, {3}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.applySectorUpdate(u); err != nil {
+		t.Fatal("authorized update was rejected:", err)
+	}
+	if !s.ExpectsSegment(sector, crypto.Hash{10}) {
+		t.Error("update did not replace the segment")
+	}
+	dropped := s.droppedSegments[sector]
+	if len(dropped) != 1 || dropped[0] != (crypto.Hash{1}) {
+		t.Error("replaced segment was not dropped:", dropped)
+	}
+	if s.applySectorUpdate(u) != suerrWrongRevision {
+		t.Error("replayed update was accepted")
+	}
+
+	_, other, err := crypto.CreateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad := []struct {
+		key      crypto.SecretKey
+		revision uint64
+		indices  []byte
+		expected error
+	}{
+		{other, 2, []byte{0}, suerrUnauthorized},
+		{owner, 3, []byte{0}, suerrWrongRevision},
+		{owner, 2, []byte{byte(s.quorumSize)}, suerrBounds},
+		{owner, 2, []byte{1, 1}, suerrDuplicateIndex},
+	}
+	for _, b := range bad {
+		hashes := make([]crypto.Hash, len(b.indices))
+		u, err = NewSectorUpdate(b.key, sector, b.revision, b.indices, hashes, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = s.applySectorUpdate(u); err != b.expected {
+			t.Errorf("expected %v, got %v", b.expected, err)
+		}
+	}
+
+	// the signature covers the whole update
+	u, err = NewSectorUpdate(owner, sector, 2, []byte{0}, []crypto.Hash{{11}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.Hashes[0] = crypto.Hash{12}
+	if s.applySectorUpdate(u) != suerrInvalidSignature {
+		t.Error("altered update was accepted")
+	}
+	if s.applySectorUpdate(&SectorUpdate{Sector: sector, Revision: 2}) != suerrNilSigner {
+		t.Error("unsigned update was accepted")
+	}
+}
+
+// A sector created with no authorized keys can never change.
+func TestImmutableSector(t *testing.T) {
+	s, err := CreateState(common.NewZeroNetwork())
+	if err != nil {
+		t.Fatal(err)
+	}
+	creatorID, creator := newTestWallet(t, s, 0)
+	sector := crypto.Hash{1}
+	s.sectors[sector] = &sectorRecord{owner: creatorID}
+	u, err := NewSectorUpdate(creator, sector, 0, []byte{0}, []crypto.Hash{{1}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.applySectorUpdate(u); err != nil {
+		t.Fatal(err)
+	}
+	u, err = NewSectorUpdate(creator, sector, 1, []byte{0}, []crypto.Hash{{2}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.applySectorUpdate(u) != suerrImmutable {
+		t.Error("immutable sector was updated by its creator")
+	}
+}
+
+func TestSectorUpdateEncoding(t *testing.T) {
+	ownerPub, owner, err := crypto.CreateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := NewSectorUpdate(owner, crypto.Hash{1}, 0, []byte{0, 1}, []crypto.Hash{{2}, {3}}, []*crypto.PublicKey{ownerPub})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gobUpdate, err := u.GobEncode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := new(SectorUpdate)
+	err = decoded.GobDecode(gobUpdate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.verify() != nil || len(decoded.Hashes) != 2 || decoded.Hashes[1] != (crypto.Hash{3}) ||
+		len(decoded.Authorized) != 1 || !decoded.Authorized[0].Compare(ownerPub) {
+		t.Error("update changed in encoding")
+	}
+
+	// updates after creation cannot change the authorized keys
+	u, err = NewSectorUpdate(owner, crypto.Hash{1}, 1, nil, nil, []*crypto.PublicKey{ownerPub})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.verify() != suerrAuthorizedUpdate {
+		t.Error("update changed the authorized keys")
+	}
+}
@@ -0,0 +1,339 @@
+package quorum
+
+import (
+	"common"
+	"common/crypto"
+	"common/encoding"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// maxHeartbeatTransactions is the most transactions a participant may put
+// in a single heartbeat. Transactions beyond it wait for the next block.
+const maxHeartbeatTransactions = 1024
+
+// A WalletID identifies a wallet by the hash of its public key.
+type WalletID crypto.TruncatedHash
+
+// NewWalletID returns the ID of the wallet controlled by pk.
+func NewWalletID(pk *crypto.PublicKey) (id WalletID, err error) {
+	encoded, err := encoding.Marshal(pk)
+	if err != nil {
+		return
+	}
+	th, err := crypto.CalculateTruncatedHash(encoded)
+	id = WalletID(th)
+	return
+}
+
+// String returns the hex encoding of the ID.
+func (id WalletID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// ParseWalletID reads an ID written by String.
+func ParseWalletID(s string) (id WalletID, err error) {
+	decoded, err := hex.DecodeString(s)
+	if err != nil {
+		return
+	}
+	if len(decoded) != len(id) {
+		err = fmt.Errorf("wallet ID %q is %v bytes, expected %v", s, len(decoded), len(id))
+		return
+	}
+	copy(id[:], decoded)
+	return
+}
+
+// A Wallet holds a balance of siacoins. The nonce counts the transactions
+// spent from the wallet, and each transaction must carry the next nonce, so
+// that no transaction can be applied twice.
+type Wallet struct {
+	balance uint64
+	nonce   uint64
+}
+
+// Transaction Kinds
+const (
+	TransferTransaction byte = iota // pays the wallet Recipient
+	TopUpTransaction                // adds to the balance of the sector Sector
+)
+
+// A Transaction moves Amount siacoins from the wallet of Sender to the
+// destination given by its Kind. It is signed by Sender, and is valid only
+// as the Nonce'th transaction spent from that wallet.
+type Transaction struct {
+	Kind      byte
+	Sender    *crypto.PublicKey
+	Recipient WalletID    // TransferTransaction only
+	Sector    crypto.Hash // TopUpTransaction only
+	Amount    uint64
+	Nonce     uint64
+	Signature crypto.Signature
+}
+
+var txerrUnknownKind = errors.New("Transaction is of an unknown kind")
+var txerrNilSender = errors.New("Transaction has no sender")
+var txerrZeroAmount = errors.New("Transaction moves no siacoins")
+var txerrInvalidSignature = errors.New("Transaction has an invalid signature")
+var txerrUnknownWallet = errors.New("Transaction spends from a wallet that does not exist")
+var txerrWrongNonce = errors.New("Transaction nonce does not match the wallet; it is a double spend or out of order")
+var txerrInsufficientBalance = errors.New("Transaction spends more than the wallet holds")
+var txerrOverflow = errors.New("Transaction would overflow the recipient's balance")
+
+// NewTransaction creates a transaction from the wallet of secKey to the
+// wallet recipient, signed with secKey.
+func NewTransaction(secKey crypto.SecretKey, recipient WalletID, amount uint64, nonce uint64) (t *Transaction, err error) {
+	t = &Transaction{
+		Kind:      TransferTransaction,
+		Sender:    secKey.Public(),
+		Recipient: recipient,
+		Amount:    amount,
+		Nonce:     nonce,
+	}
+	err = t.sign(secKey)
+	return
+}
+
+// NewTopUp creates a transaction that pays amount from the wallet of secKey
+// into the balance of a sector, signed with secKey.
+func NewTopUp(secKey crypto.SecretKey, sector crypto.Hash, amount uint64, nonce uint64) (t *Transaction, err error) {
+	t = &Transaction{
+		Kind:   TopUpTransaction,
+		Sender: secKey.Public(),
+		Sector: sector,
+		Amount: amount,
+		Nonce:  nonce,
+	}
+	err = t.sign(secKey)
+	return
+}
+
+// sign sets the signature of the transaction.
+func (t *Transaction) sign(secKey crypto.SecretKey) (err error) {
+	body, err := t.body()
+	if err != nil {
+		return
+	}
+	signedMessage, err := secKey.Sign(body)
+	if err != nil {
+		return
+	}
+	t.Signature = signedMessage.Signature
+	return
+}
+
+// body returns the encoding of the transaction without its signature, which
+// is what the signature covers.
+func (t *Transaction) body() ([]byte, error) {
+	e := new(encoding.Encoder)
+	t.encodeBody(e)
+	return e.Bytes(), e.Err()
+}
+
+// verify checks the parts of a transaction that do not depend on the State.
+func (t *Transaction) verify() error {
+	if t.Kind != TransferTransaction && t.Kind != TopUpTransaction {
+		return txerrUnknownKind
+	}
+	if t.Sender == nil {
+		return txerrNilSender
+	}
+	if t.Amount == 0 {
+		return txerrZeroAmount
+	}
+	body, err := t.body()
+	if err != nil {
+		return err
+	}
+	if !t.Sender.Verify(&crypto.SignedMessage{Signature: t.Signature, Message: body}) {
+		return txerrInvalidSignature
+	}
+	return nil
+}
+
+// EncodeTo writes the canonical encoding of the transaction:
+//
+//	kind      uint8
+//	sender    crypto.PublicKey
+//	recipient [TruncatedHashSize]byte, for a TransferTransaction
+//	sector    [HashSize]byte, for a TopUpTransaction
+//	amount    uint64
+//	nonce     uint64
+//	signature crypto.Signature
+func (t *Transaction) EncodeTo(e *encoding.Encoder) {
+	t.encodeBody(e)
+	t.Signature.EncodeTo(e)
+}
+
+func (t *Transaction) encodeBody(e *encoding.Encoder) {
+	e.WriteUint8(t.Kind)
+	t.Sender.EncodeTo(e)
+	switch t.Kind {
+	case TransferTransaction:
+		e.WriteFixed(t.Recipient[:])
+	case TopUpTransaction:
+		e.WriteFixed(t.Sector[:])
+	default:
+		e.Fail(txerrUnknownKind)
+	}
+	e.WriteUint64(t.Amount)
+	e.WriteUint64(t.Nonce)
+}
+
+// DecodeFrom reads a transaction written by EncodeTo.
+func (t *Transaction) DecodeFrom(d *encoding.Decoder) {
+	t.Kind = d.ReadUint8()
+	t.Sender = new(crypto.PublicKey)
+	t.Sender.DecodeFrom(d)
+	switch t.Kind {
+	case TransferTransaction:
+		d.ReadFixed(t.Recipient[:])
+	case TopUpTransaction:
+		d.ReadFixed(t.Sector[:])
+	default:
+		d.Fail(txerrUnknownKind)
+	}
+	t.Amount = d.ReadUint64()
+	t.Nonce = d.ReadUint64()
+	t.Signature.DecodeFrom(d)
+}
+
+func (t *Transaction) GobEncode() ([]byte, error) {
+	return t.EncodeVersion(common.ProtocolVersion)
+}
+
+func (t *Transaction) EncodeVersion(version uint16) (gobTransaction []byte, err error) {
+	if t == nil {
+		err = fmt.Errorf("Cannot encode nil value t")
+		return
+	}
+	var encoded []byte
+	switch version {
+	case 14, 15:
+		encoded, err = encoding.Marshal(t)
+	default:
+		err = fmt.Errorf("Cannot encode a Transaction at version %v", version)
+	}
+	if err != nil {
+		return
+	}
+	gobTransaction = common.VersionedEnvelope(version, encoded)
+	return
+}
+
+func (t *Transaction) GobDecode(gobTransaction []byte) (err error) {
+	if t == nil {
+		err = fmt.Errorf("Cannot decode into nil Transaction")
+		return
+	}
+
+	version, body, err := common.OpenEnvelope(gobTransaction)
+	if err != nil {
+		return
+	}
+	switch version {
+	case 14, 15:
+		err = encoding.Unmarshal(body, t)
+	default:
+		err = fmt.Errorf("Cannot decode a Transaction of version %v", version)
+	}
+	return
+}
+
+// applyTransaction moves the siacoins of a transaction from the sender's
+// wallet, creating the recipient's wallet or sector if it does not exist. A
+// transaction that is invalid, or that spends coins the sender no longer
+// has, is rejected and changes nothing. applyTransaction only runs during
+// compile().
+func (s *State) applyTransaction(t *Transaction) (err error) {
+	err = t.verify()
+	if err != nil {
+		return
+	}
+	senderID, err := NewWalletID(t.Sender)
+	if err != nil {
+		return
+	}
+
+	s.walletsLock.Lock()
+	defer s.walletsLock.Unlock()
+	sender := s.wallets[senderID]
+	if sender == nil {
+		return txerrUnknownWallet
+	}
+	if t.Nonce != sender.nonce {
+		return txerrWrongNonce
+	}
+	if t.Amount > sender.balance {
+		return txerrInsufficientBalance
+	}
+
+	switch t.Kind {
+	case TransferTransaction:
+		recipient := s.wallets[t.Recipient]
+		if recipient == nil {
+			recipient = new(Wallet)
+		}
+		if senderID != t.Recipient && recipient.balance+t.Amount < recipient.balance {
+			return txerrOverflow
+		}
+		sender.balance -= t.Amount
+		recipient.balance += t.Amount
+		s.wallets[t.Recipient] = recipient
+	case TopUpTransaction:
+		sector := s.sectors[t.Sector]
+		if sector == nil {
+			sector = &sectorRecord{owner: senderID}
+		}
+		if sector.balance+t.Amount < sector.balance {
+			return txerrOverflow
+		}
+		sender.balance -= t.Amount
+		sector.balance += t.Amount
+		s.sectors[t.Sector] = sector
+	}
+	sender.nonce++
+	return
+}
+
+// HandleTransaction takes a transaction from a client and queues it to be
+// put in our next heartbeat. The transaction is checked against the State
+// only when it is compiled, since earlier transactions in the block may
+// change the sender's wallet.
+func (s *State) HandleTransaction(t Transaction, arb *struct{}) (err error) {
+	err = t.verify()
+	if err != nil {
+		return
+	}
+	s.walletsLock.Lock()
+	s.pendingTransactions = append(s.pendingTransactions, &t)
+	s.walletsLock.Unlock()
+	return
+}
+
+// takePendingTransactions removes and returns as many queued transactions as
+// fit in a heartbeat.
+func (s *State) takePendingTransactions() (transactions []*Transaction) {
+	s.walletsLock.Lock()
+	defer s.walletsLock.Unlock()
+	n := len(s.pendingTransactions)
+	if n > maxHeartbeatTransactions {
+		n = maxHeartbeatTransactions
+	}
+	transactions = s.pendingTransactions[:n]
+	s.pendingTransactions = s.pendingTransactions[n:]
+	return
+}
+
+// Balance returns the balance of a wallet and the nonce its next transaction
+// must carry. Wallets that do not exist have a balance of 0.
+func (s *State) Balance(id WalletID) (balance uint64, nonce uint64) {
+	s.walletsLock.RLock()
+	defer s.walletsLock.RUnlock()
+	if w := s.wallets[id]; w != nil {
+		balance, nonce = w.balance, w.nonce
+	}
+	return
+}
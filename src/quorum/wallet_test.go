@@ -0,0 +1,263 @@
+package quorum
+
+import (
+	"common"
+	"common/crypto"
+	"common/encoding"
+	"testing"
+)
+
+// newTestWallet creates a key pair and gives its wallet balance siacoins.
+func newTestWallet(t *testing.T, s *State, balance uint64) (id WalletID, secKey crypto.SecretKey) {
+	pubKey, secKey, err := crypto.CreateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err = NewWalletID(pubKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.wallets[id] = &Wallet{balance: balance}
+	return
+}
+
+func TestTransactionSignature(t *testing.T) {
+	_, secKey, err := crypto.CreateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, err := NewTransaction(secKey, WalletID{1}, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tx.verify(); err != nil {
+		t.Fatal("signed transaction did not verify:", err)
+	}
+
+	tx.Amount = 11
+	if tx.verify() != txerrInvalidSignature {
+		t.Error("altered transaction verified")
+	}
+	tx.Amount = 0
+	if tx.verify() != txerrZeroAmount {
+		t.Error("transaction of nothing was accepted")
+	}
+	tx.Sender = nil
+	if tx.verify() != txerrNilSender {
+		t.Error("transaction without a sender was accepted")
+	}
+}
+
+func TestTransactionEncoding(t *testing.T) {
+	_, secKey, err := crypto.CreateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, err := NewTransaction(secKey, WalletID{1}, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gobTx, err := tx.GobEncode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := new(Transaction)
+	err = decoded.GobDecode(gobTx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Recipient != tx.Recipient || decoded.Amount != 10 || decoded.Nonce != 3 || decoded.verify() != nil {
+		t.Error("transaction changed in encoding")
+	}
+
+	// transactions travel in heartbeats
+	hb := goldenHeartbeat()
+	hb.transactions = []*Transaction{tx, tx}
+	encoded, err := encoding.Marshal(hb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decodedHb := new(heartbeat)
+	err = encoding.Unmarshal(encoded, decodedHb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decodedHb.transactions) != 2 || decodedHb.transactions[1].verify() != nil {
+		t.Error("heartbeat transactions changed in encoding")
+	}
+}
+
+// Conflicting transactions from the same wallet: only the first to be
+// applied succeeds.
+func TestApplyTransaction(t *testing.T) {
+	s, err := CreateState(common.NewZeroNetwork())
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, aKey := newTestWallet(t, s, 100)
+	b, _ := newTestWallet(t, s, 0)
+	c := WalletID{3}
+
+	tx1, _ := NewTransaction(aKey, b, 60, 0)
+	tx2, _ := NewTransaction(aKey, c, 60, 0)
+	tx3, _ := NewTransaction(aKey, c, 60, 1)
+	tx4, _ := NewTransaction(aKey, c, 40, 1)
+
+	if err = s.applyTransaction(tx1); err != nil {
+		t.Fatal("valid transaction was rejected:", err)
+	}
+	if s.applyTransaction(tx1) != txerrWrongNonce {
+		t.Error("replayed transaction was not rejected")
+	}
+	if s.applyTransaction(tx2) != txerrWrongNonce {
+		t.Error("double spend was not rejected")
+	}
+	if s.applyTransaction(tx3) != txerrInsufficientBalance {
+		t.Error("overspend was not rejected")
+	}
+	if err = s.applyTransaction(tx4); err != nil {
+		t.Fatal("valid transaction was rejected:", err)
+	}
+
+	if balance, nonce := s.Balance(a); balance != 0 || nonce != 2 {
+		t.Error("sender wallet is wrong:", balance, nonce)
+	}
+	if balance, _ := s.Balance(b); balance != 60 {
+		t.Error("recipient wallet is wrong:", balance)
+	}
+	if balance, _ := s.Balance(c); balance != 40 {
+		t.Error("new wallet is wrong:", balance)
+	}
+
+	// a wallet that has never received anything cannot spend
+	_, unknownKey, _ := crypto.CreateKeyPair()
+	tx5, _ := NewTransaction(unknownKey, a, 1, 0)
+	if s.applyTransaction(tx5) != txerrUnknownWallet {
+		t.Error("spend from an unknown wallet was not rejected")
+	}
+}
+
+// Participants that compile the same heartbeats with the same entropy
+// resolve conflicting transactions the same way.
+func TestCompileTransactions(t *testing.T) {
+	aPub, aKey, err := crypto.CreateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := NewWalletID(aPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := DefaultConfig()
+	config.Genesis = map[WalletID]uint64{a: 100}
+
+	var states []*State
+	for i := 0; i < 2; i++ {
+		_, secKey, err := crypto.CreateKeyPair()
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := CreateStateWithConfig(common.NewZeroNetwork(), secKey, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fillQuorum(s)
+		states = append(states, s)
+	}
+	if balance, _ := states[1].Balance(a); balance != 100 {
+		t.Fatal("genesis balance was not given:", balance)
+	}
+
+	// every participant puts a different spend of the whole wallet in its
+	// heartbeat
+	var heartbeats []*heartbeat
+	for i := 0; i < common.DefaultQuorumSize; i++ {
+		tx, err := NewTransaction(aKey, WalletID{byte(i + 1)}, 100, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hb := goldenHeartbeat()
+		hb.transactions = []*Transaction{tx}
+		heartbeats = append(heartbeats, hb)
+	}
+	for _, s := range states {
+		for i, hb := range heartbeats {
+			s.heartbeats[i] = map[crypto.TruncatedHash]*heartbeat{{byte(i)}: hb}
+		}
+		s.compile()
+	}
+
+	winners := 0
+	for i := range heartbeats {
+		b0, _ := states[0].Balance(WalletID{byte(i + 1)})
+		b1, _ := states[1].Balance(WalletID{byte(i + 1)})
+		if b0 != b1 {
+			t.Error("states resolved the conflict differently")
+		}
+		if b0 == 100 {
+			winners++
+		}
+	}
+	if winners != 1 {
+		t.Error("expected exactly one transaction to succeed, got", winners)
+	}
+	if balance, _ := states[0].Balance(a); balance != 0 {
+		t.Error("genesis balance was not spent:", balance)
+	}
+}
+
+func TestWalletIDString(t *testing.T) {
+	id := WalletID{1, 2, 0xff}
+	parsed, err := ParseWalletID(id.String())
+	if err != nil || parsed != id {
+		t.Error("wallet ID changed in its string:", parsed, err)
+	}
+	if _, err = ParseWalletID("0102"); err == nil {
+		t.Error("parsed a wallet ID that is too short")
+	}
+	if _, err = ParseWalletID("not hex"); err == nil {
+		t.Error("parsed a wallet ID that is not hex")
+	}
+}
+
+// Queued transactions go into our next heartbeat.
+func TestHandleTransaction(t *testing.T) {
+	s, err := CreateState(common.NewZeroNetwork())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, secKey, err := crypto.CreateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, err := NewTransaction(secKey, WalletID{1}, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad := *tx
+	bad.Amount = 11
+	if s.HandleTransaction(bad, nil) == nil {
+		t.Error("queued a transaction with an invalid signature")
+	}
+	if err = s.HandleTransaction(*tx, nil); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < maxHeartbeatTransactions; i++ {
+		s.pendingTransactions = append(s.pendingTransactions, tx)
+	}
+
+	hb, err := s.newHeartbeat(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hb.transactions) != maxHeartbeatTransactions {
+		t.Error("heartbeat holds", len(hb.transactions), "transactions")
+	}
+	hb, err = s.newHeartbeat(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hb.transactions) != 1 {
+		t.Error("leftover transaction was not put in the next heartbeat")
+	}
+}
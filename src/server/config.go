@@ -0,0 +1,316 @@
+package main
+
+import (
+	"common"
+	"common/log"
+	"discovery"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"network"
+	"os"
+	"quorum"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// hostConfig holds everything needed to run a host without prompting. Values
+// are read from a JSON config file and then overridden by command-line flags.
+type hostConfig struct {
+	Port         int      // port the RPCServer listens on
+	BindHost     string   // local address to listen on; every interface if empty
+	Advertise    string   // host other hosts reach this one at; detected if empty
+	LearnAddress bool     // advertise the host that peers observe, once they agree
+	Bootstrap    string   // host:port of the bootstrap participant; found through discovery if empty
+	Seeds        []string // host:port of each host to ask for peers
+	QuorumSize   int      // participants in each quorum; every participant must agree
+	Fanout       int      // participants each message is gossiped to; 0 for all
+	PeerFile     string   // file holding the peer database
+	StorageDir   string   // directory holding the host's files
+	Capacity     uint64   // bytes of storage offered
+	KeyFile      string   // file holding the participant's identity key
+	LogLevel     string   // one of fatal, error, warning, info, debug
+
+	// the step starts at StepDuration and adapts to the measured latency,
+	// between MinStep and MaxStep; every participant must agree
+	StepDuration time.Duration
+	MinStep      time.Duration
+	MaxStep      time.Duration
+
+	SectorPayout uint64 // siacoins paid to each host per sector per block
+
+	// a participant locks DownPayment siacoins to join, and is refunded
+	// DepositCooldown blocks after it leaves; it stays HandOffBlocks blocks
+	// after announcing it is leaving
+	DownPayment     uint64
+	DepositCooldown uint64
+	HandOffBlocks   uint64
+
+	// Genesis maps the hex ID of each wallet to its balance when the quorum
+	// starts; it is only read from the config file, and every participant
+	// must agree
+	Genesis map[string]uint64
+
+	// EntropyFile holds a hex seed per block, mixed into the quorum's
+	// entropy; every participant must use the same seeds
+	EntropyFile string
+}
+
+// defaultConfig returns the configuration used when no file or flags are
+// given.
+func defaultConfig() hostConfig {
+	return hostConfig{
+		Port:       9988,
+		QuorumSize: common.DefaultQuorumSize,
+		PeerFile:   "peers.json",
+		StorageDir: "storage",
+		Capacity:   16 << 30, // 16 GB, the per-quorum share in the whitepaper
+		LogLevel:   "warning",
+
+		StepDuration: quorum.DefaultConfig().StepDuration,
+		MinStep:      quorum.DefaultConfig().MinStepDuration,
+		MaxStep:      quorum.DefaultConfig().MaxStepDuration,
+		SectorPayout: quorum.DefaultSectorPayout,
+
+		DepositCooldown: quorum.DefaultDepositCooldown,
+		HandOffBlocks:   quorum.DefaultHandOffBlocks,
+	}
+}
+
+// logLevels maps each level name to the priority flags that are logged
+// immediately at that level.
+var logLevels = map[string]uint{
+	"fatal":   log.Pfatal,
+	"error":   log.Pfatal | log.Perror,
+	"warning": log.PstdFlags,
+	"info":    log.PstdFlags | log.Pinfo,
+	"debug":   log.PdebugFlags,
+}
+
+// loadConfigFile reads a JSON config file over the values already in c.
+// Fields missing from the file keep their current values.
+func (c *hostConfig) loadConfigFile(filename string) (err error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	return json.NewDecoder(file).Decode(c)
+}
+
+// parseConfig builds the configuration from the defaults, then the config
+// file named by -config (if any), then any other flags that were given.
+func parseConfig(args []string) (c hostConfig, err error) {
+	c = defaultConfig()
+	var flagConfig hostConfig
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	configFile := fs.String("config", "", "JSON config file")
+	fs.IntVar(&flagConfig.Port, "port", c.Port, "port to listen on")
+	fs.StringVar(&flagConfig.BindHost, "bind", c.BindHost, "local address to listen on")
+	fs.StringVar(&flagConfig.Advertise, "advertise", c.Advertise, "host other hosts should reach this one at")
+	fs.BoolVar(&flagConfig.LearnAddress, "learn-address", c.LearnAddress, "advertise the host that peers observe")
+	fs.StringVar(&flagConfig.Bootstrap, "bootstrap", c.Bootstrap, "host:port of the bootstrap participant")
+	seeds := fs.String("seeds", "", "comma separated host:port of each seed")
+	fs.IntVar(&flagConfig.QuorumSize, "quorum-size", c.QuorumSize, "participants in each quorum")
+	fs.IntVar(&flagConfig.Fanout, "fanout", c.Fanout, "participants each message is gossiped to, 0 for all")
+	fs.DurationVar(&flagConfig.StepDuration, "step", c.StepDuration, "length of a step in the first block")
+	fs.DurationVar(&flagConfig.MinStep, "min-step", c.MinStep, "shortest the step may adapt to")
+	fs.DurationVar(&flagConfig.MaxStep, "max-step", c.MaxStep, "longest the step may adapt to")
+	fs.Uint64Var(&flagConfig.SectorPayout, "sector-payout", c.SectorPayout, "siacoins paid to each host per sector per block")
+	fs.Uint64Var(&flagConfig.DownPayment, "down-payment", c.DownPayment, "siacoins a participant locks to join")
+	fs.Uint64Var(&flagConfig.DepositCooldown, "deposit-cooldown", c.DepositCooldown, "blocks before a departed participant is refunded")
+	fs.Uint64Var(&flagConfig.HandOffBlocks, "hand-off", c.HandOffBlocks, "blocks a departing participant stays to hand off its segments")
+	fs.StringVar(&flagConfig.EntropyFile, "entropy-file", c.EntropyFile, "file of external seeds, one per block")
+	fs.StringVar(&flagConfig.PeerFile, "peers", c.PeerFile, "file holding the peer database")
+	fs.StringVar(&flagConfig.StorageDir, "storage", c.StorageDir, "directory to store files in")
+	fs.Uint64Var(&flagConfig.Capacity, "capacity", c.Capacity, "bytes of storage to offer")
+	fs.StringVar(&flagConfig.KeyFile, "keyfile", c.KeyFile, "file holding the participant key")
+	fs.StringVar(&flagConfig.LogLevel, "loglevel", c.LogLevel, "fatal, error, warning, info or debug")
+	err = fs.Parse(args)
+	if err != nil {
+		return
+	}
+
+	if *configFile != "" {
+		err = c.loadConfigFile(*configFile)
+		if err != nil {
+			return
+		}
+	}
+
+	// only flags that were explicitly set override the config file
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "port":
+			c.Port = flagConfig.Port
+		case "bind":
+			c.BindHost = flagConfig.BindHost
+		case "advertise":
+			c.Advertise = flagConfig.Advertise
+		case "learn-address":
+			c.LearnAddress = flagConfig.LearnAddress
+		case "bootstrap":
+			c.Bootstrap = flagConfig.Bootstrap
+		case "seeds":
+			c.Seeds = strings.Split(*seeds, ",")
+		case "quorum-size":
+			c.QuorumSize = flagConfig.QuorumSize
+		case "fanout":
+			c.Fanout = flagConfig.Fanout
+		case "step":
+			c.StepDuration = flagConfig.StepDuration
+		case "min-step":
+			c.MinStep = flagConfig.MinStep
+		case "max-step":
+			c.MaxStep = flagConfig.MaxStep
+		case "sector-payout":
+			c.SectorPayout = flagConfig.SectorPayout
+		case "down-payment":
+			c.DownPayment = flagConfig.DownPayment
+		case "deposit-cooldown":
+			c.DepositCooldown = flagConfig.DepositCooldown
+		case "hand-off":
+			c.HandOffBlocks = flagConfig.HandOffBlocks
+		case "entropy-file":
+			c.EntropyFile = flagConfig.EntropyFile
+		case "peers":
+			c.PeerFile = flagConfig.PeerFile
+		case "storage":
+			c.StorageDir = flagConfig.StorageDir
+		case "capacity":
+			c.Capacity = flagConfig.Capacity
+		case "keyfile":
+			c.KeyFile = flagConfig.KeyFile
+		case "loglevel":
+			c.LogLevel = flagConfig.LogLevel
+		}
+	})
+
+	err = c.validate()
+	return
+}
+
+// validate checks that every value in the configuration is usable.
+func (c *hostConfig) validate() (err error) {
+	if c.Port <= 0 || c.Port > 65535 {
+		return fmt.Errorf("invalid port %v", c.Port)
+	}
+	if err = common.ValidateQuorumSize(c.QuorumSize); err != nil {
+		return
+	}
+	if c.Fanout < 0 {
+		return fmt.Errorf("invalid fanout %v", c.Fanout)
+	}
+	if c.MinStep < time.Millisecond || c.StepDuration < c.MinStep || c.StepDuration > c.MaxStep {
+		return fmt.Errorf("invalid step duration %v, must be between %v and %v", c.StepDuration, c.MinStep, c.MaxStep)
+	}
+	if c.SectorPayout == 0 {
+		return fmt.Errorf("sector payout must be at least 1")
+	}
+	if c.HandOffBlocks == 0 {
+		return fmt.Errorf("hand-off must last at least 1 block")
+	}
+	if _, err = c.genesis(); err != nil {
+		return
+	}
+	if c.BindHost != "" && net.ParseIP(c.BindHost) == nil {
+		return fmt.Errorf("invalid bind address %q", c.BindHost)
+	}
+	if c.Bootstrap != "" {
+		if _, err = c.bootstrapAddress(); err != nil {
+			return
+		}
+	}
+	if _, err = c.seedAddresses(); err != nil {
+		return
+	}
+	if c.StorageDir == "" {
+		return fmt.Errorf("no storage directory given")
+	}
+	if _, ok := logLevels[c.LogLevel]; !ok {
+		return fmt.Errorf("unknown log level %q", c.LogLevel)
+	}
+	return
+}
+
+// parseAddress converts a host:port string into an Address with the given ID.
+func parseAddress(hostport string, id common.Identifier) (a common.Address, err error) {
+	host, portString, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		err = fmt.Errorf("invalid port %q", portString)
+		return
+	}
+	a = common.Address{
+		ID:   id,
+		Host: host,
+		Port: port,
+	}
+	return
+}
+
+// serverConfig returns the configuration of the host's RPCServer.
+func (c *hostConfig) serverConfig() network.ServerConfig {
+	return network.ServerConfig{
+		BindHost:      c.BindHost,
+		Port:          c.Port,
+		AdvertiseHost: c.Advertise,
+		LearnAddress:  c.LearnAddress,
+		Timeout:       c.MaxStep,
+	}
+}
+
+// quorumConfig returns the parameters of the quorum the host participates in.
+func (c *hostConfig) quorumConfig() quorum.Config {
+	config := quorum.DefaultConfig()
+	config.QuorumSize = c.QuorumSize
+	config.StepDuration = c.StepDuration
+	config.MinStepDuration = c.MinStep
+	config.MaxStepDuration = c.MaxStep
+	config.SectorPayout = c.SectorPayout
+	config.DownPayment = c.DownPayment
+	config.DepositCooldown = c.DepositCooldown
+	config.HandOffBlocks = c.HandOffBlocks
+	config.Genesis, _ = c.genesis()
+	return config
+}
+
+// genesis converts the Genesis into the balance of each wallet.
+func (c *hostConfig) genesis() (genesis map[quorum.WalletID]uint64, err error) {
+	genesis = make(map[quorum.WalletID]uint64)
+	for hexID, balance := range c.Genesis {
+		var id quorum.WalletID
+		id, err = quorum.ParseWalletID(hexID)
+		if err != nil {
+			return
+		}
+		genesis[id] = balance
+	}
+	return
+}
+
+// bootstrapAddress converts the Bootstrap string into an Address. The
+// bootstrap State is the first handler registered on its server, so it
+// always has ID 1.
+func (c *hostConfig) bootstrapAddress() (common.Address, error) {
+	return parseAddress(c.Bootstrap, 1)
+}
+
+// seedAddresses converts the Seeds into the addresses of their Discovery
+// handlers.
+func (c *hostConfig) seedAddresses() (seeds []common.Address, err error) {
+	for _, seed := range c.Seeds {
+		var a common.Address
+		a, err = parseAddress(seed, discovery.HandlerID)
+		if err != nil {
+			return
+		}
+		seeds = append(seeds, a)
+	}
+	return
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"os"
+	"quorum"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Flags override the config file, which overrides the defaults.
+func TestParseConfig(t *testing.T) {
+	// defaults only
+	c, err := parseConfig(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(c, defaultConfig()) {
+		t.Error("parsing no arguments did not produce the default config")
+	}
+
+	// write a config file that changes some values
+	file, err := os.Create("test.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("test.conf")
+	wallet := strings.Repeat("ab", 32)
+	_, err = file.WriteString(`{"Port": 9000, "StorageDir": "fromfile", "LogLevel": "debug", "Genesis": {"` + wallet + `": 500}}`)
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err = parseConfig([]string{"-config", "test.conf", "-port", "9001", "-bootstrap", "10.0.0.1:9002", "-seeds", "a:1,b:2", "-fanout", "3", "-quorum-size", "128"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Port != 9001 {
+		t.Error("flag did not override the config file port:", c.Port)
+	}
+	if c.Fanout != 3 || c.quorumConfig().QuorumSize != 128 {
+		t.Error("quorum flags were not read:", c.Fanout, c.QuorumSize)
+	}
+	if c.StorageDir != "fromfile" || c.LogLevel != "debug" {
+		t.Error("config file values were not loaded:", c)
+	}
+	id, _ := quorum.ParseWalletID(wallet)
+	if c.quorumConfig().Genesis[id] != 500 {
+		t.Error("genesis was not loaded:", c.Genesis)
+	}
+	if c.Capacity != defaultConfig().Capacity {
+		t.Error("value missing from the config file lost its default:", c.Capacity)
+	}
+	a, err := c.bootstrapAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Host != "10.0.0.1" || a.Port != 9002 || a.ID != 1 {
+		t.Error("bootstrap address parsed incorrectly:", a)
+	}
+
+	// IPv6 addresses are accepted in brackets
+	c, err = parseConfig([]string{"-bind", "::1", "-advertise", "2001:db8::1", "-bootstrap", "[2001:db8::2]:9002"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := c.serverConfig()
+	if sc.BindHost != "::1" || sc.AdvertiseHost != "2001:db8::1" || sc.Port != c.Port || sc.Timeout != c.MaxStep {
+		t.Error("server config built incorrectly:", sc)
+	}
+	a, err = c.bootstrapAddress()
+	if err != nil || a.Host != "2001:db8::2" {
+		t.Error("IPv6 bootstrap address parsed incorrectly:", a, err)
+	}
+
+	c, err = parseConfig([]string{"-config", "test.conf", "-seeds", "a:1,b:2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	seeds, err := c.seedAddresses()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seeds) != 2 || seeds[1].Host != "b" || seeds[1].Port != 2 {
+		t.Error("seeds parsed incorrectly:", seeds)
+	}
+
+	// step durations are read as Go durations
+	c, err = parseConfig([]string{"-step", "200ms", "-min-step", "50ms", "-max-step", "2s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	qc := c.quorumConfig()
+	if qc.StepDuration != 200*time.Millisecond || qc.MinStepDuration != 50*time.Millisecond || qc.MaxStepDuration != 2*time.Second {
+		t.Error("step flags were not read:", qc)
+	}
+
+	c, err = parseConfig([]string{"-down-payment", "100", "-deposit-cooldown", "4", "-hand-off", "2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	qc = c.quorumConfig()
+	if qc.DownPayment != 100 || qc.DepositCooldown != 4 || qc.HandOffBlocks != 2 {
+		t.Error("down payment flags were not read:", qc)
+	}
+
+	c, err = parseConfig([]string{"-entropy-file", "seeds.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.EntropyFile != "seeds.txt" {
+		t.Error("entropy file was not read:", c.EntropyFile)
+	}
+
+	// bad values are rejected
+	bad := [][]string{
+		{"-port", "0"},
+		{"-bootstrap", "nocolon"},
+		{"-bind", "not an address"},
+		{"-fanout", "-1"},
+		{"-quorum-size", "1"},
+		{"-min-step", "0s"},
+		{"-step", "10ms", "-min-step", "50ms"},
+		{"-sector-payout", "0"},
+		{"-hand-off", "0"},
+		{"-seeds", "a:1,nocolon"},
+		{"-loglevel", "loud"},
+		{"-storage", ""},
+		{"-config", "missing.conf"},
+	}
+	for _, args := range bad {
+		_, err = parseConfig(args)
+		if err == nil {
+			t.Error("accepted invalid arguments", args)
+		}
+	}
+
+	c = defaultConfig()
+	c.Genesis = map[string]uint64{"nothex": 1}
+	if c.validate() == nil {
+		t.Error("accepted a genesis wallet that is not a wallet ID")
+	}
+}
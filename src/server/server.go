@@ -1,38 +1,313 @@
 package main
 
 import (
+	"common"
+	"common/crypto"
+	"common/log"
+	"discovery"
+	"disk"
+	"errors"
 	"fmt"
 	"network"
+	"os"
+	"os/signal"
+	"path/filepath"
 	"quorum"
+	"syscall"
 )
 
-func establishQuorum() {
-	var port int
-	print("Port number: ")
-	fmt.Scanf("%d", &port)
-	networkServer, err := network.NewRPCServer(port)
+var errUnexpectedSegment = errors.New("segment was not set by an update to the sector")
+
+// segmentHandlerID is the ID of the Segments handler, which is registered
+// after the State and Discovery, and before the Server.
+const segmentHandlerID = 3
+
+// Segments serves the segments a host stores, so that a successor can fetch
+// the segments handed off to it.
+type Segments struct {
+	store *disk.SegmentStore
+}
+
+// Fetch returns the segment with the given hash.
+func (s *Segments) Fetch(hash crypto.Hash, data *[]byte) (err error) {
+	*data, err = s.store.Get(hash)
+	return
+}
+
+// Server serves clients: it accepts the segments they upload, and returns
+// them on request.
+type Server struct {
+	host *host
+}
+
+// UploadSegment stores an uploaded segment, provided the quorum has agreed,
+// through an authorized update, that we store it for its sector. Any other
+// segment is rejected, so that clients cannot fill our storage with segments
+// nobody pays for.
+func (s *Server) UploadSegment(upload common.Upload, arb *struct{}) error {
+	return s.host.storeSegment(upload.Sector, upload.Segment.Data)
+}
+
+// DownloadSegment returns the segment with the given hash. We do not know
+// where in the ring the segment belongs, so the client sets its Index.
+func (s *Server) DownloadSegment(hash crypto.Hash, segment *common.Segment) (err error) {
+	segment.Data, err = s.host.segments.Get(hash)
+	return
+}
+
+// A host is a running participant: the RPCServer it listens on, the quorum
+// State it participates with, the storage it offers, and the peers it knows.
+type host struct {
+	config    hostConfig
+	router    *network.RPCServer
+	state     *quorum.State
+	storage   *disk.MultiVolumeStorage
+	segments  *disk.SegmentStore
+	peers     *discovery.PeerDB
+	discovery *discovery.Discovery
+}
+
+// newHost opens the storage, starts the RPCServer, creates the State
+// described by config and finds a bootstrap participant. It does not join
+// Sia.
+func newHost(config hostConfig) (h *host, err error) {
+	h = &host{config: config}
+
+	err = os.MkdirAll(config.StorageDir, os.ModeDir|os.ModePerm)
+	if err != nil {
+		return
+	}
+	h.storage = disk.CreateMultiVolumeStorage("host", nil)
+	err = h.storage.AddVolume(config.StorageDir, config.Capacity)
+	if err != nil {
+		return
+	}
+	h.segments, err = disk.LoadSegmentStore(h.storage, filepath.Join(config.StorageDir, "segments.json"))
+	if err != nil {
+		return
+	}
+	h.peers, err = discovery.LoadPeerDB(config.PeerFile)
+	if err != nil {
+		return
+	}
+
+	var secKey crypto.SecretKey
+	if config.KeyFile == "" {
+		_, secKey, err = crypto.CreateKeyPair()
+	} else {
+		secKey, err = loadIdentity(config.KeyFile)
+	}
+	if err != nil {
+		return
+	}
+
+	// the State must be registered first and Discovery second, so that
+	// they receive the IDs other hosts expect
+	h.router, err = network.NewRPCServerWithConfig(config.serverConfig())
+	if err != nil {
+		return
+	}
+	h.state, err = quorum.CreateStateWithConfig(h.router, secKey, config.quorumConfig())
+	if err == nil {
+		h.state.SetFanout(config.Fanout)
+		h.state.SetSectorDeleter(h.deleteSector)
+		h.state.SetHandOff(h.handOff)
+		err = h.setEntropySource(config.EntropyFile)
+	}
+	if err == nil {
+		h.discovery, err = discovery.New(h.router, secKey, h.state.Address, h.peers)
+	}
+	if err == nil {
+		id := h.router.RegisterHandler(&Segments{h.segments})
+		if id != segmentHandlerID {
+			err = fmt.Errorf("Segments registered with ID %v, expected %v", id, segmentHandlerID)
+		}
+	}
+	if err == nil {
+		id := h.router.RegisterHandler(&Server{h})
+		if id != common.ServerHandlerID {
+			err = fmt.Errorf("Server registered with ID %v, expected %v", id, common.ServerHandlerID)
+		}
+	}
+	if err == nil {
+		err = h.findBootstrap()
+	}
 	if err != nil {
-		println(err)
+		h.router.Close()
 		return
 	}
-	s, err := quorum.CreateState(networkServer)
-	s.JoinSia()
-	select {}
+	return
 }
 
-func main() {
-	var input string
-	for {
-		print("Please enter a command: ")
-		fmt.Scanln(&input)
-
-		switch input {
-		default:
-			println("unrecognized command")
-		case "e":
-			establishQuorum()
-		case "q":
+// findBootstrap sets the bootstrap address. An explicitly configured address
+// is used as is. Otherwise the seeds are asked for peers, and the most
+// recently seen peer that is not ourselves becomes the bootstrap. If no peer
+// is known, this host bootstraps a new quorum itself.
+func (h *host) findBootstrap() (err error) {
+	if h.config.Bootstrap != "" {
+		var bootstrap common.Address
+		bootstrap, err = h.config.bootstrapAddress()
+		if err != nil {
 			return
 		}
+		quorum.SetBootstrapAddress(bootstrap)
+		return
+	}
+
+	seeds, err := h.config.seedAddresses()
+	if err != nil {
+		return
+	}
+	err = discovery.Discover(h.router, seeds, h.peers)
+	if err != nil {
+		log.Warning("peer discovery failed: ", err)
+	}
+
+	self := h.state.Address()
+	for _, a := range h.peers.Addresses() {
+		if a != self {
+			quorum.SetBootstrapAddress(a)
+			return nil
+		}
+	}
+	log.Info("no peers found, bootstrapping a new quorum")
+	quorum.SetBootstrapAddress(self)
+	return nil
+}
+
+// deleteSector releases the segments we store of a sector whose balance has
+// run out.
+func (h *host) deleteSector(sector crypto.Hash, segments []crypto.Hash) {
+	for _, segment := range segments {
+		if !h.segments.Holds(sector, segment) {
+			continue
+		}
+		err := h.segments.Release(sector, segment)
+		if err != nil {
+			log.Warning("could not delete segment of expired sector: ", err)
+		}
+	}
+}
+
+// storeSegment stores our segment of a sector, provided the quorum has
+// agreed, through an authorized update, that we should store it.
+func (h *host) storeSegment(sector crypto.Hash, data []byte) (err error) {
+	hash, err := crypto.CalculateHash(data)
+	if err != nil {
+		return
+	}
+	if !h.state.ExpectsSegment(sector, hash) {
+		return errUnexpectedSegment
+	}
+	_, err = h.segments.Put(sector, data)
+	return
+}
+
+// setEntropySource mixes the seeds in filename into the quorum's entropy. No
+// file mixes in nothing.
+func (h *host) setEntropySource(filename string) (err error) {
+	if filename == "" {
+		return
+	}
+	source, err := quorum.NewFileEntropySource(filename)
+	if err != nil {
+		return
+	}
+	h.state.SetExternalEntropySource(source)
+	return
+}
+
+// handOff fetches the segments our predecessor hands off to us.
+func (h *host) handOff(predecessor common.Address, list quorum.HandOffList) {
+	for i := range list.Sectors {
+		data, err := h.fetchSegment(predecessor, list.Segments[i])
+		if err == nil {
+			err = h.storeSegment(list.Sectors[i], data)
+		}
+		if err != nil {
+			log.Warning("could not fetch handed off segment: ", err)
+		}
+	}
+}
+
+// fetchSegment asks the host at a, which may be the address of any of its
+// handlers, for a segment.
+func (h *host) fetchSegment(a common.Address, segment crypto.Hash) (data []byte, err error) {
+	a.ID = segmentHandlerID
+	err = h.router.SendMessage(&common.Message{
+		Dest: a,
+		Proc: "Segments.Fetch",
+		Args: segment,
+		Resp: &data,
+	})
+	return
+}
+
+// loadIdentity loads the participant key from filename, generating and saving
+// a new key the first time the host runs. The key is encrypted with
+// SIA_KEY_PASSPHRASE if it is set.
+func loadIdentity(filename string) (secKey crypto.SecretKey, err error) {
+	passphrase := []byte(os.Getenv("SIA_KEY_PASSPHRASE"))
+	secKey, err = crypto.LoadSecretKey(filename, passphrase)
+	if !os.IsNotExist(err) {
+		return
+	}
+
+	log.Infof("no key found at %v, generating a new one", filename)
+	_, secKey, err = crypto.CreateKeyPair()
+	if err != nil {
+		return
+	}
+	err = crypto.SaveSecretKey(filename, &secKey, passphrase)
+	return
+}
+
+// shutdown stops accepting messages and saves the storage metadata, the
+// segment index and the peer database.
+func (h *host) shutdown() (err error) {
+	h.router.Close()
+	err = h.storage.Save()
+	if err != nil {
+		return
+	}
+	err = h.segments.Save()
+	if err != nil {
+		return
+	}
+	return h.peers.Save()
+}
+
+// runDaemon joins Sia and serves until a signal arrives on stop, then shuts
+// down gracefully.
+func (h *host) runDaemon(stop <-chan os.Signal) (err error) {
+	err = h.state.JoinSia()
+	if err != nil {
+		return
+	}
+	log.Infof("host listening on port %v, advertising %v", h.config.Port, h.router.Address().Host)
+
+	sig := <-stop
+	log.Infof("received %v, shutting down", sig)
+	return h.shutdown()
+}
+
+func main() {
+	config, err := parseConfig(os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	log.SetGlobalFlags(logLevels[config.LogLevel])
+
+	h, err := newHost(config)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	err = h.runDaemon(stop)
+	if err != nil {
+		log.Fatalln(err)
 	}
 }
@@ -2,8 +2,13 @@ package main
 
 import (
 	"common"
+	"common/crypto"
+	"fmt"
+	"io/ioutil"
 	"network"
+	"os"
 	"quorum"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -42,10 +47,261 @@ func TestNetworkedQuorum(t *testing.T) {
 		t.Skip()
 	}
 
-	time.Sleep(3 * common.StepDuration * time.Duration(common.QuorumSize))
+	time.Sleep(3 * common.DefaultStepDuration * time.Duration(common.DefaultQuorumSize))
 
 	// if no seg faults, no errors
 	// there needs to be a s0.ParticipantStatus() call returning a function with public information about the participant
 	// there needs to be a s0.QuorumStatus() call returning public information about the quorum
 	// 		all participants in a public quorum should return the same information
 }
+
+// A daemon shuts down on a signal, closing its server and saving its storage.
+func TestDaemonShutdown(t *testing.T) {
+	config := defaultConfig()
+	config.Port = 9970
+	config.Bootstrap = "localhost:9970"
+	config.StorageDir = "daemonstorage"
+	config.PeerFile = "daemonpeers.json"
+	defer os.RemoveAll(config.StorageDir)
+	defer os.Remove(config.PeerFile)
+
+	h, err := newHost(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan os.Signal, 1)
+	done := make(chan error)
+	go func() {
+		done <- h.runDaemon(stop)
+	}()
+	stop <- syscall.SIGTERM
+	err = <-done
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the metadata was saved and the port was released
+	_, err = os.Stat(config.StorageDir + "/host.conf")
+	if err != nil {
+		t.Error("storage metadata was not saved:", err)
+	}
+	_, err = os.Stat(config.StorageDir + "/segments.json")
+	if err != nil {
+		t.Error("segment index was not saved:", err)
+	}
+	_, err = os.Stat(config.PeerFile)
+	if err != nil {
+		t.Error("peer database was not saved:", err)
+	}
+	rpcs, err := network.NewRPCServer(config.Port)
+	if err != nil {
+		t.Fatal("port still in use after shutdown:", err)
+	}
+	rpcs.Close()
+}
+
+// A second host finds the first through discovery and bootstraps to it.
+func TestDiscoveredBootstrap(t *testing.T) {
+	first := defaultConfig()
+	first.Port = 9971
+	first.StorageDir = "firststorage"
+	first.PeerFile = ""
+	defer os.RemoveAll(first.StorageDir)
+	h0, err := newHost(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h0.shutdown()
+
+	second := first
+	second.Port = 9972
+	second.StorageDir = "secondstorage"
+	second.Seeds = []string{"localhost:9971"}
+	defer os.RemoveAll(second.StorageDir)
+	h1, err := newHost(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h1.shutdown()
+
+	// the second host learned the first host's State address
+	addresses := h1.peers.Addresses()
+	if len(addresses) != 1 || addresses[0] != h0.state.Address() {
+		t.Error("second host discovered", addresses, "expected", h0.state.Address())
+	}
+}
+
+// The first run generates a key; later runs load the same one.
+func TestLoadIdentity(t *testing.T) {
+	defer os.Remove("identity.key")
+	secKey, err := loadIdentity("identity.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := loadIdentity("identity.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reloaded.Public().Compare(secKey.Public()) {
+		t.Error("restarted host did not keep its identity")
+	}
+
+	// a corrupt key file is an error, not a reason to replace the key
+	err = ioutil.WriteFile("identity.key", []byte("corrupt"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = loadIdentity("identity.key")
+	if err == nil {
+		t.Error("loaded a corrupt key file")
+	}
+}
+
+// The host stores only the segments the quorum expects, and deletes them when
+// the quorum drops them.
+func TestSectorSegments(t *testing.T) {
+	config := defaultConfig()
+	config.Port = 9969
+	config.Bootstrap = "localhost:9969"
+	config.StorageDir = "deletestorage"
+	config.PeerFile = "deletepeers.json"
+	defer os.RemoveAll(config.StorageDir)
+	defer os.Remove(config.PeerFile)
+
+	h, err := newHost(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.shutdown()
+
+	// only segments set by an update are accepted
+	data := []byte("segment data")
+	err = h.storeSegment(crypto.Hash{}, data)
+	if err != errUnexpectedSegment {
+		t.Error("stored a segment the quorum did not expect:", err)
+	}
+	segment, err := h.segments.Put(crypto.Hash{}, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.segments.Put(crypto.Hash{2}, data)
+
+	// deleting a sector releases only its own references
+	h.deleteSector(crypto.Hash{}, []crypto.Hash{{1}, segment})
+	h.deleteSector(crypto.Hash{}, []crypto.Hash{segment})
+	if h.segments.References(segment) != 1 {
+		t.Error("expected the other sector's reference to remain, got", h.segments.References(segment))
+	}
+	h.deleteSector(crypto.Hash{2}, []crypto.Hash{segment})
+	if h.segments.References(segment) != 0 {
+		t.Error("segment of deleted sector is still stored")
+	}
+}
+
+// A successor fetches the segments handed off to it from its predecessor.
+func TestFetchSegment(t *testing.T) {
+	var hosts []*host
+	for i, port := range []int{9967, 9968} {
+		config := defaultConfig()
+		config.Port = port
+		config.Bootstrap = "localhost:9967"
+		config.StorageDir = fmt.Sprintf("fetchstorage%v", i)
+		config.PeerFile = fmt.Sprintf("fetchpeers%v.json", i)
+		defer os.RemoveAll(config.StorageDir)
+		defer os.Remove(config.PeerFile)
+
+		h, err := newHost(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer h.shutdown()
+		hosts = append(hosts, h)
+	}
+
+	data := []byte("handed off data")
+	segment, err := hosts[0].segments.Put(crypto.Hash{}, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetched, err := hosts[1].fetchSegment(hosts[0].state.Address(), segment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(fetched) != string(data) {
+		t.Error("fetched the wrong data:", fetched)
+	}
+	if _, err = hosts[1].fetchSegment(hosts[0].state.Address(), crypto.Hash{1}); err == nil {
+		t.Error("fetched a segment that is not stored")
+	}
+
+	// segments that were not handed off are not stored
+	hosts[1].handOff(hosts[0].state.Address(), quorum.HandOffList{
+		Sectors:  []crypto.Hash{{1}},
+		Segments: []crypto.Hash{segment},
+	})
+	if hosts[1].segments.References(segment) != 0 {
+		t.Error("stored a segment that was not handed off")
+	}
+}
+
+// A client's upload is stored only if the quorum expects the segment, and
+// stored segments are served back to clients.
+func TestUploadSegment(t *testing.T) {
+	config := defaultConfig()
+	config.Port = 9955
+	config.Bootstrap = "localhost:9955"
+	config.StorageDir = "uploadstorage"
+	config.PeerFile = "uploadpeers.json"
+	defer os.RemoveAll(config.StorageDir)
+	defer os.Remove(config.PeerFile)
+
+	h, err := newHost(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.shutdown()
+	client, err := network.NewRPCServer(9956)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	server := h.state.Address()
+	server.ID = common.ServerHandlerID
+	upload := common.Upload{Sector: crypto.Hash{1}, Segment: common.Segment{Data: []byte("uploaded data")}}
+	err = client.SendMessage(&common.Message{
+		Dest: server,
+		Proc: "Server.UploadSegment",
+		Args: upload,
+		Resp: nil,
+	})
+	if err == nil || err.Error() != errUnexpectedSegment.Error() {
+		t.Error("host accepted a segment the quorum does not expect:", err)
+	}
+	segment, err := crypto.CalculateHash(upload.Segment.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.segments.References(segment) != 0 {
+		t.Error("rejected segment was stored")
+	}
+
+	_, err = h.segments.Put(crypto.Hash{1}, upload.Segment.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var downloaded common.Segment
+	err = client.SendMessage(&common.Message{
+		Dest: server,
+		Proc: "Server.DownloadSegment",
+		Args: segment,
+		Resp: &downloaded,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(downloaded.Data) != string(upload.Segment.Data) {
+		t.Error("downloaded the wrong data:", downloaded.Data)
+	}
+}